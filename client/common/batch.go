@@ -0,0 +1,106 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BatchConfig Configuration of how bets are grouped before being sent
+type BatchConfig struct {
+	// MaxAmount Bets per batch, or the biggest batch size if Adaptive
+	MaxAmount int
+	// Adaptive Whether the batch size follows the latency of the acks
+	Adaptive bool
+	// MinAmount Smallest batch size if Adaptive
+	MinAmount int
+	// TargetLatency Ack latency under which the batch size keeps growing
+	// if Adaptive
+	TargetLatency time.Duration
+}
+
+// Batch Group of bets sent to the server in a single frame. Seq is
+// assigned in sending order and is used to match the server acks
+type Batch struct {
+	Seq     uint32
+	Bets    []Bet
+	Payload []byte
+
+	// written Set once the batch was written to some server
+	written uint32
+}
+
+func (b *Batch) frame() Frame {
+	return Frame{Type: MsgBatch, Seq: b.Seq, Payload: b.Payload}
+}
+
+// markWritten Records that the batch was written. Returns true only the
+// first time, so a batch written to several replicas or again after a
+// reconnect is counted once
+func (b *Batch) markWritten() bool {
+	return atomic.CompareAndSwapUint32(&b.written, 0, 1)
+}
+
+// batchSource Provides the batches a sender delivers, in sequence order
+type batchSource interface {
+	// nextBatch Returns the next batch, with at most size bets and a frame
+	// of at most maxFrameSize bytes if the source cuts them, or nil if
+	// there are no batches left
+	nextBatch(size int, maxFrameSize int) (*Batch, error)
+	done() bool
+}
+
+// batcher Cuts a list of bets into consecutive batches
+type batcher struct {
+	bets []Bet
+	next int
+	seq  uint32
+}
+
+func newBatcher(bets []Bet) *batcher {
+	return &batcher{bets: bets}
+}
+
+// done True once every bet was put in a batch
+func (b *batcher) done() bool {
+	return b.next >= len(b.bets)
+}
+
+// nextBatch Cuts the next batch with at most size bets. The batch is
+// shortened if its frame would exceed maxFrameSize. nil is returned
+// once there are no bets left
+func (b *batcher) nextBatch(size int, maxFrameSize int) (*Batch, error) {
+	if b.done() {
+		return nil, nil
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	payloadSize := 0
+	end := b.next
+	for end < len(b.bets) && end-b.next < size {
+		betSize := len(b.bets[end].Encode())
+		if end > b.next {
+			betSize += len(betSeparator)
+		}
+		if frameLengthSize+frameHeaderSize+payloadSize+betSize > maxFrameSize {
+			break
+		}
+		payloadSize += betSize
+		end++
+	}
+	if end == b.next {
+		return nil, errors.Errorf("bet %v does not fit in a frame", b.bets[b.next].Document)
+	}
+
+	b.seq++
+	batch := &Batch{
+		Seq:     b.seq,
+		Bets:    b.bets[b.next:end],
+		Payload: EncodeBets(b.bets[b.next:end]),
+	}
+	b.next = end
+	return batch, nil
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// batchSizer Chooses the amount of bets of each batch. If adaptive, the
+// size grows by one bet for every ack received within the target latency
+// and is halved on slower acks or when the connection is lost, always
+// staying between MinAmount and MaxAmount. Batches are still cut so they
+// fit in a frame, whatever the size chosen. It is safe for concurrent use,
+// as the senders of every replica share one
+type batchSizer struct {
+	mu       sync.Mutex
+	config   BatchConfig
+	clientID string
+	metrics  *Metrics
+	size     int
+}
+
+func newBatchSizer(config BatchConfig, clientID string, metrics *Metrics) *batchSizer {
+	s := &batchSizer{config: config, clientID: clientID, metrics: metrics, size: config.MaxAmount}
+	if config.Adaptive {
+		s.size = config.MinAmount
+	}
+	metrics.SetBatchSize(s.size)
+	return s
+}
+
+func (s *batchSizer) current() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// observe Adjusts the size with the latency of the ack of a batch of
+// bets bets. Batches smaller than the size, cut short by the frame limit,
+// do not make it grow
+func (s *batchSizer) observe(latency time.Duration, bets int) {
+	if !s.config.Adaptive {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if latency <= s.config.TargetLatency {
+		if bets >= s.size {
+			s.resize(s.size+1, latency)
+		}
+	} else {
+		s.resize(s.size/2, latency)
+	}
+}
+
+// timeout Shrinks the size after the connection was lost
+func (s *batchSizer) timeout() {
+	if !s.config.Adaptive {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resize(s.size/2, 0)
+}
+
+func (s *batchSizer) resize(size int, latency time.Duration) {
+	if size < s.config.MinAmount {
+		size = s.config.MinAmount
+	}
+	if size > s.config.MaxAmount {
+		size = s.config.MaxAmount
+	}
+	if size == s.size {
+		return
+	}
+
+	grown := size > s.size
+	s.size = size
+	s.metrics.SetBatchSize(size)
+	if grown {
+		log.Debugf("action: batch_size | result: success | client_id: %v | size: %v | latency: %v",
+			s.clientID,
+			size,
+			latency,
+		)
+		return
+	}
+	log.Infof("action: batch_size | result: success | client_id: %v | size: %v | latency: %v",
+		s.clientID,
+		size,
+		latency,
+	)
+}
@@ -0,0 +1,241 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// betFieldSeparator Separates the fields of a serialized bet
+	betFieldSeparator = "/"
+	// betSeparator Separates the bets of a serialized batch
+	betSeparator = ";"
+	// birthdateLayout Format of the birthdates in the agency files
+	birthdateLayout = "2006-01-02"
+)
+
+// Bet A lottery bet placed in an agency
+type Bet struct {
+	Agency    string
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate string
+	Number    string
+}
+
+// Encode Serializes the bet as <Agency>/<FirstName>/<LastName>/<Document>/<Birthdate>/<Number>
+func (b Bet) Encode() string {
+	return strings.Join([]string{
+		b.Agency,
+		b.FirstName,
+		b.LastName,
+		b.Document,
+		b.Birthdate,
+		b.Number,
+	}, betFieldSeparator)
+}
+
+// normalize Converts every field of the bet to NFC, failing if one holds
+// text that cannot be represented
+func (b *Bet) normalize() error {
+	fields := []*string{&b.FirstName, &b.LastName, &b.Document, &b.Birthdate, &b.Number}
+	for _, field := range fields {
+		normalized, err := normalizeField(*field)
+		if err != nil {
+			return err
+		}
+		*field = normalized
+	}
+	return nil
+}
+
+// validate Checks that every field of the bet is present and well formed
+func (b Bet) validate() error {
+	fields := map[string]string{
+		"first_name": b.FirstName,
+		"last_name":  b.LastName,
+		"document":   b.Document,
+		"birthdate":  b.Birthdate,
+		"number":     b.Number,
+	}
+	for name, value := range fields {
+		if value == "" {
+			return errors.Errorf("missing %v", name)
+		}
+		if strings.ContainsAny(value, betFieldSeparator+betSeparator) {
+			return errors.Errorf("%v contains a reserved character", name)
+		}
+	}
+
+	if _, err := strconv.ParseUint(b.Document, 10, 64); err != nil {
+		return errors.Errorf("invalid document %q", b.Document)
+	}
+	if _, err := time.Parse(birthdateLayout, b.Birthdate); err != nil {
+		return errors.Errorf("invalid birthdate %q", b.Birthdate)
+	}
+	if _, err := strconv.Atoi(b.Number); err != nil {
+		return errors.Errorf("invalid number %q", b.Number)
+	}
+	return nil
+}
+
+// EncodeBets Serializes a group of bets separating them with ;
+func EncodeBets(bets []Bet) []byte {
+	encoded := make([]string, len(bets))
+	for i, bet := range bets {
+		encoded[i] = bet.Encode()
+	}
+	return []byte(strings.Join(encoded, betSeparator))
+}
+
+// DecodeBets Parses a group of bets serialized with EncodeBets
+func DecodeBets(payload []byte) ([]Bet, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	var bets []Bet
+	for _, encoded := range strings.Split(string(payload), betSeparator) {
+		fields := strings.Split(encoded, betFieldSeparator)
+		if len(fields) != 6 {
+			return nil, errors.Errorf("malformed bet %q", encoded)
+		}
+		bets = append(bets, Bet{
+			Agency:    fields[0],
+			FirstName: fields[1],
+			LastName:  fields[2],
+			Document:  fields[3],
+			Birthdate: fields[4],
+			Number:    fields[5],
+		})
+	}
+	return bets, nil
+}
+
+// RowError Problem found in a row of a bets file
+type RowError struct {
+	Line int
+	Err  error
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %v: %v", e.Line, e.Err)
+}
+
+// RowErrors Every row of a bets file that could not be loaded
+type RowErrors struct {
+	Path string
+	Rows []RowError
+}
+
+func (e *RowErrors) Error() string {
+	if len(e.Rows) == 1 {
+		return fmt.Sprintf("%v:%v: %v", e.Path, e.Rows[0].Line, e.Rows[0].Err)
+	}
+	return fmt.Sprintf("%v: %v invalid rows, first at %v", e.Path, len(e.Rows), e.Rows[0])
+}
+
+// loadBets Reads the bets of an agency from a file in the format and
+// encoding configured, normalizing every field to NFC. Rows are checked
+// against rules before the built-in checks, leaving out the ones rejected,
+// and the outcome returned as a report. If some rows are not valid, a *RowErrors listing
+// all of them is returned, and an *ErrAborted if a rule aborted the file
+func loadBets(path string, agency string, config InputConfig, rules []*Rule) ([]Bet, *ValidationReport, error) {
+	validator := newValidator(path, rules)
+	bets, err := readBets(path, agency, config, validator)
+	validator.report.Accepted = len(bets)
+	var rowErrors *RowErrors
+	if errors.As(err, &rowErrors) {
+		validator.report.Invalid = len(rowErrors.Rows)
+	}
+	if err != nil {
+		return nil, validator.report, err
+	}
+	return bets, validator.report, nil
+}
+
+// readBets Reads the bets of a file, see loadBets
+func readBets(path string, agency string, config InputConfig, validator *validator) ([]Bet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, detected, err := decodeInput(data, config.Encoding)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v", path)
+	}
+	if config.Encoding == EncodingAuto {
+		log.Debugf("action: detect_encoding | result: success | file: %v | encoding: %v", path, detected)
+	}
+
+	source, err := NewBetSource(bytes.NewReader(data), FormatOf(path, config.Format), config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%v", path)
+	}
+
+	var bets []Bet
+	invalid := &RowErrors{Path: path}
+	for {
+		bet, line, err := source.Next()
+		if err == io.EOF {
+			break
+		}
+		var rowErr RowError
+		if err != nil && !errors.As(err, &rowErr) {
+			return nil, errors.Wrapf(err, "%v", path)
+		}
+		validator.report.Rows++
+		if err != nil {
+			invalid.Rows = append(invalid.Rows, rowErr)
+			continue
+		}
+
+		bet.Agency = agency
+		if err := bet.normalize(); err != nil {
+			invalid.Rows = append(invalid.Rows, RowError{Line: line, Err: err})
+			continue
+		}
+		// Rules go first, so rows they reject are left out instead of
+		// failing the whole file
+		accepted, err := validator.check(bet, line)
+		if err != nil {
+			return nil, err
+		}
+		if !accepted {
+			continue
+		}
+		if err := bet.validate(); err != nil {
+			invalid.Rows = append(invalid.Rows, RowError{Line: line, Err: err})
+			continue
+		}
+		bets = append(bets, bet)
+	}
+	if len(invalid.Rows) > 0 {
+		return nil, invalid
+	}
+	return bets, nil
+}
+
+// logRowErrors Logs every row of err, if it is a *RowErrors
+func logRowErrors(clientID string, err error) {
+	var rowErrors *RowErrors
+	if !errors.As(err, &rowErrors) {
+		return
+	}
+	for _, row := range rowErrors.Rows {
+		log.Warningf("action: load_bet | result: fail | client_id: %v | file: %v | line: %v | error: %v",
+			clientID,
+			rowErrors.Path,
+			row.Line,
+			row.Err,
+		)
+	}
+}
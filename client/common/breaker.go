@@ -0,0 +1,70 @@
+package common
+
+import (
+	"time"
+)
+
+// Circuit breaker states
+const (
+	// circuitClosed Connections go through and their failures are counted
+	circuitClosed = "closed"
+	// circuitOpen Connections are rejected until the cool-down ends
+	circuitOpen = "open"
+	// circuitHalfOpen A single probe connection was let through and its
+	// outcome decides whether the circuit closes or opens again
+	circuitHalfOpen = "half_open"
+)
+
+// circuitBreaker Stops the client from hammering a server that keeps
+// failing. It is not safe for concurrent use, its owner must guard it
+type circuitBreaker struct {
+	state    string
+	failures int
+	// until End of the cool-down while open, or of the probe while half
+	// open. A probe that never reports back is replaced once it expires
+	until time.Time
+}
+
+func newCircuitBreaker() circuitBreaker {
+	return circuitBreaker{state: circuitClosed}
+}
+
+// allow Returns whether a connection can be attempted at now. Once the
+// cool-down of an open circuit ends, the attempt allowed is the probe
+// and the circuit becomes half open
+func (b *circuitBreaker) allow(now time.Time, cooldown time.Duration) bool {
+	if b.state == circuitClosed {
+		return true
+	}
+	if now.Before(b.until) {
+		return false
+	}
+	b.state = circuitHalfOpen
+	b.until = now.Add(cooldown)
+	return true
+}
+
+// failure Records a failure. The circuit opens after maxFailures
+// consecutive failures, or right away if the probe failed. Returns
+// whether the circuit opened
+func (b *circuitBreaker) failure(now time.Time, maxFailures int, cooldown time.Duration) bool {
+	b.failures++
+	if b.state == circuitClosed && b.failures < maxFailures {
+		return false
+	}
+	opened := b.state != circuitOpen
+	b.state = circuitOpen
+	b.failures = 0
+	b.until = now.Add(cooldown)
+	return opened
+}
+
+// success Records a success, closing the circuit. Returns whether the
+// circuit was not closed before
+func (b *circuitBreaker) success() bool {
+	closed := b.state != circuitClosed
+	b.state = circuitClosed
+	b.failures = 0
+	b.until = time.Time{}
+	return closed
+}
@@ -2,7 +2,9 @@ package common
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"time"
 
@@ -15,75 +17,492 @@ var log = logging.MustGetLogger("log")
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
-	LoopAmount    int
-	LoopPeriod    time.Duration
+	// ServerAddresses Servers to connect to. ServerAddress is used if empty
+	ServerAddresses []string
+	Failover        FailoverConfig
+	// Shards Servers the agencies are spread across. If set, the client
+	// only connects to the shard its agency is mapped to
+	Shards            []string
+	ShardVirtualNodes int
+	LoopAmount        int
+	LoopPeriod        time.Duration
+	BetsFile          string
+	Input             InputConfig
+	Validation        ValidationConfig
+	Dedup             DedupConfig
+	Watch             WatchConfig
+	JournalPath       string
+	Batch             BatchConfig
+	Pipeline          PipelineConfig
+	Replication       ReplicationConfig
+	Heartbeat         HeartbeatConfig
+	Compression       CompressionConfig
+	Integrity         IntegrityConfig
+	Results           ResultsConfig
+	Rate              RateConfig
+	Trace             TraceConfig
 }
 
 // Client Entity that encapsulates how
 type Client struct {
-	config ClientConfig
-	conn   net.Conn
+	config    ClientConfig
+	dialer    Dialer
+	conn      net.Conn
+	endpoints *endpointSet
+	current   *endpoint
+	session   Session
+	status    statusTracker
+	limiter   *RateLimiter
+	metrics   *Metrics
+	tracer    *requestTracer
+	// helloRequest Request ID of the hello that agreed session
+	helloRequest uint32
+	// lastRequest Request ID of the last hello or message sent, logged
+	// with the outcome of the operation it belongs to
+	lastRequest uint32
+	// lagging Replicas still catching up with the last file sent
+	lagging *laggingReplicas
 }
 
 // NewClient Initializes a new client receiving the configuration
-// as a parameter
-func NewClient(config ClientConfig) *Client {
+// as a parameter. Connections are opened with dialer, or with a
+// net.Dialer if it is nil
+func NewClient(config ClientConfig, dialer Dialer) *Client {
+	if dialer == nil {
+		dialer = &net.Dialer{KeepAlive: config.Heartbeat.KeepAlive}
+	}
+
+	addresses := config.ServerAddresses
+	if len(addresses) == 0 {
+		addresses = []string{config.ServerAddress}
+	}
+	if len(config.Shards) > 0 {
+		shard := NewShardRing(config.Shards, config.ShardVirtualNodes).ShardOf(config.ID)
+		log.Infof("action: shard | result: success | client_id: %v | shard: %v", config.ID, shard)
+		addresses = []string{shard}
+	}
+
+	metrics := NewMetrics()
+	dialer = &countingDialer{dialer: dialer, metrics: metrics}
 	client := &Client{
-		config: config,
+		config:    config,
+		dialer:    dialer,
+		endpoints: newEndpointSet(addresses, config.Failover, dialer),
+		limiter:   NewRateLimiter(config.Rate, metrics),
+		metrics:   metrics,
+		tracer:    newRequestTracer(config.ID, config.Trace),
 	}
 	return client
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+// SessionID Returns the ID every frame of the client carries along with
+// its request ID
+func (c *Client) SessionID() SessionID {
+	return c.tracer.session
+}
+
+// Session Returns the session agreed with the server on the last
+// connection of the framed protocol
+func (c *Client) Session() Session {
+	return c.session
+}
+
+// Status Returns a snapshot of the current state of the client
+func (c *Client) Status() Status {
+	return c.status.snapshot()
+}
+
+// CreateClientSocket Initializes client socket. Servers are tried in the
+// order given by the selection policy until one accepts the connection.
+// In case no server can be reached, error is printed in stdout/stderr
+// and returned
+func (c *Client) createClientSocket(ctx context.Context) error {
+	conn, e, err := c.endpoints.dial(ctx, c.config.ID)
 	if err != nil {
 		log.Criticalf(
 			"action: connect | result: fail | client_id: %v | error: %v",
 			c.config.ID,
 			err,
 		)
+		return err
+	}
+
+	if e != c.current {
+		log.Infof("action: connect | result: success | client_id: %v | server: %v | ip: %v",
+			c.config.ID,
+			e.address,
+			conn.RemoteAddr(),
+		)
 	}
 	c.conn = conn
+	c.current = e
+	c.status.setServer(e.address, conn.RemoteAddr().String())
+	return nil
+}
+
+// connect Opens a new connection to one of the servers of the client and
+// agrees on the session used over it
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	if err := c.createClientSocket(ctx); err != nil {
+		return nil, err
+	}
+
+	session, request, err := handshake(c.conn, newHello(c.config), c.config.Failover.ConnectTimeout, c.tracer)
+	c.helloRequest, c.lastRequest = request, request
+	if err != nil {
+		c.conn.Close()
+		logHandshakeError(c.config.ID, c.address(), request, err)
+		if !isFatal(err) {
+			c.failed()
+		}
+		return nil, err
+	}
+	if !sameSession(session, c.session) {
+		logSession(c.config.ID, c.address(), request, session)
+	}
+	c.session = session
+	return c.conn, nil
+}
+
+// succeeded Records that the current server answered as expected
+func (c *Client) succeeded() {
+	if c.current != nil {
+		c.endpoints.markSuccess(c.current, c.config.ID)
+	}
+}
+
+// failed Records that the connection to the current server failed
+func (c *Client) failed() {
+	if c.current != nil {
+		c.endpoints.markFailure(c.current, c.config.ID)
+	}
+}
+
+// address Address of the server the client connected to last
+func (c *Client) address() string {
+	if c.current == nil {
+		return ""
+	}
+	return c.current.address
+}
+
+// sendMessage Writes a message to the server once the rate limiter
+// allows it. bets is the amount of bets carried by the message
+func (c *Client) sendMessage(ctx context.Context, msg string, bets int) error {
+	if err := c.limiter.Wait(ctx, bets, len(msg)); err != nil {
+		return err
+	}
+
+	// A write may take only part of the message, so the rest is written
+	// until every byte is sent or the connection fails
+	buf := []byte(msg)
+	for len(buf) > 0 {
+		n, err := c.conn.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
+// sendBets Loads the bets of the agency from BetsFile and sends them to
+// the server, see sendFile
+func (c *Client) sendBets(ctx context.Context) ([]Bet, error) {
+	bets, _, err := c.sendFile(ctx, c.config.BetsFile)
+	return bets, err
+}
+
+// loadFile Loads the bets of the agency from the file at path, applying
+// the validation rules configured. The outcome of the validation is
+// logged, added to the metrics and written to Validation.Report if set
+func (c *Client) loadFile(path string) ([]Bet, *ValidationReport, error) {
+	bets, report, err := loadBets(path, c.config.ID, c.config.Input, c.config.Validation.Rules)
+	logValidation(c.config.ID, report)
+	c.metrics.AddValidation(report)
+	if report != nil {
+		c.metrics.AddRead(report.Rows, report.Invalid)
+	}
+	if c.config.Validation.Report != "" && report != nil {
+		if err := report.WriteJSON(c.config.Validation.Report); err != nil {
+			log.Warningf("action: validation_report | result: fail | client_id: %v | file: %v | error: %v",
+				c.config.ID,
+				c.config.Validation.Report,
+				err,
+			)
+		}
+	}
+	if err != nil {
+		logRowErrors(c.config.ID, err)
+		log.Errorf("action: load_bets | result: fail | client_id: %v | file: %v | error: %v",
+			c.config.ID,
+			path,
+			err,
+		)
+		return nil, report, err
+	}
+	return bets, report, nil
+}
+
+// sendFile Loads the bets of the agency from the file at path and sends
+// them to the server in batches, keeping up to Pipeline.Window batches
+// in flight. Duplicates are handled as configured before. If replicas
+// are configured, the bets are sent to all of them instead. Returns the
+// bets of the file the server holds, which include the duplicates dropped
+// for being stored in a previous session, along with the outcome of their
+// validation
+func (c *Client) sendFile(ctx context.Context, path string) ([]Bet, *ValidationReport, error) {
+	// The replicas that lag behind with the previous file use its journal
+	c.stopLagging()
+
+	bets, report, err := c.loadFile(path)
+	if err != nil {
+		return nil, report, err
+	}
+	bets, stored, err := c.dedup(path, bets)
+	if err != nil {
+		log.Errorf("action: load_bets | result: fail | client_id: %v | file: %v | error: %v",
+			c.config.ID,
+			path,
+			err,
+		)
+		return nil, report, err
+	}
+
+	journal, err := OpenJournal(c.config.JournalPath)
+	if err != nil {
+		log.Errorf("action: open_journal | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, report, err
+	}
+
+	var batches int
+	if len(c.config.Replication.Replicas) > 0 {
+		// The journal is closed once the replicas stop
+		batches, err = c.sendReplicated(ctx, bets, journal)
+	} else {
+		defer journal.Close()
+		sender := newPipelineSender(c, c, &journaledSource{source: newBatcher(bets), journal: journal})
+		sender.onAck = func(b *Batch) {
+			c.metrics.AddAcked(len(b.Bets))
+			if err := journal.AppendAck(c.address(), b.Seq); err != nil {
+				log.Warningf("action: journal_ack | result: fail | client_id: %v | seq: %v | error: %v",
+					c.config.ID,
+					b.Seq,
+					err,
+				)
+			}
+		}
+		sender.onRTT = c.status.setHeartbeatRTT
+		err = sender.run(ctx)
+		batches = sender.inflight.ackedCount()
+	}
+
+	if err != nil {
+		log.Errorf("action: send_bets | result: fail | client_id: %v | acked_batches: %v | error: %v",
+			c.config.ID,
+			batches,
+			err,
+		)
+		return nil, report, err
+	}
+
+	log.Infof("action: send_bets | result: success | client_id: %v | file: %v | bets: %v | batches: %v",
+		c.config.ID,
+		path,
+		len(bets),
+		batches,
+	)
+	return stored, report, nil
+}
+
+// awaitDraw Tells the server the agency finished sending bets, checking
+// that the server stored the same bets, and, if configured to, waits for
+// the winners of the agency. Winners are checked against the bets of the
+// file and exported if an output file is configured. Returns the
+// winners, nil if they were not received, and why the draw could not be
+// completed or verified, if it could not
+func (c *Client) awaitDraw(ctx context.Context, bets []Bet) (*WinnersReport, string) {
+	sent := NewSubmission(c.config.ID, bets)
+	stored, server, err := c.finishBets(ctx, sent)
+	if err != nil {
+		log.Errorf("action: finish_bets | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err.Error()
+	}
+	log.Infof("action: finish_bets | result: success | client_id: %v", c.config.ID)
+
+	reason := ""
+	if stored != nil {
+		logReconcile(c.config.ID, server, sent, *stored)
+		if !sent.Matches(*stored) {
+			reason = "the server did not store the bets sent"
+		}
+	} else {
+		log.Warningf("action: reconcile | result: fail | client_id: %v | server: %v | error: the server did not report the bets it stored",
+			c.config.ID,
+			server,
+		)
+	}
+
+	if !c.config.Results.Wait {
+		return nil, reason
+	}
+
+	result, err := c.waitResults(ctx)
+	if err != nil {
+		log.Errorf("action: consulta_ganadores | result: fail | client_id: %v | error: %v",
+			c.config.ID,
+			err,
+		)
+		return nil, err.Error()
+	}
+	log.Infof("action: consulta_ganadores | result: success | client_id: %v | numero_ganador: %v | cant_ganadores: %v",
+		c.config.ID,
+		result.WinningNumber,
+		len(result.Winners),
+	)
+
+	winners := VerifyWinners(c.config.ID, bets, result)
+	logWinners(c.config.ID, winners)
+	if !winners.Consistent() && reason == "" {
+		reason = "the winners announced do not match the local bets"
+	}
+	if c.config.Results.Output == "" {
+		return winners, reason
+	}
+	if err := winners.Write(c.config.Results.Output, c.config.Results.Format); err != nil {
+		log.Errorf("action: export_winners | result: fail | client_id: %v | file: %v | error: %v",
+			c.config.ID,
+			c.config.Results.Output,
+			err,
+		)
+		return winners, err.Error()
+	}
+	log.Infof("action: export_winners | result: success | client_id: %v | file: %v | winners: %v",
+		c.config.ID,
+		c.config.Results.Output,
+		len(winners.Winners),
+	)
+	return winners, reason
+}
+
+// sendSession Sends the bets of BetsFile and waits for the draw, then
+// summarizes the session. It is partial if some bets were left out or
+// the draw could not be completed or verified, and failed if no bet was
+// stored
+func (c *Client) sendSession(ctx context.Context, start time.Time) *SessionSummary {
+	bets, err := c.sendBets(ctx)
+	if err != nil {
+		status := SessionFailed
+		if acked, _ := c.metrics.Acked(); acked > 0 {
+			status = SessionPartial
+		}
+		return c.summarize(start, status, err.Error(), nil)
+	}
+
+	winners, reason := c.awaitDraw(ctx, bets)
+	c.stopLagging()
+	var count *int
+	if winners != nil {
+		n := winners.ServerWinners
+		count = &n
+	}
+
+	summary := c.summarize(start, SessionSuccess, reason, count)
+	if reason == "" && summary.BetsRejected > 0 {
+		summary.Error = "some bets of the file were left out"
+	}
+	if summary.Error != "" {
+		summary.Status = SessionPartial
+	}
+	return summary
+}
+
+// StartClientLoop Send messages to the client until some time threshold is met.
+// If a bets file is configured, its bets are sent instead. Returns the
+// summary of the session
+func (c *Client) StartClientLoop(ctx context.Context) *SessionSummary {
+	start := time.Now()
+	defer func() {
+		c.stopLagging()
+		c.metrics.Log(c.config.ID)
+		c.Status().Log(c.config.ID)
+	}()
+
+	if c.config.BetsFile != "" {
+		return c.sendSession(ctx, start)
+	}
+
+	// failed Summary of a loop interrupted after the messages before msgID
+	failed := func(msgID int, err error) *SessionSummary {
+		status := SessionFailed
+		if msgID > 1 {
+			status = SessionPartial
+		}
+		return c.summarize(start, status, err.Error(), nil)
+	}
+
 	// There is an autoincremental msgID to identify every message sent
 	// Messages if the message amount threshold has not been surpassed
 	for msgID := 1; msgID <= c.config.LoopAmount; msgID++ {
 		// Create the connection the server in every loop iteration. Send an
-		c.createClientSocket()
+		if err := c.createClientSocket(ctx); err != nil {
+			return failed(msgID, err)
+		}
 
-		// TODO: Modify the send to avoid short-write
-		fmt.Fprintf(
-			c.conn,
-			"[CLIENT %v] Message N°%v\n",
-			c.config.ID,
-			msgID,
+		err := c.sendMessage(
+			ctx,
+			fmt.Sprintf("[CLIENT %v] Message N°%v\n", c.config.ID, msgID),
+			1,
 		)
+		if err != nil {
+			c.conn.Close()
+			log.Errorf("action: send_message | result: fail | client_id: %v | error: %v",
+				c.config.ID,
+				err,
+			)
+			return failed(msgID, err)
+		}
+
 		msg, err := bufio.NewReader(c.conn).ReadString('\n')
 		c.conn.Close()
 
 		if err != nil {
+			c.failed()
 			log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
 				c.config.ID,
 				err,
 			)
-			return
+			return failed(msgID, err)
 		}
+		c.succeeded()
 
 		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
 			c.config.ID,
 			msg,
 		)
 
-		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.LoopPeriod)
+		// Wait a time between sending one message and the next one. The wait
+		// is interrupted if the client is shutting down
+		select {
+		case <-time.After(c.config.LoopPeriod):
+		case <-ctx.Done():
+			log.Infof("action: loop_finished | result: cancelled | client_id: %v", c.config.ID)
+			if msgID < c.config.LoopAmount {
+				return failed(msgID+1, ctx.Err())
+			}
+			return c.summarize(start, SessionSuccess, "", nil)
+		}
 
 	}
 	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return c.summarize(start, SessionSuccess, "", nil)
 }
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// CompressionConfig Configuration of the compression of frame payloads.
+// It is only used if the server agreed to FeatureCompression
+type CompressionConfig struct {
+	Enabled bool
+	// Threshold Payloads smaller than this amount of bytes are sent as is
+	Threshold int
+	// MaxDecompressedSize Biggest payload accepted after decompressing a
+	// frame, so a small frame cannot expand without bounds
+	MaxDecompressedSize int
+}
+
+// ErrDecompressedTooLarge Returned when a payload decompresses to more
+// bytes than allowed
+var ErrDecompressedTooLarge = errors.New("decompressed payload too large")
+
+// CompressFrame Returns f with its payload compressed with DEFLATE if it
+// has at least threshold bytes and compressing makes it smaller
+func CompressFrame(f Frame, threshold int) (Frame, error) {
+	if f.Flags&FlagCompressed != 0 || len(f.Payload) < threshold {
+		return f, nil
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return f, err
+	}
+	if _, err := w.Write(f.Payload); err != nil {
+		return f, err
+	}
+	if err := w.Close(); err != nil {
+		return f, err
+	}
+	if buf.Len() >= len(f.Payload) {
+		return f, nil
+	}
+
+	f.Flags |= FlagCompressed
+	f.Payload = buf.Bytes()
+	return f, nil
+}
+
+// DecompressFrame Returns f with its payload decompressed if it has
+// FlagCompressed set. Payloads decompressing to more than maxSize bytes
+// are rejected with ErrDecompressedTooLarge
+func DecompressFrame(f Frame, maxSize int) (Frame, error) {
+	if f.Flags&FlagCompressed == 0 {
+		return f, nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(f.Payload))
+	defer r.Close()
+	// Reading one byte past the limit tells a payload of exactly maxSize
+	// bytes apart from a bigger one
+	payload, err := ioutil.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return f, errors.Wrapf(err, "invalid compressed payload")
+	}
+	if len(payload) > maxSize {
+		return f, ErrDecompressedTooLarge
+	}
+
+	f.Flags &^= FlagCompressed
+	f.Payload = payload
+	return f, nil
+}
@@ -0,0 +1,64 @@
+package common_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"runtime"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// deflate Returns a frame holding size zero bytes compressed, written in
+// chunks so the payload is never held whole
+func deflate(t *testing.T, size int) common.Frame {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, 64*1024)
+	for written := 0; written < size; written += len(chunk) {
+		if size-written < len(chunk) {
+			chunk = chunk[:size-written]
+		}
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return common.Frame{Type: common.MsgBatch, Flags: common.FlagCompressed, Payload: buf.Bytes()}
+}
+
+// TestDecompressLimit A payload of exactly the limit is accepted
+func TestDecompressLimit(t *testing.T) {
+	const limit = 64 * 1024
+	frame, err := common.DecompressFrame(deflate(t, limit), limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frame.Payload) != limit || frame.Flags&common.FlagCompressed != 0 {
+		t.Fatalf("decompressed %v bytes with flags %v, expected %v uncompressed bytes", len(frame.Payload), frame.Flags, limit)
+	}
+}
+
+// TestDecompressTooLarge A payload inflating past the limit is rejected
+// after reading just past the limit, not once it was inflated whole
+func TestDecompressTooLarge(t *testing.T) {
+	const limit, size = 64 * 1024, 64 * 1024 * 1024
+	frame := deflate(t, size)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := common.DecompressFrame(frame, limit)
+	runtime.ReadMemStats(&after)
+	if err != common.ErrDecompressedTooLarge {
+		t.Fatalf("decompressed with %v, expected %v", err, common.ErrDecompressedTooLarge)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16*1024*1024 {
+		t.Fatalf("%v bytes allocated to reject the payload, expected it not to be inflated whole", allocated)
+	}
+}
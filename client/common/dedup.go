@@ -0,0 +1,302 @@
+package common
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Policies for duplicate bets
+const (
+	// DuplicatesOff Duplicates are not looked for
+	DuplicatesOff = "off"
+	// DuplicatesWarn Duplicates are reported and sent anyway
+	DuplicatesWarn = "warn"
+	// DuplicatesDrop Only the first occurrence of a key is sent, and none
+	// if it was already submitted
+	DuplicatesDrop = "drop"
+	// DuplicatesFail Nothing of a file with duplicates is sent
+	DuplicatesFail = "fail"
+)
+
+// Where a duplicate key was seen first
+const (
+	duplicateInFile    = "file"
+	duplicateInJournal = "journal"
+)
+
+// maxLoggedDuplicates Duplicates listed in the error of a failed file
+const maxLoggedDuplicates = 10
+
+// DedupConfig Configuration of how duplicate bets are found. A bet is a
+// duplicate of an earlier bet of the same file, or of a bet of the agency
+// acknowledged in a previous session of the journal, with the same key
+type DedupConfig struct {
+	// Key Fields of a bet compared to find duplicates
+	Key []string
+	// Policy What is done with duplicates, see DuplicatesWarn
+	Policy string
+	// ExpectedBets Bets of a file the Bloom filter is sized for, on top of
+	// the ones of the journal. Larger files are sized for their own bets
+	ExpectedBets int
+	// FalsePositiveRate False positives of the Bloom filter when holding
+	// ExpectedBets bets
+	FalsePositiveRate float64
+}
+
+// Validate Returns an error if the configuration cannot be used
+func (c DedupConfig) Validate() error {
+	switch c.Policy {
+	case DuplicatesOff, DuplicatesWarn, DuplicatesDrop, DuplicatesFail:
+	default:
+		return errors.Errorf("unknown policy %q, expected %v, %v, %v or %v", c.Policy, DuplicatesOff, DuplicatesWarn, DuplicatesDrop, DuplicatesFail)
+	}
+	if c.Policy == DuplicatesOff {
+		return nil
+	}
+	if len(c.Key) == 0 {
+		return errors.New("empty key")
+	}
+	for _, field := range c.Key {
+		if !containsString(betFields, field) {
+			return errors.Errorf("unknown field %q in key, expected one of %v", field, strings.Join(betFields, ", "))
+		}
+	}
+	if c.ExpectedBets < 1 {
+		return errors.Errorf("invalid expected bets %v", c.ExpectedBets)
+	}
+	if c.FalsePositiveRate <= 0 || c.FalsePositiveRate >= 1 {
+		return errors.Errorf("invalid false positive rate %v, must be between 0 and 1", c.FalsePositiveRate)
+	}
+	return nil
+}
+
+// key Values of the key fields of b
+func (c DedupConfig) key(b Bet) string {
+	values := make([]string, len(c.Key))
+	for i, field := range c.Key {
+		values[i] = b.field(field)
+	}
+	return strings.Join(values, betFieldSeparator)
+}
+
+// bloomFilter Set of keys that may report keys never added as present,
+// with a bounded rate
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64
+	hashes int
+}
+
+// newBloomFilter Sizes a filter to hold n keys with a rate p of false
+// positives
+func newBloomFilter(n int, p float64) *bloomFilter {
+	size := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if size < 64 {
+		size = 64
+	}
+	hashes := int(math.Round(float64(size) / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (size+63)/64), size: size, hashes: hashes}
+}
+
+// add Adds key to the filter. Returns whether it may have been added
+// before
+func (f *bloomFilter) add(key string) bool {
+	// Double hashing derives every hash from two independent ones
+	h1 := fnv.New64a()
+	h1.Write([]byte(key))
+	h2 := fnv.New64()
+	h2.Write([]byte(key))
+	a, b := h1.Sum64(), h2.Sum64()|1
+
+	present := true
+	for i := 0; i < f.hashes; i++ {
+		bit := (a + uint64(i)*b) % f.size
+		mask := uint64(1) << (bit % 64)
+		if f.bits[bit/64]&mask == 0 {
+			present = false
+			f.bits[bit/64] |= mask
+		}
+	}
+	return present
+}
+
+// Duplicate Bet whose key was already seen
+type Duplicate struct {
+	Key string `json:"key"`
+	// Source Where the key was seen first, the file or the journal
+	Source string `json:"source"`
+}
+
+// DuplicatesError Returned when a file with duplicates is loaded with
+// DuplicatesFail
+type DuplicatesError struct {
+	Path       string
+	Duplicates []Duplicate
+}
+
+func (e *DuplicatesError) Error() string {
+	shown := e.Duplicates
+	if len(shown) > maxLoggedDuplicates {
+		shown = shown[:maxLoggedDuplicates]
+	}
+	keys := make([]string, len(shown))
+	for i, d := range shown {
+		keys[i] = fmt.Sprintf("%v (%v)", d.Key, d.Source)
+	}
+	return fmt.Sprintf("%v: %v duplicate bets: %v", e.Path, len(e.Duplicates), strings.Join(keys, ", "))
+}
+
+// findDuplicates Returns which bets of the agency are duplicates, along
+// with the duplicates found in order and the bets of the journal their
+// keys were first acknowledged with. Keys are first added to a Bloom
+// filter, along with the ones acknowledged in the journal at journalPath
+// if set, and only the keys it reports as repeated are verified exactly
+func findDuplicates(agency string, bets []Bet, config DedupConfig, journalPath string) ([]bool, []Duplicate, map[string]Bet, error) {
+	forEachJournaled := func(fn func(string, Bet)) error {
+		if journalPath == "" {
+			return nil
+		}
+		return forEachSubmitted(journalPath, func(b Bet) {
+			if b.Agency == agency {
+				fn(config.key(b), b)
+			}
+		})
+	}
+
+	journaled := 0
+	err := forEachJournaled(func(string, Bet) {
+		journaled++
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	expected := config.ExpectedBets
+	if expected < len(bets) {
+		expected = len(bets)
+	}
+	filter := newBloomFilter(expected+journaled, config.FalsePositiveRate)
+
+	err = forEachJournaled(func(key string, _ Bet) {
+		filter.add(key)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	candidates := make(map[string]bool)
+	for _, b := range bets {
+		if key := config.key(b); filter.add(key) {
+			candidates[key] = true
+		}
+	}
+	if len(candidates) == 0 {
+		return make([]bool, len(bets)), nil, nil, nil
+	}
+
+	submitted := make(map[string]Bet)
+	err = forEachJournaled(func(key string, b Bet) {
+		if _, ok := submitted[key]; candidates[key] && !ok {
+			submitted[key] = b
+		}
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	duplicated := make([]bool, len(bets))
+	var duplicates []Duplicate
+	seen := make(map[string]bool)
+	for i, b := range bets {
+		key := config.key(b)
+		if !candidates[key] {
+			continue
+		}
+		_, inJournal := submitted[key]
+		switch {
+		case inJournal:
+			duplicates = append(duplicates, Duplicate{Key: key, Source: duplicateInJournal})
+		case seen[key]:
+			duplicates = append(duplicates, Duplicate{Key: key, Source: duplicateInFile})
+		default:
+			seen[key] = true
+			continue
+		}
+		duplicated[i] = true
+	}
+	return duplicated, duplicates, submitted, nil
+}
+
+// dedup Looks for duplicates among the bets loaded from the file at path
+// and applies the policy configured to them. Returns the bets to send,
+// and the bets of the file the server holds once they are stored, which
+// with DuplicatesDrop include the ones acknowledged in previous sessions
+func (c *Client) dedup(path string, bets []Bet) ([]Bet, []Bet, error) {
+	config := c.config.Dedup
+	if config.Policy == DuplicatesOff {
+		return bets, bets, nil
+	}
+
+	duplicated, duplicates, journaled, err := findDuplicates(c.config.ID, bets, config, c.config.JournalPath)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not look for duplicates")
+	}
+	c.metrics.AddDuplicates(len(duplicates))
+
+	inFile, submitted := 0, 0
+	for _, d := range duplicates {
+		log.Debugf("action: find_duplicates | result: fail | client_id: %v | file: %v | key: %v | source: %v",
+			c.config.ID,
+			path,
+			d.Key,
+			d.Source,
+		)
+		if d.Source == duplicateInFile {
+			inFile++
+		} else {
+			submitted++
+		}
+	}
+	if len(duplicates) == 0 {
+		log.Infof("action: find_duplicates | result: success | client_id: %v | file: %v | duplicates: 0", c.config.ID, path)
+		return bets, bets, nil
+	}
+	log.Warningf("action: find_duplicates | result: fail | client_id: %v | file: %v | policy: %v | duplicates: %v | in_file: %v | already_submitted: %v",
+		c.config.ID,
+		path,
+		config.Policy,
+		len(duplicates),
+		inFile,
+		submitted,
+	)
+
+	switch config.Policy {
+	case DuplicatesFail:
+		return nil, nil, &DuplicatesError{Path: path, Duplicates: duplicates}
+	case DuplicatesDrop:
+		// Duplicates of bets already stored are not left out of the file
+		c.metrics.AddDropped(inFile)
+		kept := make([]Bet, 0, len(bets)-len(duplicates))
+		stored := make([]Bet, 0, len(bets))
+		for i, b := range bets {
+			if !duplicated[i] {
+				kept = append(kept, b)
+				stored = append(stored, b)
+				continue
+			}
+			// The server holds the bet as it was journaled, once
+			key := config.key(b)
+			if journaledBet, ok := journaled[key]; ok {
+				stored = append(stored, journaledBet)
+				delete(journaled, key)
+			}
+		}
+		return kept, stored, nil
+	}
+	return bets, bets, nil
+}
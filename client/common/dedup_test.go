@@ -0,0 +1,173 @@
+package common_test
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// TestDedupDropResumedFile Sending a file again after a previous session
+// stored part of it drops the bets journaled, and the bets stored and the
+// winners are still checked against the whole file
+func TestDedupDropResumedFile(t *testing.T) {
+	config := testserver.DefaultConfig()
+	// The bet of the line 10 wins, and it is sent by the first session
+	config.WinningNumber = "1010"
+	address, server := startServer(t, config)
+
+	const stored, bets = 50, 100
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+	run := func(n int) *common.SessionSummary {
+		clientConfig := testConfig(address, writeBetsFile(t, n))
+		clientConfig.JournalPath = journal
+		clientConfig.Dedup = common.DedupConfig{
+			Key:               []string{"document", "number"},
+			Policy:            common.DuplicatesDrop,
+			ExpectedBets:      10,
+			FalsePositiveRate: 0.01,
+		}
+		clientConfig.Results.Wait = true
+		return common.NewClient(clientConfig, nil).StartClientLoop(context.Background())
+	}
+
+	if summary := run(stored); summary.Status != common.SessionSuccess {
+		t.Fatalf("first session ended as %v: %v", summary.Status, summary.Error)
+	}
+	summary := run(bets)
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("second session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if summary.Winners == nil || *summary.Winners != 1 {
+		t.Fatalf("second session got %v winners, expected 1", summary.Winners)
+	}
+	if n := len(server.Bets(testAgency)); n != bets {
+		t.Fatalf("server stored %v bets, expected %v", n, bets)
+	}
+}
+
+// dedupConfig Configuration of a client that sends the bets of betsFile to
+// the server at address, journaling them at journal and handling
+// duplicates with policy
+func dedupConfig(address string, betsFile string, journal string, policy string) common.ClientConfig {
+	config := testConfig(address, betsFile)
+	config.JournalPath = journal
+	config.Dedup = common.DedupConfig{
+		Key:               []string{"document", "number"},
+		Policy:            policy,
+		ExpectedBets:      10,
+		FalsePositiveRate: 0.01,
+	}
+	return config
+}
+
+// repeatedBets Bets of a file whose third row repeats the first one
+const repeatedBets = "Ana,Perez,30000001,1990-01-02,1001\n" +
+	"Eva,Perez,30000002,1990-01-02,1002\n" +
+	"Ana,Perez,30000001,1990-01-02,1001\n"
+
+// TestDedupWarn Duplicates found with DuplicatesWarn are sent anyway
+func TestDedupWarn(t *testing.T) {
+	address, server := startServer(t, testserver.DefaultConfig())
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+	config := dedupConfig(address, writeFile(t, "agency-1.csv", repeatedBets), journal, common.DuplicatesWarn)
+
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if summary.BetsSent != 3 || summary.BetsRejected != 0 {
+		t.Fatalf("%v bets sent and %v rejected, expected every row to be sent", summary.BetsSent, summary.BetsRejected)
+	}
+	if n := len(server.Bets(testAgency)); n != 3 {
+		t.Fatalf("server stored %v bets, expected the 3 rows", n)
+	}
+}
+
+// TestDedupFail Nothing of a file with duplicates is sent with
+// DuplicatesFail, and the duplicates are reported
+func TestDedupFail(t *testing.T) {
+	address, server := startServer(t, testserver.DefaultConfig())
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+	path := writeFile(t, "agency-1.csv", repeatedBets)
+	config := dedupConfig(address, path, journal, common.DuplicatesFail)
+
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionFailed {
+		t.Fatalf("session ended as %v, expected the duplicates to fail it", summary.Status)
+	}
+	if !strings.Contains(summary.Error, path+": 1 duplicate bets") {
+		t.Fatalf("session failed with %q, expected the duplicate to be reported", summary.Error)
+	}
+	if summary.BetsSent != 0 {
+		t.Fatalf("%v bets sent, expected none", summary.BetsSent)
+	}
+	if n := len(server.Bets(testAgency)); n != 0 {
+		t.Fatalf("server stored %v bets, expected none", n)
+	}
+}
+
+// TestDedupDropAllJournaled Sending again a file fully stored in a
+// previous session sends nothing, and the bets stored are still checked
+// against the whole file
+func TestDedupDropAllJournaled(t *testing.T) {
+	config := testserver.DefaultConfig()
+	config.WinningNumber = "1010"
+	address, server := startServer(t, config)
+
+	const bets = 50
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+	clientConfig := dedupConfig(address, writeBetsFile(t, bets), journal, common.DuplicatesDrop)
+	clientConfig.Results.Wait = true
+
+	if summary := common.NewClient(clientConfig, nil).StartClientLoop(context.Background()); summary.Status != common.SessionSuccess {
+		t.Fatalf("first session ended as %v: %v", summary.Status, summary.Error)
+	}
+	summary := common.NewClient(clientConfig, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("second session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if summary.BetsSent != 0 {
+		t.Fatalf("second session sent %v bets, expected none", summary.BetsSent)
+	}
+	if summary.Winners == nil || *summary.Winners != 1 {
+		t.Fatalf("second session got %v winners, expected 1", summary.Winners)
+	}
+	assertStored(t, server, bets)
+}
+
+// TestDedupBloomFalsePositives Keys the Bloom filter reports as seen are
+// verified against the journal, so unseen keys are never duplicates
+func TestDedupBloomFalsePositives(t *testing.T) {
+	address, _ := startServer(t, testserver.DefaultConfig())
+	journal := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	first := dedupConfig(address, writeBetsFile(t, 50), journal, common.DuplicatesFail)
+	if summary := common.NewClient(first, nil).StartClientLoop(context.Background()); summary.Status != common.SessionSuccess {
+		t.Fatalf("first session ended as %v: %v", summary.Status, summary.Error)
+	}
+
+	// Other numbers for the same documents, so no key was journaled
+	var content strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&content, "Nombre%v,Apellido%v,%v,1990-01-02,%v\n", i, i, 30000000+i, 5000+i)
+	}
+	// The file is stored by another server, it only shares the journal
+	address, server := startServer(t, testserver.DefaultConfig())
+	second := dedupConfig(address, writeFile(t, "agency-1.csv", content.String()), journal, common.DuplicatesFail)
+	// The smallest filter, 64 bits with a single hash, holds the 150 keys
+	// of the journal and the file, so most of them collide
+	second.Dedup.ExpectedBets = 1
+	second.Dedup.FalsePositiveRate = 0.99
+	summary := common.NewClient(second, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("second session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if n := len(server.Bets(testAgency)); n != 100 {
+		t.Fatalf("server stored %v bets, expected every bet of the file", n)
+	}
+}
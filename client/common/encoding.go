@@ -0,0 +1,110 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Encodings of the bets files
+const (
+	// EncodingAuto Detects the encoding of every file. Files starting with
+	// a UTF-8 BOM or that hold valid UTF-8 sequences are read as UTF-8,
+	// the rest as Latin-1
+	EncodingAuto = "auto"
+	// EncodingUTF8 UTF-8, with or without BOM
+	EncodingUTF8 = "utf-8"
+	// EncodingLatin1 ISO-8859-1, as written by old spreadsheet exports
+	EncodingLatin1 = "latin-1"
+)
+
+var (
+	utf8BOM    = []byte{0xEF, 0xBB, 0xBF}
+	utf16BEBOM = []byte{0xFE, 0xFF}
+	utf16LEBOM = []byte{0xFF, 0xFE}
+)
+
+// ValidateEncoding Returns an error if encoding is not one of the
+// supported encodings
+func ValidateEncoding(encoding string) error {
+	switch encoding {
+	case EncodingAuto, EncodingUTF8, EncodingLatin1:
+		return nil
+	}
+	return errors.Errorf("unknown encoding %q, expected %v, %v or %v", encoding, EncodingAuto, EncodingUTF8, EncodingLatin1)
+}
+
+// decodeInput Returns the content of a bets file in UTF-8, without BOM,
+// along with the encoding it was read as. UTF-8 content is returned as
+// is, so invalid sequences are found by normalizeField in the row holding
+// them
+func decodeInput(data []byte, encoding string) ([]byte, string, error) {
+	if bytes.HasPrefix(data, utf16BEBOM) || bytes.HasPrefix(data, utf16LEBOM) {
+		return nil, "", errors.New("UTF-16 files are not supported")
+	}
+	if bytes.HasPrefix(data, utf8BOM) {
+		if encoding == EncodingLatin1 {
+			return nil, "", errors.New("the file starts with a UTF-8 BOM but latin-1 was configured")
+		}
+		return data[len(utf8BOM):], EncodingUTF8, nil
+	}
+
+	if encoding == EncodingAuto {
+		encoding = detectEncoding(data)
+	}
+	if encoding == EncodingLatin1 {
+		decoded, err := charmap.ISO8859_1.NewDecoder().Bytes(data)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "could not decode the file as latin-1")
+		}
+		return decoded, EncodingLatin1, nil
+	}
+	return data, EncodingUTF8, nil
+}
+
+// detectEncoding Guesses the encoding of data. Latin-1 is only assumed
+// when data holds bytes that are not valid UTF-8 and no multi-byte UTF-8
+// sequence at all, since a Latin-1 text matching a UTF-8 sequence by
+// chance is unlikely. Invalid bytes in a UTF-8 file are then reported
+// instead of mangling the whole file
+func detectEncoding(data []byte) string {
+	valid := false
+	invalid := false
+	for i := 0; i < len(data); {
+		if data[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if r == utf8.RuneError && size == 1 {
+			invalid = true
+		} else {
+			valid = true
+		}
+		i += size
+	}
+	if invalid && !valid {
+		return EncodingLatin1
+	}
+	return EncodingUTF8
+}
+
+// normalizeField Checks that value holds printable text and returns it in
+// NFC, so the same name is always sent as the same bytes
+func normalizeField(value string) (string, error) {
+	if !utf8.ValidString(value) {
+		return "", errors.Errorf("invalid UTF-8 in %q", strings.ToValidUTF8(value, "�"))
+	}
+	for _, r := range value {
+		// C1 controls come from bytes meant for another code page, such as
+		// the quotes of Windows-1252 read as Latin-1
+		if r < ' ' || (r >= 0x7F && r <= 0x9F) {
+			return "", errors.Errorf("character %U cannot be represented in %q", r, strings.ToValidUTF8(value, "�"))
+		}
+	}
+	return norm.NFC.String(value), nil
+}
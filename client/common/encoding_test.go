@@ -0,0 +1,74 @@
+package common_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// TestEncodingNames Names are sent in UTF-8 and NFC whatever the encoding
+// and normalization form of the file
+func TestEncodingNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		content  string
+	}{
+		{"utf-8 bom", common.EncodingAuto, "\xef\xbb\xbfMuñoz,Perez,30000001,1990-01-02,1001\n"},
+		{"latin-1", common.EncodingLatin1, "Mu\xf1oz,Perez,30000001,1990-01-02,1001\n"},
+		{"latin-1 detected", common.EncodingAuto, "Mu\xf1oz,Perez,30000001,1990-01-02,1001\n"},
+		{"nfd", common.EncodingUTF8, "Mun\u0303oz,Perez,30000001,1990-01-02,1001\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, server := startServer(t, testserver.DefaultConfig())
+			path := filepath.Join(t.TempDir(), "agency-1.csv")
+			if err := os.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			config := testConfig(address, path)
+			config.Input.Encoding = test.encoding
+			summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+			if summary.Status != common.SessionSuccess {
+				t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+			}
+			bets := server.Bets(testAgency)
+			if len(bets) != 1 || bets[0].FirstName != "Muñoz" {
+				t.Fatalf("server stored %+v, expected the first name %q", bets, "Muñoz")
+			}
+		})
+	}
+}
+
+// TestEncodingUnrepresentable A Latin-1 byte that has no printable
+// character, such as a Windows-1252 quote, is reported in the row holding
+// it while the rest of the file is still read
+func TestEncodingUnrepresentable(t *testing.T) {
+	address, _ := startServer(t, testserver.DefaultConfig())
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	content := "Ana,Perez,30000001,1990-01-02,1001\n" +
+		"\x93Eva\x94,Perez,30000002,1990-01-02,1002\n" +
+		"Mu\xf1oz,Perez,30000003,1990-01-02,1003\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(address, path)
+	config.Input.Encoding = common.EncodingLatin1
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionFailed {
+		t.Fatalf("session ended as %v, expected the invalid row to fail it", summary.Status)
+	}
+	if summary.BetsRead != 3 {
+		t.Fatalf("%v rows read, expected every row of the file", summary.BetsRead)
+	}
+	if !strings.Contains(summary.Error, path+":2:") || !strings.Contains(summary.Error, "U+0093 cannot be represented") {
+		t.Fatalf("session failed with %q, expected the character of line 2 to be reported", summary.Error)
+	}
+}
@@ -0,0 +1,222 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Server selection policies
+const (
+	// SelectionPriority Always tries the servers in the order they were listed
+	SelectionPriority = "priority"
+	// SelectionRoundRobin Starts each connection with the server following
+	// the one used last
+	SelectionRoundRobin = "round_robin"
+)
+
+// FailoverConfig Configuration of how the client picks a server from
+// ServerAddresses
+type FailoverConfig struct {
+	Selection string
+	// MaxFailures Consecutive failures after which the circuit breaker of
+	// a server opens
+	MaxFailures int
+	// Cooldown Time a server with an open circuit is skipped before a probe
+	// connection is let through
+	Cooldown time.Duration
+	// ConnectTimeout Maximum time spent connecting to a single address
+	ConnectTimeout time.Duration
+}
+
+// endpoint A server address along with its health
+type endpoint struct {
+	address string
+	breaker circuitBreaker
+}
+
+// endpointSet Addresses of the servers the client can connect to
+type endpointSet struct {
+	mu        sync.Mutex
+	config    FailoverConfig
+	dialer    Dialer
+	endpoints []*endpoint
+	next      int
+}
+
+func newEndpointSet(addresses []string, config FailoverConfig, dialer Dialer) *endpointSet {
+	set := &endpointSet{config: config, dialer: dialer}
+	for _, address := range addresses {
+		set.endpoints = append(set.endpoints, &endpoint{address: address, breaker: newCircuitBreaker()})
+	}
+	return set
+}
+
+// candidates Endpoints in the order they should be tried. Endpoints with
+// a closed circuit come first following the selection policy. The rest
+// are left last, the closest to the end of its cool-down first
+func (s *endpointSet) candidates(now time.Time) []*endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ordered := make([]*endpoint, 0, len(s.endpoints))
+	start := 0
+	if s.config.Selection == SelectionRoundRobin && len(s.endpoints) > 0 {
+		start = s.next % len(s.endpoints)
+		s.next++
+	}
+	for i := range s.endpoints {
+		ordered = append(ordered, s.endpoints[(start+i)%len(s.endpoints)])
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iClosed := ordered[i].breaker.state == circuitClosed
+		jClosed := ordered[j].breaker.state == circuitClosed
+		if iClosed || jClosed {
+			return iClosed && !jClosed
+		}
+		return ordered[i].breaker.until.Before(ordered[j].breaker.until)
+	})
+	return ordered
+}
+
+// markFailure Records a failure of the endpoint. Once MaxFailures
+// consecutive failures are reached, or if the endpoint was being probed,
+// its circuit opens and it is skipped until its cool-down ends
+func (s *endpointSet) markFailure(e *endpoint, clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !e.breaker.failure(time.Now(), s.config.MaxFailures, s.config.Cooldown) {
+		return
+	}
+	log.Warningf("action: circuit_breaker | result: success | client_id: %v | server: %v | state: %v | cooldown: %v",
+		clientID,
+		e.address,
+		e.breaker.state,
+		s.config.Cooldown,
+	)
+}
+
+// markSuccess Records a success of the endpoint, closing its circuit
+func (s *endpointSet) markSuccess(e *endpoint, clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !e.breaker.success() {
+		return
+	}
+	log.Infof("action: circuit_breaker | result: success | client_id: %v | server: %v | state: %v",
+		clientID,
+		e.address,
+		e.breaker.state,
+	)
+}
+
+// allow Returns whether the circuit of the endpoint lets a connection
+// through, and when to check again if it does not
+func (s *endpointSet) allow(e *endpoint, clientID string) (bool, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wasOpen := e.breaker.state == circuitOpen
+	if !e.breaker.allow(time.Now(), s.config.Cooldown) {
+		return false, e.breaker.until
+	}
+	if wasOpen {
+		log.Infof("action: circuit_breaker | result: success | client_id: %v | server: %v | state: %v",
+			clientID,
+			e.address,
+			e.breaker.state,
+		)
+	}
+	return true, time.Time{}
+}
+
+// dial Connects to the first endpoint that accepts the connection, trying
+// them in the order given by candidates. Failed endpoints are marked so
+// they end up being skipped. If the circuit of every endpoint is open,
+// it waits for the first cool-down to end instead of trying them anyway
+func (s *endpointSet) dial(ctx context.Context, clientID string) (net.Conn, *endpoint, error) {
+	for {
+		var err error
+		var retryAt time.Time
+		for _, e := range s.candidates(time.Now()) {
+			allowed, until := s.allow(e, clientID)
+			if !allowed {
+				if retryAt.IsZero() || until.Before(retryAt) {
+					retryAt = until
+				}
+				continue
+			}
+
+			var conn net.Conn
+			conn, err = s.dialEndpoint(ctx, e)
+			if err == nil {
+				return conn, e, nil
+			}
+			log.Warningf("action: connect | result: fail | client_id: %v | server: %v | error: %v",
+				clientID,
+				e.address,
+				err,
+			)
+			s.markFailure(e, clientID)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if retryAt.IsZero() {
+			return nil, nil, errors.New("no servers configured")
+		}
+
+		wait := time.Until(retryAt)
+		log.Infof("action: circuit_breaker | result: in_progress | client_id: %v | wait: %v",
+			clientID,
+			wait,
+		)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// dialEndpoint Connects to the endpoint. Host names are resolved again on
+// every call so a server that changed its IP is still reachable
+func (s *endpointSet) dialEndpoint(ctx context.Context, e *endpoint) (net.Conn, error) {
+	network, address := ParseServerAddress(e.address)
+	if resolver, ok := s.dialer.(remoteResolver); network != "tcp" || (ok && resolver.resolvesRemotely()) {
+		dialCtx, cancel := withTimeout(ctx, s.config.ConnectTimeout)
+		defer cancel()
+		return s.dialer.DialContext(dialCtx, network, address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	resolveCtx, cancel := withTimeout(ctx, s.config.ConnectTimeout)
+	ips, err := net.DefaultResolver.LookupIPAddr(resolveCtx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = errors.Errorf("no addresses found for %v", host)
+	for _, ip := range ips {
+		var conn net.Conn
+		dialCtx, cancel := withTimeout(ctx, s.config.ConnectTimeout)
+		conn, err = s.dialer.DialContext(dialCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
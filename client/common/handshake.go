@@ -0,0 +1,410 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Version Build version of the client. It is set at build time with
+// -ldflags "-X github.com/7574-sistemas-distribuidos/docker-compose-init/client/common.Version=<version>"
+var Version = "dev"
+
+// ProtocolVersions Versions of the protocol implemented by this package
+var ProtocolVersions = []int{1}
+
+// Optional features agreed in the handshake
+const (
+	// FeaturePipelining Several batches can be in flight on a connection
+	FeaturePipelining = "pipelining"
+	// FeaturePushResults The server pushes the results to subscribed
+	// clients, which must poll for them otherwise
+	FeaturePushResults = "push_results"
+	// FeatureCompression Payloads can be compressed, see FlagCompressed
+	FeatureCompression = "compression"
+	// FeatureChecksum Every frame carries a CRC32C trailer, see FlagChecksum
+	FeatureChecksum = "checksum"
+	// FeatureTrace Every frame carries the session ID of the client and its
+	// request ID, see FlagTrace
+	FeatureTrace = "trace"
+)
+
+// errHandshake Returned when the client and the server cannot agree on a
+// session. It is not retried since every connection would fail the same
+// way
+type errHandshake struct {
+	msg string
+}
+
+func (e *errHandshake) Error() string {
+	return "handshake failed: " + e.msg
+}
+
+// Hello First message the client sends on every connection
+type Hello struct {
+	Agency  string
+	Version string
+	// Protocols Protocol versions the client can speak
+	Protocols []int
+	// Features Optional features the client wants to use
+	Features []string
+	// MaxFrameSize Biggest frame the client can receive
+	MaxFrameSize int
+	// Session Session ID of the client and Request the request ID of the
+	// hello, since it is sent before FlagTrace can be agreed
+	Session SessionID
+	Request uint32
+}
+
+// Session Parameters agreed with the server in the handshake
+type Session struct {
+	Protocol int
+	Features []string
+	// MaxFrameSize Biggest frame either side can receive
+	MaxFrameSize int
+}
+
+// Has Returns whether the feature was agreed
+func (s Session) Has(feature string) bool {
+	return containsString(s.Features, feature)
+}
+
+// Flags Flags every frame sent in the session must carry
+func (s Session) Flags() byte {
+	var flags byte
+	if s.Has(FeatureChecksum) {
+		flags |= FlagChecksum
+	}
+	if s.Has(FeatureTrace) {
+		flags |= FlagTrace
+	}
+	return flags
+}
+
+// MaxPayloadSize Biggest payload a frame of the session can carry
+func (s Session) MaxPayloadSize() int {
+	return s.maxBatchFrameSize() - frameLengthSize - frameHeaderSize
+}
+
+// maxBatchFrameSize Biggest frame a batch can take before the trace
+// header and the trailers agreed in the session are added
+func (s Session) maxBatchFrameSize() int {
+	size := s.MaxFrameSize
+	if s.Has(FeatureTrace) {
+		size -= traceSize
+	}
+	if s.Has(FeatureChecksum) {
+		size -= checksumSize
+	}
+	return size
+}
+
+// Encode Serializes the hello as key=value fields separated by ';'
+func (h Hello) Encode() []byte {
+	return encodeFields([][2]string{
+		{"agency", h.Agency},
+		{"version", h.Version},
+		{"protocols", joinInts(h.Protocols)},
+		{"features", strings.Join(h.Features, ",")},
+		{"max_frame_size", strconv.Itoa(h.MaxFrameSize)},
+		{"session_id", h.Session.String()},
+		{"request_id", strconv.FormatUint(uint64(h.Request), 10)},
+	})
+}
+
+// DecodeHello Parses a hello serialized with Encode
+func DecodeHello(payload []byte) (Hello, error) {
+	fields, err := decodeFields(payload)
+	if err != nil {
+		return Hello{}, err
+	}
+	protocols, err := splitInts(fields["protocols"])
+	if err != nil {
+		return Hello{}, errors.Wrapf(err, "invalid protocols")
+	}
+	maxFrameSize, err := strconv.Atoi(fields["max_frame_size"])
+	if err != nil {
+		return Hello{}, errors.Errorf("invalid max frame size %q", fields["max_frame_size"])
+	}
+	hello := Hello{
+		Agency:       fields["agency"],
+		Version:      fields["version"],
+		Protocols:    protocols,
+		Features:     splitList(fields["features"]),
+		MaxFrameSize: maxFrameSize,
+	}
+	// Clients that predate tracing send no IDs
+	if session, ok := fields["session_id"]; ok {
+		if hello.Session, err = ParseSessionID(session); err != nil {
+			return Hello{}, err
+		}
+		request, err := strconv.ParseUint(fields["request_id"], 10, 32)
+		if err != nil {
+			return Hello{}, errors.Errorf("invalid request id %q", fields["request_id"])
+		}
+		hello.Request = uint32(request)
+	}
+	return hello, nil
+}
+
+// Encode Serializes the session as key=value fields separated by ';'
+func (s Session) Encode() []byte {
+	return encodeFields([][2]string{
+		{"protocol", strconv.Itoa(s.Protocol)},
+		{"features", strings.Join(s.Features, ",")},
+		{"max_frame_size", strconv.Itoa(s.MaxFrameSize)},
+	})
+}
+
+// DecodeSession Parses a session serialized with Encode
+func DecodeSession(payload []byte) (Session, error) {
+	fields, err := decodeFields(payload)
+	if err != nil {
+		return Session{}, err
+	}
+	protocol, err := strconv.Atoi(fields["protocol"])
+	if err != nil {
+		return Session{}, errors.Errorf("invalid protocol %q", fields["protocol"])
+	}
+	maxFrameSize, err := strconv.Atoi(fields["max_frame_size"])
+	if err != nil {
+		return Session{}, errors.Errorf("invalid max frame size %q", fields["max_frame_size"])
+	}
+	return Session{
+		Protocol:     protocol,
+		Features:     splitList(fields["features"]),
+		MaxFrameSize: maxFrameSize,
+	}, nil
+}
+
+// Negotiate Chooses the session for hello, as a server supporting the
+// given protocols and features would. The highest protocol version both
+// sides speak is used, along with the features both sides implement
+func Negotiate(hello Hello, protocols []int, features []string, maxFrameSize int) (Session, error) {
+	session := Session{Protocol: -1, MaxFrameSize: maxFrameSize}
+	for _, p := range hello.Protocols {
+		for _, supported := range protocols {
+			if p == supported && p > session.Protocol {
+				session.Protocol = p
+			}
+		}
+	}
+	if session.Protocol < 0 {
+		return Session{}, errors.Errorf("no common protocol version, client speaks %v and server speaks %v",
+			joinInts(hello.Protocols),
+			joinInts(protocols),
+		)
+	}
+
+	for _, f := range hello.Features {
+		for _, supported := range features {
+			if f == supported {
+				session.Features = append(session.Features, f)
+			}
+		}
+	}
+	if hello.MaxFrameSize < session.MaxFrameSize {
+		session.MaxFrameSize = hello.MaxFrameSize
+	}
+	return session, nil
+}
+
+// handshake Sends the hello over conn as a new request of tracer and
+// returns the session chosen by the server, which must not exceed what
+// the client asked for, along with the request ID of the hello. The
+// exchange must end within timeout, if not zero
+func handshake(conn net.Conn, hello Hello, timeout time.Duration, tracer *requestTracer) (Session, uint32, error) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	frame, span := tracer.request(Frame{Type: MsgHello})
+	hello.Session, hello.Request = frame.Session, frame.Request
+	frame.Payload = hello.Encode()
+	if err := WriteFrame(conn, frame); err != nil {
+		span.Fail(err)
+		return Session{}, frame.Request, err
+	}
+	response, err := ReadFrame(conn)
+	if err != nil {
+		span.Fail(err)
+		return Session{}, frame.Request, err
+	}
+	span.Finish(MessageName(response.Type))
+
+	session, err := acceptSession(hello, response)
+	return session, frame.Request, err
+}
+
+// acceptSession Returns the session the server chose in its response to
+// hello, checking that it does not exceed what the client asked for
+func acceptSession(hello Hello, response Frame) (Session, error) {
+	switch response.Type {
+	case MsgWelcome:
+	case MsgError:
+		return Session{}, &errHandshake{msg: string(response.Payload)}
+	case MsgUnsupported:
+		return Session{}, &errHandshake{msg: "the server does not support the handshake"}
+	default:
+		return Session{}, errors.Errorf("unexpected message type %q", response.Type)
+	}
+
+	session, err := DecodeSession(response.Payload)
+	if err != nil {
+		return Session{}, &errHandshake{msg: err.Error()}
+	}
+	if !containsInt(hello.Protocols, session.Protocol) {
+		return Session{}, &errHandshake{msg: fmt.Sprintf("the server chose protocol version %v, client speaks %v",
+			session.Protocol,
+			joinInts(hello.Protocols),
+		)}
+	}
+	for _, f := range session.Features {
+		if !containsString(hello.Features, f) {
+			return Session{}, &errHandshake{msg: fmt.Sprintf("the server agreed to unknown feature %q", f)}
+		}
+	}
+	if session.MaxFrameSize < frameLengthSize+frameHeaderSize || session.MaxFrameSize > hello.MaxFrameSize {
+		return Session{}, &errHandshake{msg: fmt.Sprintf("the server chose an invalid max frame size %v", session.MaxFrameSize)}
+	}
+	return session, nil
+}
+
+// newHello Hello sent by a client with the given configuration. Only
+// the features enabled in it are asked for
+func newHello(config ClientConfig) Hello {
+	features := []string{FeaturePipelining, FeaturePushResults, FeatureTrace}
+	if config.Compression.Enabled {
+		features = append(features, FeatureCompression)
+	}
+	if config.Integrity.Checksum {
+		features = append(features, FeatureChecksum)
+	}
+	return Hello{
+		Agency:       config.ID,
+		Version:      Version,
+		Protocols:    ProtocolVersions,
+		Features:     features,
+		MaxFrameSize: MaxFrameSize,
+	}
+}
+
+// fieldEscaper Percent-encodes the characters that delimit the fields
+// and the escapes themselves, so any value can be sent
+var fieldEscaper = strings.NewReplacer("%", "%25", ";", "%3B", "=", "%3D")
+
+// encodeFields Serializes fields as key=value pairs separated by ';',
+// escaping the values
+func encodeFields(fields [][2]string) []byte {
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		parts = append(parts, f[0]+"="+fieldEscaper.Replace(f[1]))
+	}
+	return []byte(strings.Join(parts, ";"))
+}
+
+// decodeFields Parses fields serialized with encodeFields
+func decodeFields(payload []byte) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(string(payload), ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("invalid field %q", part)
+		}
+		value, err := url.PathUnescape(kv[1])
+		if err != nil {
+			return nil, errors.Errorf("invalid field %q", part)
+		}
+		fields[kv[0]] = value
+	}
+	return fields, nil
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		parts = append(parts, strconv.Itoa(v))
+	}
+	return strings.Join(parts, ",")
+}
+
+func splitInts(list string) ([]int, error) {
+	var values []int
+	for _, part := range splitList(list) {
+		v, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func sameSession(a Session, b Session) bool {
+	return a.Protocol == b.Protocol &&
+		a.MaxFrameSize == b.MaxFrameSize &&
+		strings.Join(a.Features, ",") == strings.Join(b.Features, ",")
+}
+
+func logSession(clientID string, server string, request uint32, session Session) {
+	log.Infof("action: handshake | result: success | client_id: %v | request_id: %v | server: %v | version: %v | protocol: %v | features: %v | max_frame_size: %v",
+		clientID,
+		request,
+		server,
+		Version,
+		session.Protocol,
+		strings.Join(session.Features, ","),
+		session.MaxFrameSize,
+	)
+}
+
+func logHandshakeError(clientID string, server string, request uint32, err error) {
+	var handshakeErr *errHandshake
+	if errors.As(err, &handshakeErr) {
+		log.Criticalf("action: handshake | result: fail | client_id: %v | request_id: %v | server: %v | version: %v | error: %v",
+			clientID,
+			request,
+			server,
+			Version,
+			err,
+		)
+		return
+	}
+	log.Warningf("action: handshake | result: fail | client_id: %v | request_id: %v | server: %v | error: %v",
+		clientID,
+		request,
+		server,
+		err,
+	)
+}
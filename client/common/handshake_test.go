@@ -0,0 +1,64 @@
+package common_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// TestEncodeDelimiters Values holding the characters that delimit the
+// fields are escaped and decoded back as they were
+func TestEncodeDelimiters(t *testing.T) {
+	hello := common.Hello{
+		Agency:       "1;features=x",
+		Version:      "1.0=beta;100%",
+		Protocols:    []int{1},
+		Features:     []string{common.FeaturePipelining},
+		MaxFrameSize: common.MaxFrameSize,
+	}
+	decodedHello, err := common.DecodeHello(hello.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedHello, hello) {
+		t.Fatalf("hello decoded as %+v, expected %+v", decodedHello, hello)
+	}
+
+	submission := common.Submission{Agency: "a=b;c", Bets: 10, Digest: "%3B"}
+	decodedSubmission, err := common.DecodeSubmission(submission.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedSubmission != submission {
+		t.Fatalf("submission decoded as %+v, expected %+v", decodedSubmission, submission)
+	}
+}
+
+// TestHandshakeProtocolMismatch A server that speaks none of the protocol
+// versions of the client fails the session on the first connection,
+// without reconnecting
+func TestHandshakeProtocolMismatch(t *testing.T) {
+	config := testserver.DefaultConfig()
+	config.Protocols = []int{99}
+	address, server := startServer(t, config)
+
+	dialer := &recordingDialer{}
+	summary := common.NewClient(testConfig(address, writeBetsFile(t, 10)), dialer).StartClientLoop(context.Background())
+	if summary.Status != common.SessionFailed {
+		t.Fatalf("session ended as %v, expected it to fail", summary.Status)
+	}
+	if !strings.Contains(summary.Error, "protocol") {
+		t.Fatalf("session failed with %q, expected a protocol mismatch", summary.Error)
+	}
+	if len(dialer.connsTo(address)) != 1 || summary.Reconnects != 0 {
+		t.Fatalf("%v connections and %v reconnects, expected a single connection",
+			len(dialer.connsTo(address)), summary.Reconnects)
+	}
+	if n := len(server.Bets(testAgency)); n != 0 {
+		t.Fatalf("server stored %v bets, expected none", n)
+	}
+}
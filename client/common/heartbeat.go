@@ -0,0 +1,192 @@
+package common
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HeartbeatConfig Configuration of the dead peer detection on long-lived
+// connections
+type HeartbeatConfig struct {
+	// Interval Time between PING frames. Heartbeats are disabled if zero
+	Interval time.Duration
+	// Timeout Time to wait for the PONG of a PING before counting it as
+	// missed
+	Timeout time.Duration
+	// MaxMissed Consecutive missed heartbeats after which the connection
+	// is closed
+	MaxMissed int
+	// KeepAlive Period of the TCP keepalive probes. The system default is
+	// used if zero and keepalive is disabled if negative
+	KeepAlive time.Duration
+}
+
+// heartbeat Sends PING frames over a connection and closes it if the
+// server stops answering them. The goroutine reading the connection must
+// hand every PONG to pong
+type heartbeat struct {
+	config   HeartbeatConfig
+	clientID string
+	conn     net.Conn
+	flags    byte
+	onRTT    func(time.Duration)
+	tracer   *requestTracer
+
+	mu  sync.Mutex
+	seq uint32
+	// span Span of the last PING, which measures its round trip time
+	span    *Span
+	waiting bool
+	missed  int
+	dead    bool
+
+	stopped chan struct{}
+	exited  chan struct{}
+}
+
+// startHeartbeat Starts sending heartbeats over conn, as frames with the
+// given flags stamped by tracer. onRTT, if not nil, is called with the
+// round trip time of every PING answered. Returns nil if heartbeats are
+// disabled
+func startHeartbeat(conn net.Conn, config HeartbeatConfig, clientID string, flags byte, tracer *requestTracer, onRTT func(time.Duration)) *heartbeat {
+	if config.Interval <= 0 {
+		return nil
+	}
+
+	h := &heartbeat{
+		config:   config,
+		clientID: clientID,
+		conn:     conn,
+		flags:    flags,
+		onRTT:    onRTT,
+		tracer:   tracer,
+		stopped:  make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+func (h *heartbeat) run() {
+	defer close(h.exited)
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+	timeout := time.NewTimer(h.config.Timeout)
+	timeout.Stop()
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.mu.Lock()
+			if h.waiting {
+				// The previous PING is still pending, its timeout decides
+				h.mu.Unlock()
+				continue
+			}
+			h.seq++
+			ping, span := h.tracer.request(Frame{Type: MsgPing, Flags: h.flags, Seq: h.seq})
+			h.span = span
+			h.waiting = true
+			h.mu.Unlock()
+
+			if err := WriteFrame(h.conn, ping); err != nil {
+				span.Fail(err)
+				return
+			}
+			timeout.Reset(h.config.Timeout)
+		case <-timeout.C:
+			h.mu.Lock()
+			if !h.waiting {
+				h.mu.Unlock()
+				continue
+			}
+			h.waiting = false
+			h.missed++
+			missed := h.missed
+			span := h.span
+			h.mu.Unlock()
+
+			span.Finish(SpanTimeout)
+			log.Warningf("action: heartbeat | result: fail | client_id: %v | request_id: %v | server: %v | missed: %v",
+				h.clientID,
+				span.Request,
+				h.conn.RemoteAddr(),
+				missed,
+			)
+			if missed >= h.config.MaxMissed {
+				h.mu.Lock()
+				h.dead = true
+				h.mu.Unlock()
+				// Closing the connection unblocks its reader, which reports
+				// the error and makes the sender reconnect
+				h.conn.Close()
+				return
+			}
+		case <-h.stopped:
+			h.mu.Lock()
+			if h.waiting {
+				h.span.Finish(SpanLost)
+			}
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+// pong Records the PONG answering the PING seq
+func (h *heartbeat) pong(seq uint32) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	if !h.waiting || seq != h.seq {
+		h.mu.Unlock()
+		return
+	}
+	span := h.span
+	h.waiting = false
+	h.missed = 0
+	h.mu.Unlock()
+
+	span.Finish(MessageName(MsgPong))
+	rtt := span.End.Sub(span.Start)
+	log.Debugf("action: heartbeat | result: success | client_id: %v | request_id: %v | server: %v | rtt: %v",
+		h.clientID,
+		span.Request,
+		h.conn.RemoteAddr(),
+		rtt,
+	)
+	if h.onRTT != nil {
+		h.onRTT(rtt)
+	}
+}
+
+// err Returns an error if the connection was closed because the server
+// stopped answering heartbeats
+func (h *heartbeat) err() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dead {
+		return nil
+	}
+	return errors.Errorf("server missed %v heartbeats", h.missed)
+}
+
+// stop Stops sending heartbeats and waits for the heartbeat goroutine
+func (h *heartbeat) stop() {
+	if h == nil {
+		return
+	}
+	close(h.stopped)
+	<-h.exited
+}
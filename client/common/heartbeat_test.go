@@ -0,0 +1,80 @@
+package common_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// silencingDialer Dialer whose first connection stops reaching the server
+// right after the first batch, as if the server was paused: writes still
+// succeed but nothing arrives, so nothing is answered
+type silencingDialer struct {
+	mu    sync.Mutex
+	dials int
+}
+
+func (d *silencingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	if d.dials > 1 {
+		return conn, nil
+	}
+	return &silencingConn{Conn: conn}, nil
+}
+
+type silencingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	silent bool
+}
+
+// Write Frames are written with a single call, so b starts with the
+// length of the frame followed by its type
+func (c *silencingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	silent := c.silent
+	c.silent = c.silent || (len(b) > 4 && b[4] == common.MsgBatch)
+	c.mu.Unlock()
+	if silent {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// TestHeartbeatDeadPeer A server that stops answering is detected by the
+// missed heartbeats, and the bets are sent again on a new connection
+func TestHeartbeatDeadPeer(t *testing.T) {
+	address, server := startServer(t, testserver.DefaultConfig())
+	const bets = 30
+	config := testConfig(address, writeBetsFile(t, bets))
+	config.Heartbeat = common.HeartbeatConfig{
+		Interval:  20 * time.Millisecond,
+		Timeout:   50 * time.Millisecond,
+		MaxMissed: 2,
+	}
+	dialer := &silencingDialer{}
+
+	// Nothing else times out the wait for the ack of the second batch
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	summary := common.NewClient(config, dialer).StartClientLoop(ctx)
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if dialer.dials < 2 || summary.Reconnects < 1 {
+		t.Fatalf("%v connections and %v reconnects, expected a reconnect once the server stopped answering",
+			dialer.dials, summary.Reconnects)
+	}
+	assertStored(t, server, bets)
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// IntegrityConfig Configuration of the end-to-end integrity checks
+type IntegrityConfig struct {
+	// Checksum Whether every frame carries a CRC32C trailer. It is only
+	// used if the server agreed to FeatureChecksum
+	Checksum bool
+}
+
+// Submission Summary of the bets of an agency. The client sends it along
+// with MsgFinished and the server answers with the one of the bets it
+// stored, so both sides can tell whether they hold the same bets
+type Submission struct {
+	Agency string
+	// Bets Amount of distinct bets
+	Bets int
+	// Digest Hex encoded digest of the bets, see NewSubmission
+	Digest string
+}
+
+// NewSubmission Summarizes the bets of agency. The digest is a SHA-256
+// over the canonical encoding of every distinct bet, sorted and ended by
+// a newline, so it depends neither on the order the bets were sent in
+// nor on the batches delivered more than once
+func NewSubmission(agency string, bets []Bet) Submission {
+	encoded := make([]string, 0, len(bets))
+	for _, b := range bets {
+		encoded = append(encoded, b.Encode())
+	}
+	sort.Strings(encoded)
+
+	hash := sha256.New()
+	distinct := 0
+	for i, e := range encoded {
+		if i > 0 && e == encoded[i-1] {
+			continue
+		}
+		distinct++
+		hash.Write([]byte(e))
+		hash.Write([]byte("\n"))
+	}
+	return Submission{
+		Agency: agency,
+		Bets:   distinct,
+		Digest: hex.EncodeToString(hash.Sum(nil)),
+	}
+}
+
+// Encode Serializes the submission as key=value fields separated by ';'
+func (s Submission) Encode() []byte {
+	return encodeFields([][2]string{
+		{"agency", s.Agency},
+		{"bets", strconv.Itoa(s.Bets)},
+		{"digest", s.Digest},
+	})
+}
+
+// DecodeSubmission Parses a submission serialized with Encode
+func DecodeSubmission(payload []byte) (Submission, error) {
+	fields, err := decodeFields(payload)
+	if err != nil {
+		return Submission{}, err
+	}
+	bets, err := strconv.Atoi(fields["bets"])
+	if err != nil {
+		return Submission{}, errors.Errorf("invalid bet count %q", fields["bets"])
+	}
+	return Submission{
+		Agency: fields["agency"],
+		Bets:   bets,
+		Digest: fields["digest"],
+	}, nil
+}
+
+// Matches Returns whether both submissions hold the same bets
+func (s Submission) Matches(other Submission) bool {
+	return s.Bets == other.Bets && s.Digest == other.Digest
+}
+
+// logReconcile Logs whether the server stored the bets the client sent.
+// On a mismatch the agency has to resubmit its bets
+func logReconcile(clientID string, server string, sent Submission, stored Submission) {
+	if sent.Matches(stored) {
+		log.Infof("action: reconcile | result: success | client_id: %v | server: %v | bets: %v | digest: %v",
+			clientID,
+			server,
+			sent.Bets,
+			sent.Digest,
+		)
+		return
+	}
+	log.Errorf("action: reconcile | result: fail | client_id: %v | server: %v | sent_bets: %v | stored_bets: %v | sent_digest: %v | stored_digest: %v",
+		clientID,
+		server,
+		sent.Bets,
+		stored.Bets,
+		sent.Digest,
+		stored.Digest,
+	)
+}
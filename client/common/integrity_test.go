@@ -0,0 +1,121 @@
+package common_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// TestReadFrameChecksum A frame whose bytes changed after its CRC32C
+// trailer was computed is rejected
+func TestReadFrameChecksum(t *testing.T) {
+	frame := common.Frame{Type: common.MsgBatch, Flags: common.FlagChecksum, Seq: 7, Payload: []byte("bets")}
+	var buf bytes.Buffer
+	if err := common.WriteFrame(&buf, frame); err != nil {
+		t.Fatal(err)
+	}
+	wire := buf.Bytes()
+
+	read, err := common.ReadFrame(bytes.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.Seq != frame.Seq || !bytes.Equal(read.Payload, frame.Payload) {
+		t.Fatalf("read %+v, expected %+v", read, frame)
+	}
+
+	// A bit of every byte after the length is flipped in turn
+	for i := 4; i < len(wire); i++ {
+		corrupted := append([]byte(nil), wire...)
+		corrupted[i] ^= 0x10
+		if _, err := common.ReadFrame(bytes.NewReader(corrupted)); err == nil {
+			t.Fatalf("frame with byte %v corrupted was read", i)
+		}
+	}
+}
+
+// corruptingDialer Dialer whose connections flip a bit in the payload of
+// the first batch written with a checksum
+type corruptingDialer struct {
+	mu        sync.Mutex
+	dials     int
+	corrupted bool
+}
+
+func (d *corruptingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dials++
+	return &corruptingConn{Conn: conn, dialer: d}, nil
+}
+
+type corruptingConn struct {
+	net.Conn
+	dialer *corruptingDialer
+}
+
+// Write Frames are written with a single call, so b starts with the
+// length of the frame followed by its type and flags
+func (c *corruptingConn) Write(b []byte) (int, error) {
+	c.dialer.mu.Lock()
+	if !c.dialer.corrupted && len(b) > 10 && b[4] == common.MsgBatch && b[5]&common.FlagChecksum != 0 {
+		c.dialer.corrupted = true
+		b = append([]byte(nil), b...)
+		// The last byte of the payload, right before the trailer
+		b[len(b)-5] ^= 0x10
+	}
+	c.dialer.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// TestChecksumCorruptedBatch A batch corrupted on the way is rejected by
+// the server, which drops the connection, and sent again on the next one
+func TestChecksumCorruptedBatch(t *testing.T) {
+	address, server := startServer(t, testserver.DefaultConfig())
+	const bets = 30
+	config := testConfig(address, writeBetsFile(t, bets))
+	config.Integrity.Checksum = true
+	dialer := &corruptingDialer{}
+
+	summary := common.NewClient(config, dialer).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if !dialer.corrupted || dialer.dials < 2 || summary.Reconnects < 1 {
+		t.Fatalf("corrupted: %v, %v connections and %v reconnects, expected a reconnect after the corrupted batch",
+			dialer.corrupted, dialer.dials, summary.Reconnects)
+	}
+	assertStored(t, server, bets)
+	if n := len(server.Bets(testAgency)); n != bets {
+		t.Fatalf("server stored %v bets, expected %v", n, bets)
+	}
+}
+
+// TestFinishedDigestMismatch A server that stored other bets than the ones
+// sent answers FINISHED with a summary that does not match, and the
+// session is reported as partial
+func TestFinishedDigestMismatch(t *testing.T) {
+	config := testserver.DefaultConfig()
+	config.CorruptEvery = 2
+	address, _ := startServer(t, config)
+
+	summary := common.NewClient(testConfig(address, writeBetsFile(t, 30)), nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionPartial {
+		t.Fatalf("session ended as %v, expected the mismatch to make it partial", summary.Status)
+	}
+	if summary.Error != "the server did not store the bets sent" {
+		t.Fatalf("session ended with %q, expected the mismatch to be reported", summary.Error)
+	}
+	if summary.BetsAcked != 30 {
+		t.Fatalf("%v bets acked, expected every bet", summary.BetsAcked)
+	}
+}
@@ -0,0 +1,281 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Journal record types
+const (
+	journalSession = "session"
+	journalBatch   = "batch"
+	journalAck     = "ack"
+)
+
+// journalRecord Line of the journal file
+type journalRecord struct {
+	Type    string `json:"type"`
+	Time    string `json:"time,omitempty"`
+	Seq     uint32 `json:"seq,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	Server  string `json:"server,omitempty"`
+}
+
+// Journal Append-only record of the batches sent in this session and of
+// the servers that acknowledged each of them. Records are also written to
+// a file, if one is given, so they outlive the process. Every run appends
+// a session record before its own batches
+type Journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	batches []*Batch
+	// acked Highest seq up to which every batch was acknowledged, per
+	// server
+	acked map[string]uint32
+	// ahead Seqs acknowledged past acked, per server, since acks can
+	// arrive in any order
+	ahead map[string]map[uint32]bool
+}
+
+// OpenJournal Opens the journal file in append mode, creating it if
+// needed. If path is empty the journal is only kept in memory
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{acked: make(map[string]uint32), ahead: make(map[string]map[uint32]bool)}
+	if path == "" {
+		return j, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open journal %v", path)
+	}
+	j.file = file
+	j.writer = bufio.NewWriter(file)
+
+	if err := j.write(journalRecord{Type: journalSession, Time: time.Now().Format(time.RFC3339)}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// write Appends a record to the file and flushes it so a crash loses at
+// most the record being written
+func (j *Journal) write(record journalRecord) error {
+	if j.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.writer.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return j.writer.Flush()
+}
+
+// AppendBatch Records a batch before it is sent. Batches must be appended
+// in sequence order
+func (j *Journal) AppendBatch(b *Batch) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if int(b.Seq) != len(j.batches)+1 {
+		return errors.Errorf("journal expected batch %v, got %v", len(j.batches)+1, b.Seq)
+	}
+	j.batches = append(j.batches, b)
+	return j.write(journalRecord{Type: journalBatch, Seq: b.Seq, Payload: string(b.Payload)})
+}
+
+// AppendAck Records that server acknowledged the batch seq
+func (j *Journal) AppendAck(server string, seq uint32) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if seq > j.acked[server] {
+		if j.ahead[server] == nil {
+			j.ahead[server] = make(map[uint32]bool)
+		}
+		ahead := j.ahead[server]
+		ahead[seq] = true
+		for ahead[j.acked[server]+1] {
+			j.acked[server]++
+			delete(ahead, j.acked[server])
+		}
+	}
+	return j.write(journalRecord{Type: journalAck, Seq: seq, Server: server})
+}
+
+// Batch Returns the batch of the session with the given seq, or nil if it
+// was not appended yet
+func (j *Journal) Batch(seq uint32) *Batch {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if seq == 0 || int(seq) > len(j.batches) {
+		return nil
+	}
+	return j.batches[seq-1]
+}
+
+// Len Amount of batches appended in this session
+func (j *Journal) Len() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return len(j.batches)
+}
+
+// Acked Highest seq up to which server acknowledged every batch in this
+// session
+func (j *Journal) Acked(server string) uint32 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.acked[server]
+}
+
+// isAcked Returns whether server acknowledged the batch seq in this
+// session
+func (j *Journal) isAcked(server string, seq uint32) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return seq <= j.acked[server] || j.ahead[server][seq]
+}
+
+// Close Closes the journal file
+func (j *Journal) Close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// forEachSubmitted Calls fn with every bet of the journal file at path
+// that a server acknowledged, in the order they were journaled. The file
+// is streamed twice, first for the acks and then for the batches, so only
+// the seqs acknowledged are kept in memory. A missing file has no bets
+func forEachSubmitted(path string, fn func(Bet)) error {
+	// acked Seqs acknowledged by some server, per session
+	acked := make(map[int]map[uint32]bool)
+	err := scanJournal(path, func(session int, record journalRecord) error {
+		if record.Type == journalAck {
+			if acked[session] == nil {
+				acked[session] = make(map[uint32]bool)
+			}
+			acked[session][record.Seq] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return scanJournal(path, func(session int, record journalRecord) error {
+		if record.Type != journalBatch || !acked[session][record.Seq] {
+			return nil
+		}
+		bets, err := DecodeBets([]byte(record.Payload))
+		if err != nil {
+			return errors.Wrapf(err, "journal %v, batch %v", path, record.Seq)
+		}
+		for _, b := range bets {
+			fn(b)
+		}
+		return nil
+	})
+}
+
+// scanJournal Calls fn with every record of the journal file at path,
+// along with the number of the session it belongs to
+func scanJournal(path string, fn func(int, journalRecord) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	session := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash can leave the last record half written
+			continue
+		}
+		if record.Type == journalSession {
+			session++
+			continue
+		}
+		if err := fn(session, record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// journaledSource Batch source that records every batch it produces in
+// the journal before handing it to the sender
+type journaledSource struct {
+	source  batchSource
+	journal *Journal
+}
+
+func (s *journaledSource) done() bool {
+	return s.source.done()
+}
+
+func (s *journaledSource) nextBatch(size int, maxFrameSize int) (*Batch, error) {
+	b, err := s.source.nextBatch(size, maxFrameSize)
+	if err != nil || b == nil {
+		return b, err
+	}
+	return b, s.journal.AppendBatch(b)
+}
+
+// journalCursor Batch source that replays the batches of the journal in
+// order, starting after the last one a server acknowledged along with
+// every batch before it. It lets a server that fell behind catch up
+type journalCursor struct {
+	journal *Journal
+	server  string
+	next    uint32
+}
+
+func newJournalCursor(journal *Journal, server string) *journalCursor {
+	return &journalCursor{journal: journal, server: server, next: journal.Acked(server) + 1}
+}
+
+func (c *journalCursor) done() bool {
+	c.skipAcked()
+	return int(c.next) > c.journal.Len()
+}
+
+// skipAcked Moves the cursor past the batches the server acknowledged
+func (c *journalCursor) skipAcked() {
+	for c.journal.isAcked(c.server, c.next) {
+		c.next++
+	}
+}
+
+// nextBatch Returns the next batch of the journal the server did not
+// acknowledge yet. Batches were already cut when journaled so size and
+// maxFrameSize are ignored
+func (c *journalCursor) nextBatch(size int, maxFrameSize int) (*Batch, error) {
+	c.skipAcked()
+	b := c.journal.Batch(c.next)
+	if b != nil {
+		c.next++
+	}
+	return b, nil
+}
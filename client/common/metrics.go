@@ -0,0 +1,366 @@
+package common
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxLatencySamples Ack latencies kept to estimate their percentiles. Once
+// reached, new samples replace random old ones so the samples stay
+// uniform over the whole session
+const maxLatencySamples = 10000
+
+// Metrics Counters collected while the client runs. Every method can be
+// called concurrently and on a nil receiver, in which case it does nothing
+type Metrics struct {
+	throttled int64
+	busy      int64
+	paused    int64
+	batchSize int64
+	// uncompressed Payload bytes of the batches before compression
+	uncompressed int64
+	// compressed Payload bytes of the batches as written, compressed or not
+	compressed int64
+	// rejected Rows left out by validation rules
+	rejected int64
+	// warned Rows submitted despite violating validation rules
+	warned int64
+	// aborted Files not submitted because a validation rule aborted them
+	aborted int64
+	// duplicates Bets found to be duplicates
+	duplicates int64
+	// dropped Duplicate bets left out of the submission
+	dropped int64
+	// read Rows read from the bets files
+	read int64
+	// invalid Rows that failed the built-in checks
+	invalid int64
+	// sent Bets written in batches for the first time
+	sent int64
+	// acked Bets and batches acknowledged by a server
+	acked        int64
+	ackedBatches int64
+	// retries Batches sent again after a reconnection or a BUSY response
+	retries    int64
+	reconnects int64
+	bytesIn    int64
+	bytesOut   int64
+
+	mu sync.Mutex
+	// latencies Sample of the ack latencies
+	latencies []time.Duration
+	// observed Ack latencies observed, sampled or not
+	observed int
+	random   *rand.Rand
+}
+
+// NewMetrics Initializes an empty set of counters
+func NewMetrics() *Metrics {
+	return &Metrics{random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// AddThrottled Accumulates time spent waiting on the rate limiter
+func (m *Metrics) AddThrottled(d time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.throttled, int64(d))
+}
+
+// Throttled Total time spent waiting on the rate limiter
+func (m *Metrics) Throttled() time.Duration {
+	if m == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&m.throttled))
+}
+
+// AddBusy Records a BUSY response and the time the sender paused for it
+func (m *Metrics) AddBusy(paused time.Duration) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.busy, 1)
+	atomic.AddInt64(&m.paused, int64(paused))
+}
+
+// Busy Amount of BUSY responses received
+func (m *Metrics) Busy() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.busy)
+}
+
+// Paused Total time spent paused by BUSY responses
+func (m *Metrics) Paused() time.Duration {
+	if m == nil {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&m.paused))
+}
+
+// SetBatchSize Records the amount of bets per batch currently chosen
+func (m *Metrics) SetBatchSize(size int) {
+	if m == nil {
+		return
+	}
+	atomic.StoreInt64(&m.batchSize, int64(size))
+}
+
+// BatchSize Amount of bets per batch last chosen
+func (m *Metrics) BatchSize() int {
+	if m == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&m.batchSize))
+}
+
+// AddPayload Records the payload bytes of a batch before and after
+// compressing it. Both are equal if it was not compressed
+func (m *Metrics) AddPayload(uncompressed int, compressed int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.uncompressed, int64(uncompressed))
+	atomic.AddInt64(&m.compressed, int64(compressed))
+}
+
+// PayloadBytes Payload bytes of the batches sent, before and after
+// compression
+func (m *Metrics) PayloadBytes() (int64, int64) {
+	if m == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&m.uncompressed), atomic.LoadInt64(&m.compressed)
+}
+
+// AddValidation Accumulates the outcome of validating a file
+func (m *Metrics) AddValidation(report *ValidationReport) {
+	if m == nil || report == nil {
+		return
+	}
+	atomic.AddInt64(&m.rejected, int64(report.Rejected))
+	atomic.AddInt64(&m.warned, int64(report.Warnings))
+	if report.Aborted {
+		atomic.AddInt64(&m.aborted, 1)
+	}
+}
+
+// Validation Rows rejected and warned and files aborted by validation
+// rules
+func (m *Metrics) Validation() (int64, int64, int64) {
+	if m == nil {
+		return 0, 0, 0
+	}
+	return atomic.LoadInt64(&m.rejected), atomic.LoadInt64(&m.warned), atomic.LoadInt64(&m.aborted)
+}
+
+// AddDuplicates Accumulates the duplicate bets found in a file
+func (m *Metrics) AddDuplicates(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.duplicates, int64(n))
+}
+
+// Duplicates Duplicate bets found
+func (m *Metrics) Duplicates() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.duplicates)
+}
+
+// AddDropped Accumulates the duplicate bets left out of a file, not
+// counting the ones the server stored in a previous session
+func (m *Metrics) AddDropped(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.dropped, int64(n))
+}
+
+// AddRead Accumulates the rows read from a file, and the ones that failed
+// the built-in checks among them
+func (m *Metrics) AddRead(rows int, invalid int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.read, int64(rows))
+	atomic.AddInt64(&m.invalid, int64(invalid))
+}
+
+// AddSent Records a batch written for the first time
+func (m *Metrics) AddSent(bets int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.sent, int64(bets))
+}
+
+// AddAcked Records a batch acknowledged
+func (m *Metrics) AddAcked(bets int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.acked, int64(bets))
+	atomic.AddInt64(&m.ackedBatches, 1)
+}
+
+// AddAckLatency Records the time a batch took to be acknowledged
+func (m *Metrics) AddAckLatency(latency time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observed++
+	if len(m.latencies) < maxLatencySamples {
+		m.latencies = append(m.latencies, latency)
+	} else if i := m.random.Intn(m.observed); i < maxLatencySamples {
+		m.latencies[i] = latency
+	}
+}
+
+// AddRetries Records batches sent again
+func (m *Metrics) AddRetries(batches int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.retries, int64(batches))
+}
+
+// AddReconnect Records a connection opened again after a failure
+func (m *Metrics) AddReconnect() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.reconnects, 1)
+}
+
+// AddBytes Accumulates the bytes read from and written to the servers
+func (m *Metrics) AddBytes(in int, out int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.bytesIn, int64(in))
+	atomic.AddInt64(&m.bytesOut, int64(out))
+}
+
+// Read Rows read from the bets files and the ones that failed the
+// built-in checks
+func (m *Metrics) Read() (int64, int64) {
+	if m == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&m.read), atomic.LoadInt64(&m.invalid)
+}
+
+// Dropped Duplicate bets left out
+func (m *Metrics) Dropped() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.dropped)
+}
+
+// Sent Bets written in batches, without counting the ones sent again
+func (m *Metrics) Sent() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.sent)
+}
+
+// Acked Bets and batches acknowledged
+func (m *Metrics) Acked() (int64, int64) {
+	if m == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&m.acked), atomic.LoadInt64(&m.ackedBatches)
+}
+
+// Retries Batches sent again
+func (m *Metrics) Retries() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.retries)
+}
+
+// Reconnects Connections opened again after a failure
+func (m *Metrics) Reconnects() int64 {
+	if m == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&m.reconnects)
+}
+
+// Bytes Bytes read from and written to the servers
+func (m *Metrics) Bytes() (int64, int64) {
+	if m == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&m.bytesIn), atomic.LoadInt64(&m.bytesOut)
+}
+
+// AckLatency Percentiles of the latency of the acks
+func (m *Metrics) AckLatency() LatencySummary {
+	if m == nil {
+		return LatencySummary{}
+	}
+	m.mu.Lock()
+	sorted := append([]time.Duration(nil), m.latencies...)
+	m.mu.Unlock()
+	if len(sorted) == 0 {
+		return LatencySummary{}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	percentile := func(p float64) float64 {
+		return milliseconds(sorted[int(p*float64(len(sorted)-1))])
+	}
+	return LatencySummary{
+		Samples: len(sorted),
+		P50:     percentile(0.50),
+		P90:     percentile(0.90),
+		P99:     percentile(0.99),
+		Max:     milliseconds(sorted[len(sorted)-1]),
+	}
+}
+
+// LatencySummary Percentiles of a latency, in milliseconds
+type LatencySummary struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P90     float64 `json:"p90_ms"`
+	P99     float64 `json:"p99_ms"`
+	Max     float64 `json:"max_ms"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Log Prints every counter in a single line
+func (m *Metrics) Log(clientID string) {
+	uncompressed, compressed := m.PayloadBytes()
+	rejected, warned, aborted := m.Validation()
+	log.Infof("action: metrics | result: success | client_id: %v | throttled: %v | busy: %v | busy_paused: %v | batch_size: %v | uncompressed_bytes: %v | compressed_bytes: %v | rejected_bets: %v | warned_bets: %v | aborted_files: %v | duplicate_bets: %v",
+		clientID,
+		m.Throttled(),
+		m.Busy(),
+		m.Paused(),
+		m.BatchSize(),
+		uncompressed,
+		compressed,
+		rejected,
+		warned,
+		aborted,
+		m.Duplicates(),
+	)
+}
@@ -0,0 +1,511 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PipelineConfig Configuration of the pipelined batch sender
+type PipelineConfig struct {
+	// Window Maximum amount of batches sent and not yet acknowledged
+	Window int
+	// MaxReconnects Consecutive reconnections attempted before giving up
+	MaxReconnects int
+}
+
+// errServer Wraps the errors reported by the server. They are not
+// retried since sending the same data again would fail the same way
+type errServer struct {
+	msg string
+}
+
+func (e *errServer) Error() string {
+	return "server error: " + e.msg
+}
+
+// isFatal Returns whether err would happen again after reconnecting
+func isFatal(err error) bool {
+	var serverErr *errServer
+	var handshakeErr *errHandshake
+	return errors.As(err, &serverErr) || errors.As(err, &handshakeErr)
+}
+
+// inflightWindow Batches sent and not yet acknowledged, in sending order.
+// It is shared between the sender and the goroutine reading the acks
+type inflightWindow struct {
+	mu      sync.Mutex
+	batches []*Batch
+	acked   int
+}
+
+func (w *inflightWindow) push(b *Batch) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, b)
+}
+
+// ack Removes the batch acknowledged by seq. The server may answer the
+// batches in a different order than they were sent, so it can be any
+// batch in the window
+func (w *inflightWindow) ack(seq uint32) (*Batch, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, b := range w.batches {
+		if b.Seq == seq {
+			w.batches = append(w.batches[:i:i], w.batches[i+1:]...)
+			w.acked++
+			return b, nil
+		}
+	}
+	return nil, errors.Errorf("unexpected ack for batch %v", seq)
+}
+
+// ackedCount Amount of batches acknowledged so far
+func (w *inflightWindow) ackedCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.acked
+}
+
+func (w *inflightWindow) snapshot() []*Batch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*Batch(nil), w.batches...)
+}
+
+func (w *inflightWindow) len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.batches)
+}
+
+// oldest Returns the seq of the oldest batch in the window, false if it
+// is empty
+func (w *inflightWindow) oldest() (uint32, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.batches) == 0 {
+		return 0, false
+	}
+	return w.batches[0].Seq, true
+}
+
+// peer Server a pipelineSender delivers batches to
+type peer interface {
+	// connect Opens a new connection to the server
+	connect(ctx context.Context) (net.Conn, error)
+	// succeeded Records that the server acknowledged batches
+	succeeded()
+	// failed Records that the connection to the server failed
+	failed()
+	// address Address of the server last connected to
+	address() string
+	// Session Session agreed with the server on the last connection
+	Session() Session
+}
+
+// busyResponse BUSY answered by the server to a batch
+type busyResponse struct {
+	seq        uint32
+	request    uint32
+	retryAfter time.Duration
+}
+
+// pipelineSender Sends batches over a single connection keeping up to
+// Window batches in flight. Acks are matched to the batches by seq, so
+// they can arrive in any order. If the connection is lost, a new one is
+// opened and the unacknowledged batches are sent again in their
+// original order before any new batch. When the server is busy the
+// window is halved, and it grows back by one batch every window acked
+type pipelineSender struct {
+	client   *Client
+	peer     peer
+	source   batchSource
+	inflight inflightWindow
+	// window Current limit of batches in flight, up to Pipeline.Window
+	window int
+	// growth Batches acked since the window last changed
+	growth int
+	sizer  *batchSizer
+	// spans Span of the last send of each batch in flight, which measures
+	// the latency of its ack
+	spans map[uint32]*Span
+	// busy Retry-after asked by the server for each batch it dropped, kept
+	// until the oldest batch in flight is one of them
+	busy map[uint32]time.Duration
+	// onAck Called from the reader goroutine for every batch acknowledged.
+	// Acks are counted in the metrics by it, as a batch sent to several
+	// replicas is acknowledged once per replica
+	onAck func(b *Batch)
+	// onRTT Called with the round trip time of every heartbeat answered
+	onRTT func(rtt time.Duration)
+}
+
+func newPipelineSender(client *Client, peer peer, source batchSource) *pipelineSender {
+	window := client.config.Pipeline.Window
+	if window < 1 {
+		window = 1
+	}
+	return &pipelineSender{
+		client: client,
+		peer:   peer,
+		source: source,
+		window: window,
+		sizer:  newBatchSizer(client.config.Batch, client.config.ID, client.metrics),
+		spans:  make(map[uint32]*Span),
+		busy:   make(map[uint32]time.Duration),
+	}
+}
+
+func (p *pipelineSender) done() bool {
+	return p.source.done() && p.inflight.len() == 0
+}
+
+// run Sends every batch, reconnecting when the connection is lost
+func (p *pipelineSender) run(ctx context.Context) error {
+	config := p.client.config.Pipeline
+	failures := 0
+	for !p.done() {
+		conn, err := p.peer.connect(ctx)
+		if err == nil {
+			acked := p.inflight.ackedCount()
+			err = p.runConnection(ctx, conn)
+			if p.inflight.ackedCount() > acked {
+				failures = 0
+				p.peer.succeeded()
+			}
+			if err != nil && ctx.Err() == nil {
+				p.peer.failed()
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isFatal(err) {
+			return err
+		}
+
+		p.sizer.timeout()
+		failures++
+		if failures > config.MaxReconnects {
+			return err
+		}
+		p.client.metrics.AddReconnect()
+		log.Warningf("action: reconnect | result: in_progress | client_id: %v | server: %v | attempt: %v | unacked_batches: %v | error: %v",
+			p.client.config.ID,
+			p.peer.address(),
+			failures,
+			p.inflight.len(),
+			err,
+		)
+
+		select {
+		case <-time.After(p.client.config.LoopPeriod):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// runConnection Sends batches over conn until every batch is acknowledged
+// or the connection fails
+func (p *pipelineSender) runConnection(ctx context.Context, conn net.Conn) (err error) {
+	acks := make(chan *Batch)
+	busy := make(chan busyResponse)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	readerExited := make(chan struct{})
+
+	hb := startHeartbeat(conn, p.client.config.Heartbeat, p.client.config.ID, p.peer.Session().Flags(), p.client.tracer, p.onRTT)
+	go func() {
+		defer close(readerExited)
+		p.readAcks(conn, hb, acks, busy, readErr, done)
+	}()
+	defer func() {
+		hb.stop()
+		conn.Close()
+		close(done)
+		<-readerExited
+	}()
+	// The batches still in flight are sent again on the next connection
+	// as new requests
+	defer func() {
+		for seq, span := range p.spans {
+			if err != nil {
+				span.Fail(err)
+			} else {
+				span.Finish(SpanLost)
+			}
+			delete(p.spans, seq)
+		}
+		p.busy = make(map[uint32]time.Duration)
+	}()
+
+	if err := p.resend(ctx, conn); err != nil {
+		return err
+	}
+
+	session := p.peer.Session()
+	for {
+		window := p.window
+		if !session.Has(FeaturePipelining) {
+			window = 1
+		}
+		for p.inflight.len() < window {
+			b, err := p.source.nextBatch(p.sizer.current(), session.maxBatchFrameSize())
+			if err != nil {
+				return err
+			}
+			if b == nil {
+				break
+			}
+			// The batch is added to the window before being written so its
+			// ack can never arrive before it is expected
+			p.inflight.push(b)
+			if err := p.send(ctx, conn, b); err != nil {
+				return err
+			}
+		}
+
+		if p.inflight.len() == 0 {
+			return nil
+		}
+
+		select {
+		case b := <-acks:
+			span := p.spans[b.Seq]
+			span.Finish(MessageName(MsgAck))
+			log.Debugf("action: batch_ack | result: success | client_id: %v | request_id: %v | server: %v | seq: %v | bets: %v",
+				p.client.config.ID,
+				span.Request,
+				p.peer.address(),
+				b.Seq,
+				len(b.Bets),
+			)
+			latency := span.End.Sub(span.Start)
+			p.sizer.observe(latency, len(b.Bets))
+			p.client.metrics.AddAckLatency(latency)
+			delete(p.spans, b.Seq)
+			p.growWindow()
+			if err := p.retryBusy(ctx, conn, readErr); err != nil {
+				return err
+			}
+		case r := <-busy:
+			p.markBusy(r)
+			if err := p.retryBusy(ctx, conn, readErr); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// markBusy Records that the server dropped the batch r refers to. BUSY
+// responses to an earlier send of the batch are told apart by their
+// request ID and ignored. Without request IDs responses are expected in
+// order, so only the one for the oldest batch counts, the ones for the
+// batches after it just confirm they were dropped too
+func (p *pipelineSender) markBusy(r busyResponse) {
+	span := p.spans[r.seq]
+	if span == nil {
+		return
+	}
+	if r.request == 0 {
+		if oldest, ok := p.inflight.oldest(); !ok || oldest != r.seq {
+			return
+		}
+	} else if r.request != span.Request {
+		return
+	}
+	p.busy[r.seq] = r.retryAfter
+}
+
+// retryBusy Sends every batch in flight again once the server dropped the
+// oldest of them. The server drops every batch after one it rejects, so
+// all of them are sent again in order after waiting as asked
+func (p *pipelineSender) retryBusy(ctx context.Context, conn net.Conn, readErr <-chan error) error {
+	oldest, ok := p.inflight.oldest()
+	if !ok {
+		return nil
+	}
+	retryAfter, busy := p.busy[oldest]
+	if !busy {
+		return nil
+	}
+
+	// The acks the reader already matched but were not handled yet keep
+	// their spans
+	request := p.spans[oldest].Request
+	for _, b := range p.inflight.snapshot() {
+		p.spans[b.Seq].Finish(MessageName(MsgBusy))
+		delete(p.spans, b.Seq)
+	}
+	p.busy = make(map[uint32]time.Duration)
+	if err := p.pause(ctx, request, retryAfter, readErr); err != nil {
+		return err
+	}
+	return p.resend(ctx, conn)
+}
+
+// growWindow Grows the window by one batch once a whole window was acked,
+// until it is back to Pipeline.Window
+func (p *pipelineSender) growWindow() {
+	if p.window >= p.client.config.Pipeline.Window {
+		return
+	}
+	p.growth++
+	if p.growth >= p.window {
+		p.window++
+		p.growth = 0
+	}
+}
+
+// pause Halves the window and waits retryAfter as asked by a busy server
+// in its response to request. It is not a failure, so it does not count
+// towards MaxReconnects
+func (p *pipelineSender) pause(ctx context.Context, request uint32, retryAfter time.Duration, readErr <-chan error) error {
+	if p.window > 1 {
+		p.window /= 2
+	}
+	p.growth = 0
+	p.client.metrics.AddBusy(retryAfter)
+	log.Debugf("action: server_busy | result: in_progress | client_id: %v | request_id: %v | server: %v | retry_after: %v | window: %v",
+		p.client.config.ID,
+		request,
+		p.peer.address(),
+		retryAfter,
+		p.window,
+	)
+
+	select {
+	case <-time.After(retryAfter):
+		return nil
+	case err := <-readErr:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// resend Sends again every batch in flight, in their original order
+func (p *pipelineSender) resend(ctx context.Context, conn net.Conn) error {
+	batches := p.inflight.snapshot()
+	p.client.metrics.AddRetries(len(batches))
+	for _, b := range batches {
+		if err := p.send(ctx, conn, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pipelineSender) send(ctx context.Context, conn net.Conn, b *Batch) error {
+	frame := b.frame()
+	session := p.peer.Session()
+	frame.Flags = session.Flags()
+	if session.Has(FeatureCompression) {
+		var err error
+		frame, err = CompressFrame(frame, p.client.config.Compression.Threshold)
+		if err != nil {
+			return err
+		}
+	}
+	if maxFrameSize := session.MaxFrameSize; frame.Size() > maxFrameSize {
+		return &errHandshake{msg: fmt.Sprintf("batch %v takes %v bytes but the server accepts frames of up to %v",
+			b.Seq,
+			frame.Size(),
+			maxFrameSize,
+		)}
+	}
+	if err := p.client.limiter.Wait(ctx, len(b.Bets), frame.Size()); err != nil {
+		return err
+	}
+	compressed := len(frame.Payload)
+	frame, span := p.client.tracer.request(frame)
+	p.spans[b.Seq] = span
+	if err := WriteFrame(conn, frame); err != nil {
+		return err
+	}
+	// Batches sent again are counted as retries instead
+	if b.markWritten() {
+		p.client.metrics.AddSent(len(b.Bets))
+		p.client.metrics.AddPayload(len(b.Payload), compressed)
+	}
+	return nil
+}
+
+// readAcks Reads the responses of the server and matches each ack with
+// the batch it refers to. BUSY responses are reported in busy and the
+// first error found in errs
+func (p *pipelineSender) readAcks(conn net.Conn, hb *heartbeat, acks chan<- *Batch, busy chan<- busyResponse, errs chan<- error, done <-chan struct{}) {
+	for {
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			if hbErr := hb.err(); hbErr != nil {
+				// The read failed because the heartbeat closed the connection
+				err = hbErr
+			}
+			errs <- err
+			return
+		}
+		frame, err = DecompressFrame(frame, p.client.config.Compression.MaxDecompressedSize)
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		switch frame.Type {
+		case MsgAck:
+			b, err := p.inflight.ack(frame.Seq)
+			if err != nil {
+				errs <- err
+				return
+			}
+			stored, err := strconv.Atoi(string(frame.Payload))
+			if err != nil || stored != len(b.Bets) {
+				errs <- &errServer{msg: fmt.Sprintf("batch %v: stored %q of %v bets", b.Seq, frame.Payload, len(b.Bets))}
+				return
+			}
+			if p.onAck != nil {
+				p.onAck(b)
+			}
+			select {
+			case acks <- b:
+			case <-done:
+				return
+			}
+		case MsgBusy:
+			millis, err := strconv.ParseUint(string(frame.Payload), 10, 32)
+			if err != nil {
+				errs <- errors.Errorf("invalid retry-after %q", frame.Payload)
+				return
+			}
+			select {
+			case busy <- busyResponse{seq: frame.Seq, request: frame.Request, retryAfter: time.Duration(millis) * time.Millisecond}:
+			case <-done:
+				return
+			}
+		case MsgPong:
+			hb.pong(frame.Seq)
+		case MsgError:
+			errs <- &errServer{msg: string(frame.Payload)}
+			return
+		default:
+			errs <- errors.Errorf("unexpected message type %q", frame.Type)
+			return
+		}
+	}
+}
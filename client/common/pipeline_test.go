@@ -0,0 +1,160 @@
+package common_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// TestPipelineOutOfOrderAcks Acks delayed by a random jitter arrive in a
+// different order than the batches were sent, and every bet is still
+// stored exactly once
+func TestPipelineOutOfOrderAcks(t *testing.T) {
+	config := testserver.DefaultConfig()
+	config.Latency = 10 * time.Millisecond
+	config.Jitter = 40 * time.Millisecond
+	address, server := startServer(t, config)
+
+	const bets = 400
+	clientConfig := testConfig(address, writeBetsFile(t, bets))
+	clientConfig.Pipeline.Window = 8
+	dialer := &recordingDialer{}
+	summary := common.NewClient(clientConfig, dialer).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+
+	acks := seqs(dialer.frames(1, false, common.MsgAck))
+	reordered := false
+	for i := 1; i < len(acks); i++ {
+		if acks[i] < acks[i-1] {
+			reordered = true
+		}
+	}
+	if !reordered {
+		t.Fatalf("acks arrived in order: %v", acks)
+	}
+	if stored := len(server.Bets(testAgency)); stored != bets {
+		t.Fatalf("server stored %v bets, expected %v", stored, bets)
+	}
+}
+
+// TestPipelineWindowLimit Batches sent and not yet answered never exceed
+// the window, and the window is filled on a high latency link
+func TestPipelineWindowLimit(t *testing.T) {
+	config := testserver.DefaultConfig()
+	config.Latency = 50 * time.Millisecond
+	config.Jitter = 20 * time.Millisecond
+	address, server := startServer(t, config)
+
+	const bets, window = 300, 4
+	clientConfig := testConfig(address, writeBetsFile(t, bets))
+	clientConfig.Pipeline.Window = window
+	dialer := &recordingDialer{}
+	summary := common.NewClient(clientConfig, dialer).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+
+	inflight := make(map[uint32]bool)
+	peak := 0
+	for _, e := range dialer.snapshot() {
+		switch {
+		case e.sent && e.frame.Type == common.MsgBatch:
+			inflight[e.frame.Seq] = true
+			if len(inflight) > window {
+				t.Fatalf("%v batches in flight, window is %v", len(inflight), window)
+			}
+			if len(inflight) > peak {
+				peak = len(inflight)
+			}
+		case !e.sent && (e.frame.Type == common.MsgAck || e.frame.Type == common.MsgBusy):
+			delete(inflight, e.frame.Seq)
+		}
+	}
+	if peak != window {
+		t.Fatalf("at most %v batches were in flight, expected the window of %v", peak, window)
+	}
+	assertStored(t, server, bets)
+}
+
+// TestPipelineResendAfterReconnect The batches in flight when the
+// connection is lost are sent again first on the next connection, in
+// their original order
+func TestPipelineResendAfterReconnect(t *testing.T) {
+	config := testserver.DefaultConfig()
+	config.Latency = 50 * time.Millisecond
+	address, server := startServer(t, config)
+
+	const bets, cutAfter = 200, 5
+	clientConfig := testConfig(address, writeBetsFile(t, bets))
+	clientConfig.Pipeline.Window = 8
+	sent := 0
+	dialer := &recordingDialer{cut: func(e frameEvent) bool {
+		if e.conn != 1 || e.frame.Type != common.MsgBatch {
+			return false
+		}
+		sent++
+		return sent == cutAfter
+	}}
+	summary := common.NewClient(clientConfig, dialer).StartClientLoop(context.Background())
+	if summary.Reconnects == 0 {
+		t.Fatal("the client did not reconnect")
+	}
+	if summary.Retries == 0 || summary.BetsSent != bets {
+		t.Fatalf("summary counts %v bets sent and %v retries, expected %v bets and some retries", summary.BetsSent, summary.Retries, bets)
+	}
+
+	acked := make(map[uint32]bool)
+	for _, seq := range seqs(dialer.frames(1, false, common.MsgAck)) {
+		acked[seq] = true
+	}
+	var unacked []uint32
+	for _, seq := range seqs(dialer.frames(1, true, common.MsgBatch)) {
+		if !acked[seq] {
+			unacked = append(unacked, seq)
+		}
+	}
+	if len(unacked) == 0 {
+		t.Fatal("every batch of the first connection was acked before it was cut")
+	}
+
+	resent := seqs(dialer.frames(2, true, common.MsgBatch))
+	if len(resent) < len(unacked) {
+		t.Fatalf("%v batches sent on the second connection, expected at least %v", len(resent), len(unacked))
+	}
+	for i, seq := range unacked {
+		if resent[i] != seq {
+			t.Fatalf("batches %v sent first on the second connection, expected %v", resent[:len(unacked)], unacked)
+		}
+	}
+	assertStored(t, server, bets)
+}
+
+// TestPipelineBusyOutOfOrder A server over its capacity answers BUSY,
+// possibly before the acks of earlier batches, and every batch it dropped
+// is sent again until all of them are stored exactly once
+func TestPipelineBusyOutOfOrder(t *testing.T) {
+	config := testserver.DefaultConfig()
+	config.Latency = 5 * time.Millisecond
+	config.Jitter = 30 * time.Millisecond
+	config.MaxBetsPerSecond = 1000
+	address, server := startServer(t, config)
+
+	const bets = 2000
+	clientConfig := testConfig(address, writeBetsFile(t, bets))
+	clientConfig.Pipeline.Window = 8
+	summary := common.NewClient(clientConfig, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if summary.Retries == 0 {
+		t.Fatal("the server never answered BUSY")
+	}
+	if stored := len(server.Bets(testAgency)); stored != bets {
+		t.Fatalf("server stored %v bets, expected %v", stored, bets)
+	}
+}
@@ -0,0 +1,238 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Frames exchanged with the server have the following layout, every
+// integer being encoded in big endian:
+//
+//	| length (4 bytes) | type (1 byte) | flags (1 byte) | seq (4 bytes) | payload |
+//
+// length counts every byte after itself. flags describe how the payload
+// is encoded. seq identifies the message a response refers to. Frames
+// with FlagTrace carry between seq and the payload the session ID of the
+// client (8 bytes) and the request ID of the frame (4 bytes), which
+// responses echo. Frames with FlagChecksum end with a CRC32C of every
+// byte after length, counted in length.
+const (
+	frameLengthSize = 4
+	frameHeaderSize = 1 + 1 + 4
+	traceSize       = 8 + 4
+	checksumSize    = 4
+
+	// MaxFrameSize Biggest frame, header included, that can be exchanged
+	MaxFrameSize = 8 * 1024
+)
+
+// Message types
+const (
+	// MsgHello First message of the client on every connection, see Hello
+	MsgHello byte = 'H'
+	// MsgWelcome Answer of the server to a MsgHello carrying the Session
+	// chosen. A server that cannot agree on a session answers with a
+	// MsgError instead
+	MsgWelcome byte = 'L'
+	// MsgBatch Group of bets sent by the client
+	MsgBatch byte = 'B'
+	// MsgAck Sent by the server once a batch was stored. Its payload is the
+	// amount of bets stored
+	MsgAck byte = 'A'
+	// MsgError Sent by the server when a message could not be processed. Its
+	// payload describes the error
+	MsgError byte = 'E'
+	// MsgPing Heartbeat sent by the client on long-lived connections
+	MsgPing byte = 'P'
+	// MsgPong Answer of the server to a MsgPing, with the same seq
+	MsgPong byte = 'O'
+	// MsgUnsupported Sent by the server when it does not implement the
+	// type of the message received
+	MsgUnsupported byte = 'U'
+	// MsgFinished Sent by the client once every bet of its agency was
+	// acknowledged. Its payload is the Submission of the agency. The
+	// server answers with a MsgAck carrying the Submission of the bets it
+	// stored
+	MsgFinished byte = 'F'
+	// MsgQueryWinners Asks once for the winners of the agency in the
+	// payload. The server answers with MsgNotReady if the draw did not
+	// take place yet, or with MsgDrawComplete followed by MsgWinners
+	MsgQueryWinners byte = 'Q'
+	// MsgSubscribeResults Asks the server to push the winners of the agency
+	// in the payload as soon as the draw takes place. The server answers
+	// with a MsgAck and keeps the connection open until it sends
+	// MsgDrawComplete followed by MsgWinners
+	MsgSubscribeResults byte = 'S'
+	// MsgNotReady Sent by the server when the draw did not take place yet
+	MsgNotReady byte = 'N'
+	// MsgDrawComplete Sent by the server once every agency finished. Its
+	// payload is the winning number
+	MsgDrawComplete byte = 'D'
+	// MsgWinners Documents of the winners of the agency, separated by ';'
+	MsgWinners byte = 'W'
+	// MsgBusy Sent by an overloaded server instead of acknowledging a
+	// batch, which was not stored. Its payload is the amount of
+	// milliseconds to wait before sending it again. Once a batch is
+	// rejected, every batch following it is rejected too until the
+	// rejected one is received again
+	MsgBusy byte = 'Y'
+	// MsgQueryBets Asks for the keys of the bets stored for the agency in
+	// the payload. The server answers with as many MsgStoredBets as needed
+	// followed by a MsgAck carrying the Submission of the bets stored
+	MsgQueryBets byte = 'K'
+	// MsgStoredBets Keys of bets stored by the server, see EncodeBetKeys
+	MsgStoredBets byte = 'T'
+)
+
+// Frame flags
+const (
+	// FlagCompressed The payload is compressed with DEFLATE
+	FlagCompressed byte = 1 << 0
+	// FlagChecksum The frame ends with a CRC32C trailer
+	FlagChecksum byte = 1 << 1
+	// FlagTrace The header carries the session and request IDs of the frame
+	FlagTrace byte = 1 << 2
+)
+
+// ErrFrameTooLarge Returned when a frame exceeds MaxFrameSize
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrChecksumMismatch Returned when the CRC32C trailer of a frame does not
+// match its content
+var ErrChecksumMismatch = errors.New("frame checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// messageNames Names of the message types, as logged and traced
+var messageNames = map[byte]string{
+	MsgHello:            "hello",
+	MsgWelcome:          "welcome",
+	MsgBatch:            "batch",
+	MsgAck:              "ack",
+	MsgError:            "error",
+	MsgPing:             "ping",
+	MsgPong:             "pong",
+	MsgUnsupported:      "unsupported",
+	MsgFinished:         "finished",
+	MsgQueryWinners:     "query_winners",
+	MsgSubscribeResults: "subscribe_results",
+	MsgNotReady:         "not_ready",
+	MsgDrawComplete:     "draw_complete",
+	MsgWinners:          "winners",
+	MsgBusy:             "busy",
+	MsgQueryBets:        "query_bets",
+	MsgStoredBets:       "stored_bets",
+}
+
+// MessageName Name of the message type t
+func MessageName(t byte) string {
+	if name, ok := messageNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("%q", t)
+}
+
+// Frame Unit of communication between client and server
+type Frame struct {
+	Type  byte
+	Flags byte
+	Seq   uint32
+	// Session Session ID of the client, sent only with FlagTrace
+	Session SessionID
+	// Request Request ID of the frame, or of the one a response answers.
+	// Sent only with FlagTrace
+	Request uint32
+	Payload []byte
+}
+
+// headerSize Amount of bytes of the header after length
+func (f Frame) headerSize() int {
+	if f.Flags&FlagTrace != 0 {
+		return frameHeaderSize + traceSize
+	}
+	return frameHeaderSize
+}
+
+// Size Amount of bytes the frame takes on the wire
+func (f Frame) Size() int {
+	size := frameLengthSize + f.headerSize() + len(f.Payload)
+	if f.Flags&FlagChecksum != 0 {
+		size += checksumSize
+	}
+	return size
+}
+
+// WriteFrame Serializes the frame and writes it with a single call so
+// frames written by different goroutines are never interleaved
+func WriteFrame(w io.Writer, f Frame) error {
+	if f.Size() > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	buf := make([]byte, f.Size())
+	binary.BigEndian.PutUint32(buf, uint32(f.Size()-frameLengthSize))
+	buf[frameLengthSize] = f.Type
+	buf[frameLengthSize+1] = f.Flags
+	binary.BigEndian.PutUint32(buf[frameLengthSize+2:], f.Seq)
+	if f.Flags&FlagTrace != 0 {
+		binary.BigEndian.PutUint64(buf[frameLengthSize+frameHeaderSize:], uint64(f.Session))
+		binary.BigEndian.PutUint32(buf[frameLengthSize+frameHeaderSize+8:], f.Request)
+	}
+	copy(buf[frameLengthSize+f.headerSize():], f.Payload)
+	if f.Flags&FlagChecksum != 0 {
+		end := len(buf) - checksumSize
+		binary.BigEndian.PutUint32(buf[end:], crc32.Checksum(buf[frameLengthSize:end], castagnoli))
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame Reads a whole frame, retrying short reads until every byte
+// announced in its header arrived. The checksum of the frame, if it has
+// one, is verified and removed
+func ReadFrame(r io.Reader) (Frame, error) {
+	var lengthBuf [frameLengthSize]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if length < frameHeaderSize {
+		return Frame{}, errors.Errorf("invalid frame length %v", length)
+	}
+	if length > MaxFrameSize-frameLengthSize {
+		return Frame{}, ErrFrameTooLarge
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Frame{}, err
+	}
+
+	if buf[1]&FlagChecksum != 0 {
+		if len(buf) < frameHeaderSize+checksumSize {
+			return Frame{}, errors.Errorf("invalid frame length %v", length)
+		}
+		end := len(buf) - checksumSize
+		if crc32.Checksum(buf[:end], castagnoli) != binary.BigEndian.Uint32(buf[end:]) {
+			return Frame{}, ErrChecksumMismatch
+		}
+		buf = buf[:end]
+	}
+
+	f := Frame{Type: buf[0], Flags: buf[1], Seq: binary.BigEndian.Uint32(buf[2:])}
+	if f.Flags&FlagTrace != 0 {
+		if len(buf) < frameHeaderSize+traceSize {
+			return Frame{}, errors.Errorf("invalid frame length %v", length)
+		}
+		f.Session = SessionID(binary.BigEndian.Uint64(buf[frameHeaderSize:]))
+		f.Request = binary.BigEndian.Uint32(buf[frameHeaderSize+8:])
+	}
+	f.Payload = buf[f.headerSize():]
+	return f, nil
+}
@@ -0,0 +1,301 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Errors returned when a connection through the proxy cannot be opened
+var (
+	// ErrProxyUnreachable The proxy itself could not be reached
+	ErrProxyUnreachable = errors.New("proxy unreachable")
+	// ErrProxyAuthFailed The proxy rejected the credentials, or requires
+	// credentials that were not given
+	ErrProxyAuthFailed = errors.New("proxy authentication failed")
+	// ErrProxyRefused The proxy accepted the client but refused to open
+	// the connection to the server
+	ErrProxyRefused = errors.New("proxy refused the connection")
+)
+
+// proxyError Failure of the proxy handshake. kind is one of the ErrProxy
+// errors so callers can tell them apart with errors.Is
+type proxyError struct {
+	kind   error
+	detail string
+}
+
+func newProxyError(kind error, format string, args ...interface{}) error {
+	return &proxyError{kind: kind, detail: fmt.Sprintf(format, args...)}
+}
+
+func (e *proxyError) Error() string {
+	return e.kind.Error() + ": " + e.detail
+}
+
+func (e *proxyError) Unwrap() error {
+	return e.kind
+}
+
+// SOCKS5 constants, see RFC 1928 and RFC 1929
+const (
+	socks5Version         = 0x05
+	socks5AuthNone        = 0x00
+	socks5AuthPassword    = 0x02
+	socks5AuthNoMethod    = 0xff
+	socks5PasswordVersion = 0x01
+	socks5CmdConnect      = 0x01
+	socks5AddrIPv4        = 0x01
+	socks5AddrDomain      = 0x03
+	socks5AddrIPv6        = 0x04
+)
+
+// proxyHandshakeTimeout Time the proxy has to open the connection when
+// the dial context has no deadline, so a stalled proxy cannot hang the
+// client
+const proxyHandshakeTimeout = 10 * time.Second
+
+// remoteResolver Implemented by dialers that resolve host names on the
+// other end of the connection, so names must not be resolved locally
+type remoteResolver interface {
+	resolvesRemotely() bool
+}
+
+// proxyDialer Dialer that opens every connection through a SOCKS5 or an
+// HTTP CONNECT proxy
+type proxyDialer struct {
+	proxy   *url.URL
+	forward Dialer
+}
+
+// NewProxyDialer Returns a Dialer that connects through the proxy at
+// proxyURL, which must be socks5://[user:password@]host:port or
+// http://[user:password@]host:port. The proxy is reached using forward
+func NewProxyDialer(proxyURL string, forward Dialer) (Dialer, error) {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid proxy url")
+	}
+	if proxy.Scheme != "socks5" && proxy.Scheme != "http" {
+		return nil, errors.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if proxy.Port() == "" {
+		return nil, errors.Errorf("proxy url %v has no port", proxy.Redacted())
+	}
+	return &proxyDialer{proxy: proxy, forward: forward}, nil
+}
+
+func (d *proxyDialer) resolvesRemotely() bool {
+	return true
+}
+
+// DialContext Connects to the proxy and asks it to open a connection to
+// address. Only tcp is supported
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errors.Errorf("%v connections cannot go through a proxy", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, newProxyError(ErrProxyUnreachable, "%v: %v", d.proxy.Host, err)
+	}
+
+	// The handshake must not outlive the dial context
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(proxyHandshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if d.proxy.Scheme == "socks5" {
+		err = d.socks5Connect(conn, address)
+	} else {
+		conn, err = d.httpConnect(conn, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect Runs the SOCKS5 handshake, authenticating with user and
+// password if the proxy url has them
+func (d *proxyDialer) socks5Connect(conn net.Conn, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return errors.Errorf("invalid port %q", portStr)
+	}
+
+	method := byte(socks5AuthNone)
+	if d.proxy.User != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+	if reply[0] != socks5Version {
+		return newProxyError(ErrProxyRefused, "unexpected socks version %v", reply[0])
+	}
+	if reply[1] == socks5AuthNoMethod {
+		return newProxyError(ErrProxyAuthFailed, "no acceptable authentication method")
+	}
+	// Only the method offered can be used
+	if reply[1] != method {
+		return newProxyError(ErrProxyRefused, "proxy selected authentication method %v, offered %v", reply[1], method)
+	}
+	if method == socks5AuthPassword {
+		if err := d.socks5Authenticate(conn); err != nil {
+			return err
+		}
+	}
+
+	request := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.Errorf("host name %q too long", host)
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddrIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5AddrIPv6)
+		request = append(request, ip...)
+	}
+	var portBytes [2]byte
+	binary.BigEndian.PutUint16(portBytes[:], uint16(port))
+	request = append(request, portBytes[:]...)
+	if _, err := conn.Write(request); err != nil {
+		return newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+
+	// Reply: version, status, reserved, address type, address and port
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+	if header[1] != 0 {
+		return newProxyError(ErrProxyRefused, "socks5 reply %v", header[1])
+	}
+
+	var addrLen int
+	switch header[3] {
+	case socks5AddrIPv4:
+		addrLen = net.IPv4len
+	case socks5AddrIPv6:
+		addrLen = net.IPv6len
+	case socks5AddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return newProxyError(ErrProxyUnreachable, "%v", err)
+		}
+		addrLen = int(size[0])
+	default:
+		return newProxyError(ErrProxyRefused, "unexpected address type %v", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+	return nil
+}
+
+// socks5Authenticate Sends user and password as described in RFC 1929
+func (d *proxyDialer) socks5Authenticate(conn net.Conn) error {
+	user := d.proxy.User.Username()
+	password, _ := d.proxy.User.Password()
+	if len(user) > 255 || len(password) > 255 {
+		return newProxyError(ErrProxyAuthFailed, "credentials too long")
+	}
+
+	request := []byte{socks5PasswordVersion, byte(len(user))}
+	request = append(request, user...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		return newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+	if reply[1] != 0 {
+		return newProxyError(ErrProxyAuthFailed, "socks5 status %v", reply[1])
+	}
+	return nil
+}
+
+// httpConnect Asks an HTTP proxy to open a tunnel with the CONNECT method
+func (d *proxyDialer) httpConnect(conn net.Conn, address string) (net.Conn, error) {
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.proxy.User != nil {
+		password, _ := d.proxy.User.Password()
+		request.SetBasicAuth(d.proxy.User.Username(), password)
+		request.Header.Set("Proxy-Authorization", request.Header.Get("Authorization"))
+		request.Header.Del("Authorization")
+	}
+	if err := request.Write(conn); err != nil {
+		return conn, newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	// The body is not read: after a successful CONNECT the rest of the
+	// stream belongs to the tunnel
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return conn, newProxyError(ErrProxyUnreachable, "%v", err)
+	}
+
+	switch {
+	case response.StatusCode == http.StatusProxyAuthRequired:
+		return conn, newProxyError(ErrProxyAuthFailed, "%v", response.Status)
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return conn, newProxyError(ErrProxyRefused, "%v", response.Status)
+	}
+
+	// Bytes the server sent right after the proxy response could already be
+	// in the reader buffer
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn Connection whose first bytes were already read into a
+// buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
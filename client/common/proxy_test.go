@@ -0,0 +1,168 @@
+package common_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// serveProxy Serves handle on every connection accepted on a random local
+// port until the test ends. Returns its address
+func serveProxy(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// socks5Proxy SOCKS5 stand-in that selects method, checks the password of
+// user if it is set and answers the connect request with reply
+type socks5Proxy struct {
+	method   byte
+	user     string
+	password string
+	reply    byte
+}
+
+func (p socks5Proxy) handle(conn net.Conn) {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{0x05, p.method}); err != nil || p.method == 0xff {
+		return
+	}
+
+	if p.user != "" {
+		user, ok := readSocks5String(conn, 1)
+		if !ok {
+			return
+		}
+		password, ok := readSocks5String(conn, 0)
+		if !ok {
+			return
+		}
+		if user != p.user || password != p.password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	// Connect request with an IPv4 address
+	if _, err := io.ReadFull(conn, make([]byte, 10)); err != nil {
+		return
+	}
+	conn.Write([]byte{0x05, p.reply, 0, 0x01, 127, 0, 0, 1, 0, 0})
+}
+
+// readSocks5String Reads a length prefixed string after skip bytes
+func readSocks5String(r io.Reader, skip int) (string, bool) {
+	buf := make([]byte, skip+1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", false
+	}
+	s := make([]byte, buf[skip])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", false
+	}
+	return string(s), true
+}
+
+// httpProxy HTTP CONNECT stand-in that answers every request with status
+func httpProxy(status int) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		response := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1}
+		response.Write(conn)
+	}
+}
+
+func TestProxyDialer(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		user   string
+		handle func(conn net.Conn)
+		err    error
+	}{
+		{"socks5", "socks5", "", socks5Proxy{method: 0x00}.handle, nil},
+		{"socks5 credentials", "socks5", "user:secret", socks5Proxy{method: 0x02, user: "user", password: "secret"}.handle, nil},
+		{"socks5 wrong password", "socks5", "user:wrong", socks5Proxy{method: 0x02, user: "user", password: "secret"}.handle, common.ErrProxyAuthFailed},
+		{"socks5 no acceptable method", "socks5", "", socks5Proxy{method: 0xff}.handle, common.ErrProxyAuthFailed},
+		{"socks5 gssapi", "socks5", "", socks5Proxy{method: 0x01}.handle, common.ErrProxyRefused},
+		{"socks5 credentials skipped", "socks5", "user:secret", socks5Proxy{method: 0x00}.handle, common.ErrProxyRefused},
+		{"socks5 password not offered", "socks5", "", socks5Proxy{method: 0x02, user: "user", password: "secret"}.handle, common.ErrProxyRefused},
+		{"socks5 connection refused", "socks5", "", socks5Proxy{method: 0x00, reply: 0x05}.handle, common.ErrProxyRefused},
+		{"http", "http", "", httpProxy(http.StatusOK), nil},
+		{"http authentication required", "http", "", httpProxy(http.StatusProxyAuthRequired), common.ErrProxyAuthFailed},
+		{"http forbidden", "http", "user:secret", httpProxy(http.StatusForbidden), common.ErrProxyRefused},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxyURL := test.scheme + "://"
+			if test.user != "" {
+				proxyURL += test.user + "@"
+			}
+			proxyURL += serveProxy(t, test.handle)
+
+			dialer, err := common.NewProxyDialer(proxyURL, &net.Dialer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:12345")
+			if conn != nil {
+				conn.Close()
+			}
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatalf("dial failed: %v", err)
+			case test.err != nil && !errors.Is(err, test.err):
+				t.Fatalf("dial returned %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestProxyDialerUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	dialer, err := common.NewProxyDialer("socks5://"+address, &net.Dialer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dialer.DialContext(context.Background(), "tcp", "127.0.0.1:12345"); !errors.Is(err, common.ErrProxyUnreachable) {
+		t.Fatalf("dial returned %v, expected %v", err, common.ErrProxyUnreachable)
+	}
+}
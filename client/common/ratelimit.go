@@ -0,0 +1,140 @@
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateConfig Limits applied to the traffic the client sends to the server.
+// A zero rate disables the corresponding limit
+type RateConfig struct {
+	BetsPerSecond  float64
+	BytesPerSecond float64
+	// BurstBets Bets that can be sent at once after being idle. One
+	// second worth of BetsPerSecond if zero
+	BurstBets int
+	// BurstBytes Bytes that can be sent at once after being idle. One
+	// second worth of BytesPerSecond if zero
+	BurstBytes int
+}
+
+// tokenBucket Classic token bucket refilled at a fixed rate. The bucket can
+// go into debt so a request bigger than its capacity is still served once
+// enough time has passed to pay for it
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	capacity := float64(burst)
+	if burst <= 0 {
+		capacity = rate
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     now,
+	}
+}
+
+// reserve Takes n tokens from the bucket and returns how long the caller
+// has to wait before the reservation can be used
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund Gives back n tokens of a reservation that was not used
+func (b *tokenBucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+
+	b.tokens += n
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+// RateLimiter Paces the bets and bytes sent to the server. It is safe to
+// share a single limiter between every sender of the process so the
+// configured rates apply to the client as a whole
+type RateLimiter struct {
+	mu      sync.Mutex
+	bets    *tokenBucket
+	bytes   *tokenBucket
+	metrics *Metrics
+}
+
+// NewRateLimiter Initializes a limiter with the given configuration. Time
+// spent waiting for tokens is accumulated in metrics
+func NewRateLimiter(config RateConfig, metrics *Metrics) *RateLimiter {
+	limiter := &RateLimiter{metrics: metrics}
+	now := time.Now()
+	if config.BetsPerSecond > 0 {
+		limiter.bets = newTokenBucket(config.BetsPerSecond, config.BurstBets, now)
+	}
+	if config.BytesPerSecond > 0 {
+		limiter.bytes = newTokenBucket(config.BytesPerSecond, config.BurstBytes, now)
+	}
+	return limiter
+}
+
+// Wait Blocks until the given amount of bets and bytes can be sent without
+// exceeding the configured rates. If the context is cancelled while
+// waiting, the tokens reserved are given back and its error is returned
+func (l *RateLimiter) Wait(ctx context.Context, bets int, bytes int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	delay := l.bets.reserve(float64(bets), now)
+	if d := l.bytes.reserve(float64(bytes), now); d > delay {
+		delay = d
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	start := time.Now()
+	select {
+	case <-timer.C:
+		l.metrics.AddThrottled(delay)
+		return nil
+	case <-ctx.Done():
+		l.metrics.AddThrottled(time.Since(start))
+		l.mu.Lock()
+		l.bets.refund(float64(bets))
+		l.bytes.refund(float64(bytes))
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
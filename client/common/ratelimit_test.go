@@ -0,0 +1,118 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// waitAll Waits for every request on limiter in order and returns how long
+// it took
+func waitAll(t *testing.T, limiter *common.RateLimiter, requests [][2]int) time.Duration {
+	t.Helper()
+	start := time.Now()
+	for _, r := range requests {
+		if err := limiter.Wait(context.Background(), r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Since(start)
+}
+
+// TestRateLimiterPacing Once the burst is spent, bets and bytes are let
+// through at the configured rates
+func TestRateLimiterPacing(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   common.RateConfig
+		requests [][2]int
+		expected time.Duration
+	}{
+		{
+			name:   "bets per second",
+			config: common.RateConfig{BetsPerSecond: 100, BurstBets: 10},
+			// The first ten bets are the burst, the next fifty take half a second
+			requests: [][2]int{{10, 0}, {10, 0}, {10, 0}, {10, 0}, {10, 0}, {10, 0}},
+			expected: 500 * time.Millisecond,
+		},
+		{
+			name:     "bytes per second",
+			config:   common.RateConfig{BytesPerSecond: 10000, BurstBytes: 1000},
+			requests: [][2]int{{1, 1000}, {1, 1000}, {1, 1000}, {1, 1000}, {1, 1000}, {1, 1000}},
+			expected: 500 * time.Millisecond,
+		},
+		{
+			name:   "slowest limit",
+			config: common.RateConfig{BetsPerSecond: 1000, BytesPerSecond: 10000, BurstBets: 10, BurstBytes: 1000},
+			// Bytes allow a request every 100ms, bets every 10ms
+			requests: [][2]int{{10, 1000}, {10, 1000}, {10, 1000}, {10, 1000}},
+			expected: 300 * time.Millisecond,
+		},
+		{
+			name:   "default burst",
+			config: common.RateConfig{BetsPerSecond: 20},
+			// One second worth of bets goes through at once
+			requests: [][2]int{{20, 0}, {5, 0}},
+			expected: 250 * time.Millisecond,
+		},
+		{
+			name:     "unlimited",
+			config:   common.RateConfig{},
+			requests: [][2]int{{1000000, 1000000}, {1000000, 1000000}},
+			expected: 0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			metrics := common.NewMetrics()
+			limiter := common.NewRateLimiter(test.config, metrics)
+			elapsed := waitAll(t, limiter, test.requests)
+			if elapsed < test.expected-20*time.Millisecond || elapsed > test.expected+200*time.Millisecond {
+				t.Fatalf("requests took %v, expected about %v", elapsed, test.expected)
+			}
+			if throttled := metrics.Throttled(); throttled < test.expected-20*time.Millisecond {
+				t.Fatalf("%v recorded as throttled, expected about %v", throttled, test.expected)
+			}
+		})
+	}
+}
+
+// TestRateLimiterBurst The burst is let through at once and the following
+// request waits for the bucket to refill
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := common.NewRateLimiter(common.RateConfig{BetsPerSecond: 10, BurstBets: 50}, nil)
+	if elapsed := waitAll(t, limiter, [][2]int{{20, 0}, {20, 0}, {10, 0}}); elapsed > 50*time.Millisecond {
+		t.Fatalf("burst took %v, expected it to go through at once", elapsed)
+	}
+	if elapsed := waitAll(t, limiter, [][2]int{{1, 0}}); elapsed < 50*time.Millisecond {
+		t.Fatalf("request after the burst took %v, expected it to wait for a token", elapsed)
+	}
+}
+
+// TestRateLimiterCancel Cancelling the context while waiting returns its
+// error, and the tokens reserved are given back so the next request does
+// not pay for the cancelled one
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := common.NewRateLimiter(common.RateConfig{BetsPerSecond: 10, BurstBets: 10}, nil)
+	waitAll(t, limiter, [][2]int{{10, 0}})
+
+	// Ten more bets take a second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := limiter.Wait(ctx, 10, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("wait returned after %v, expected it to stop on cancel", elapsed)
+	}
+
+	// Without the refund a single bet would wait for the cancelled ten
+	if elapsed := waitAll(t, limiter, [][2]int{{1, 0}}); elapsed > 300*time.Millisecond {
+		t.Fatalf("request after the cancel took %v, the cancelled tokens were not given back", elapsed)
+	}
+}
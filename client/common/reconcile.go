@@ -0,0 +1,293 @@
+package common
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Kinds of discrepancies between the local bets and the stored ones
+const (
+	// DiscrepancyMissing The bet is in the local file but was not stored
+	DiscrepancyMissing = "missing"
+	// DiscrepancyExtra The bet was stored but is not in the local file
+	DiscrepancyExtra = "extra"
+	// DiscrepancyMismatched The document was stored with another number
+	DiscrepancyMismatched = "mismatched"
+)
+
+// BetKey Fields that identify a bet stored by the server
+type BetKey struct {
+	Document string
+	Number   string
+}
+
+// EncodeBetKeys Serializes keys as <Document>/<Number> separated by ';',
+// split in as many payloads of at most maxPayloadSize bytes as needed
+func EncodeBetKeys(keys []BetKey, maxPayloadSize int) [][]byte {
+	var payloads [][]byte
+	var current []string
+	size := 0
+	for _, k := range keys {
+		encoded := k.Document + betFieldSeparator + k.Number
+		if len(current) > 0 && size+len(betSeparator)+len(encoded) > maxPayloadSize {
+			payloads = append(payloads, []byte(strings.Join(current, betSeparator)))
+			current = nil
+			size = 0
+		}
+		if len(current) > 0 {
+			size += len(betSeparator)
+		}
+		current = append(current, encoded)
+		size += len(encoded)
+	}
+	if len(current) > 0 {
+		payloads = append(payloads, []byte(strings.Join(current, betSeparator)))
+	}
+	return payloads
+}
+
+// DecodeBetKeys Parses a payload serialized with EncodeBetKeys
+func DecodeBetKeys(payload []byte) ([]BetKey, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	var keys []BetKey
+	for _, encoded := range strings.Split(string(payload), betSeparator) {
+		fields := strings.Split(encoded, betFieldSeparator)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("malformed bet key %q", encoded)
+		}
+		keys = append(keys, BetKey{Document: fields[0], Number: fields[1]})
+	}
+	return keys, nil
+}
+
+// Discrepancy Difference found between a local bet and a stored one
+type Discrepancy struct {
+	Kind         string `json:"kind"`
+	Document     string `json:"document"`
+	LocalNumber  string `json:"local_number,omitempty"`
+	StoredNumber string `json:"stored_number,omitempty"`
+}
+
+// ReconcileReport Outcome of comparing the bets of a local file with the
+// ones the server stored for the agency
+type ReconcileReport struct {
+	Agency        string        `json:"agency"`
+	File          string        `json:"file"`
+	LocalBets     int           `json:"local_bets"`
+	StoredBets    int           `json:"stored_bets"`
+	Missing       int           `json:"missing"`
+	Extra         int           `json:"extra"`
+	Mismatched    int           `json:"mismatched"`
+	LocalDigest   string        `json:"local_digest"`
+	StoredDigest  string        `json:"stored_digest"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+}
+
+// Consistent Returns whether the server stored exactly the local bets.
+// Bets with the same keys but other fields changed only show up as
+// different digests
+func (r *ReconcileReport) Consistent() bool {
+	return len(r.Discrepancies) == 0 && r.LocalDigest == r.StoredDigest
+}
+
+// CompareBets Compares the local bets of agency with the keys of the bets
+// stored. Bets are matched by document and number. When a document has
+// numbers on both sides that do not match, they are paired as mismatched
+// and the rest reported as missing or extra
+func CompareBets(agency string, local []Bet, stored []BetKey) *ReconcileReport {
+	localNumbers := make(map[string]map[string]bool)
+	for _, b := range local {
+		addNumber(localNumbers, b.Document, b.Number)
+	}
+	storedNumbers := make(map[string]map[string]bool)
+	for _, k := range stored {
+		addNumber(storedNumbers, k.Document, k.Number)
+	}
+
+	documents := make(map[string]bool)
+	for d := range localNumbers {
+		documents[d] = true
+	}
+	for d := range storedNumbers {
+		documents[d] = true
+	}
+	sorted := make([]string, 0, len(documents))
+	for d := range documents {
+		sorted = append(sorted, d)
+	}
+	sort.Strings(sorted)
+
+	report := &ReconcileReport{Agency: agency, Discrepancies: []Discrepancy{}}
+	for _, d := range sorted {
+		report.LocalBets += len(localNumbers[d])
+		report.StoredBets += len(storedNumbers[d])
+
+		onlyLocal := missingNumbers(localNumbers[d], storedNumbers[d])
+		onlyStored := missingNumbers(storedNumbers[d], localNumbers[d])
+		for len(onlyLocal) > 0 && len(onlyStored) > 0 {
+			report.add(Discrepancy{Kind: DiscrepancyMismatched, Document: d, LocalNumber: onlyLocal[0], StoredNumber: onlyStored[0]})
+			onlyLocal = onlyLocal[1:]
+			onlyStored = onlyStored[1:]
+		}
+		for _, n := range onlyLocal {
+			report.add(Discrepancy{Kind: DiscrepancyMissing, Document: d, LocalNumber: n})
+		}
+		for _, n := range onlyStored {
+			report.add(Discrepancy{Kind: DiscrepancyExtra, Document: d, StoredNumber: n})
+		}
+	}
+	return report
+}
+
+func (r *ReconcileReport) add(d Discrepancy) {
+	switch d.Kind {
+	case DiscrepancyMissing:
+		r.Missing++
+	case DiscrepancyExtra:
+		r.Extra++
+	case DiscrepancyMismatched:
+		r.Mismatched++
+	}
+	r.Discrepancies = append(r.Discrepancies, d)
+}
+
+func addNumber(numbers map[string]map[string]bool, document string, number string) {
+	if numbers[document] == nil {
+		numbers[document] = make(map[string]bool)
+	}
+	numbers[document][number] = true
+}
+
+// missingNumbers Numbers in a that are not in b, sorted
+func missingNumbers(a map[string]bool, b map[string]bool) []string {
+	var missing []string
+	for n := range a {
+		if !b[n] {
+			missing = append(missing, n)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// WriteCSV Writes the discrepancies of the report as CSV, one per row
+func (r *ReconcileReport) WriteCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"kind", "document", "local_number", "stored_number"})
+	for _, d := range r.Discrepancies {
+		w.Write([]string{d.Kind, d.Document, d.LocalNumber, d.StoredNumber})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// WriteJSON Writes the whole report as indented JSON
+func (r *ReconcileReport) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Reconcile Compares the bets of the file at path with the ones the
+// server stored for the agency of the client
+func (c *Client) Reconcile(ctx context.Context, path string) (*ReconcileReport, error) {
+	local, _, err := c.loadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, submission, err := c.queryBets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := CompareBets(c.config.ID, local, stored)
+	report.File = path
+	report.LocalDigest = NewSubmission(c.config.ID, local).Digest
+	report.StoredDigest = submission.Digest
+	return report, nil
+}
+
+// queryBets Returns the keys of the bets the server stored for the agency
+// of the client, along with the summary of those bets
+func (c *Client) queryBets(ctx context.Context) ([]BetKey, Submission, error) {
+	var keys []BetKey
+	var submission Submission
+	err := c.retry(ctx, "query_bets", func(conn net.Conn) (bool, error) {
+		keys = nil
+		span, err := c.request(conn, Frame{Type: MsgQueryBets, Payload: []byte(c.config.ID)})
+		if err != nil {
+			return false, err
+		}
+		for {
+			response, err := c.readResponse(conn, nil)
+			if err != nil {
+				span.Fail(err)
+				return len(keys) > 0, err
+			}
+			// The span ends with the first response, as on the server
+			span.Finish(MessageName(response.Type))
+			switch response.Type {
+			case MsgStoredBets:
+				chunk, err := DecodeBetKeys(response.Payload)
+				if err != nil {
+					return true, &errServer{msg: err.Error()}
+				}
+				keys = append(keys, chunk...)
+			case MsgAck:
+				submission, err = DecodeSubmission(response.Payload)
+				if err != nil {
+					return true, &errServer{msg: err.Error()}
+				}
+				return true, nil
+			default:
+				return false, errors.Errorf("unexpected message type %q", response.Type)
+			}
+		}
+	})
+	return keys, submission, err
+}
+
+// LogReconcileReport Logs the outcome of a reconciliation
+func LogReconcileReport(clientID string, report *ReconcileReport) {
+	if report.Consistent() {
+		log.Infof("action: reconcile | result: success | client_id: %v | file: %v | local_bets: %v | stored_bets: %v",
+			clientID,
+			report.File,
+			report.LocalBets,
+			report.StoredBets,
+		)
+		return
+	}
+	log.Errorf("action: reconcile | result: fail | client_id: %v | file: %v | local_bets: %v | stored_bets: %v | missing: %v | extra: %v | mismatched: %v | digest_match: %v",
+		clientID,
+		report.File,
+		report.LocalBets,
+		report.StoredBets,
+		report.Missing,
+		report.Extra,
+		report.Mismatched,
+		report.LocalDigest == report.StoredDigest,
+	)
+}
@@ -0,0 +1,532 @@
+package common
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReplicationConfig Configuration of the replicated send mode. If
+// Replicas is set, every batch is sent to all of them
+type ReplicationConfig struct {
+	Replicas []string
+	// WriteQuorum Replicas that must acknowledge a batch for it to be
+	// committed. A majority of the replicas is required if not set
+	WriteQuorum int
+	// CatchUpTimeout Time the replicas behind the quorum are given to
+	// catch up once the session ends before being stopped. They are
+	// stopped right away if zero
+	CatchUpTimeout time.Duration
+}
+
+// quorum Returns the write quorum to use, validating it against the
+// amount of replicas
+func (c ReplicationConfig) quorum() (int, error) {
+	if c.WriteQuorum == 0 {
+		return len(c.Replicas)/2 + 1, nil
+	}
+	if c.WriteQuorum < 0 || c.WriteQuorum > len(c.Replicas) {
+		return 0, errors.Errorf("write quorum %v must be between 1 and the %v replicas", c.WriteQuorum, len(c.Replicas))
+	}
+	return c.WriteQuorum, nil
+}
+
+// replica Server that receives a copy of every batch. It is reached
+// through its own endpoint so its health is tracked separately
+type replica struct {
+	clientID  string
+	hello     Hello
+	endpoints *endpointSet
+	current   *endpoint
+	session   Session
+	timeout   time.Duration
+	tracer    *requestTracer
+	// idle Connection opened before the batches were cut, handed to the
+	// first connect
+	idle net.Conn
+}
+
+func newReplica(hello Hello, address string, config FailoverConfig, dialer Dialer, tracer *requestTracer) *replica {
+	return &replica{
+		clientID:  hello.Agency,
+		hello:     hello,
+		endpoints: newEndpointSet([]string{address}, config, dialer),
+		timeout:   config.ConnectTimeout,
+		tracer:    tracer,
+	}
+}
+
+func (r *replica) connect(ctx context.Context) (net.Conn, error) {
+	if conn := r.idle; conn != nil {
+		r.idle = nil
+		return conn, nil
+	}
+
+	conn, e, err := r.endpoints.dial(ctx, r.clientID)
+	if err != nil {
+		return nil, err
+	}
+	r.current = e
+	log.Debugf("action: connect | result: success | client_id: %v | replica: %v | ip: %v",
+		r.clientID,
+		e.address,
+		conn.RemoteAddr(),
+	)
+
+	session, request, err := handshake(conn, r.hello, r.timeout, r.tracer)
+	if err != nil {
+		conn.Close()
+		logHandshakeError(r.clientID, e.address, request, err)
+		if !isFatal(err) {
+			r.failed()
+		}
+		return nil, err
+	}
+	if !sameSession(session, r.session) {
+		logSession(r.clientID, e.address, request, session)
+	}
+	r.session = session
+	return conn, nil
+}
+
+func (r *replica) Session() Session {
+	return r.session
+}
+
+func (r *replica) succeeded() {
+	if r.current != nil {
+		r.endpoints.markSuccess(r.current, r.clientID)
+	}
+}
+
+func (r *replica) failed() {
+	if r.current != nil {
+		r.endpoints.markFailure(r.current, r.clientID)
+	}
+}
+
+func (r *replica) address() string {
+	return r.endpoints.endpoints[0].address
+}
+
+// commitTracker Commit state of every batch. A batch is committed once
+// quorum replicas acknowledged it
+type commitTracker struct {
+	mu        sync.Mutex
+	quorum    int
+	acks      map[uint32]int
+	committed int
+	// cut Batches cut so far, and whether every bet was already put in one
+	cut      int
+	complete bool
+	// done Closed once every batch is cut and committed
+	done   chan struct{}
+	closed bool
+}
+
+func newCommitTracker(quorum int) *commitTracker {
+	return &commitTracker{quorum: quorum, acks: make(map[uint32]int), done: make(chan struct{})}
+}
+
+// add Records that a batch was cut. last tells whether every bet is in a
+// batch by now
+func (t *commitTracker) add(last bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cut++
+	t.complete = last
+	t.closeIfDone()
+}
+
+// finish Records that every bet is in a batch
+func (t *commitTracker) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.complete = true
+	t.closeIfDone()
+}
+
+// ack Records an ack of the batch seq. Returns true if the ack is the one
+// that commits the batch
+func (t *commitTracker) ack(seq uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.acks[seq]++
+	if t.acks[seq] != t.quorum {
+		return false
+	}
+	t.committed++
+	t.closeIfDone()
+	return true
+}
+
+func (t *commitTracker) closeIfDone() {
+	if t.complete && t.committed == t.cut && !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+}
+
+// state Amount of acks received for the batch seq and whether it is
+// committed
+func (t *commitTracker) state(seq uint32) (int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.acks[seq], t.acks[seq] >= t.quorum
+}
+
+func (t *commitTracker) committedCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.committed
+}
+
+// sharedBatches Bets to be cut into batches for every replica. A batch is
+// cut when the first replica needs it, so the batches follow the sizer
+// shared by the senders of the replicas, and it is journaled for the rest
+// to replay
+type sharedBatches struct {
+	mu      sync.Mutex
+	source  *journaledSource
+	tracker *commitTracker
+	// maxFrameSize Biggest frame accepted by every replica reached
+	maxFrameSize int
+}
+
+// replicaSource Batch source of a replica. It replays the journal from
+// the last batch the replica acknowledged, and cuts the next batch once
+// the replica is past the end of the journal
+type replicaSource struct {
+	cursor *journalCursor
+	shared *sharedBatches
+}
+
+func (s *replicaSource) done() bool {
+	if !s.cursor.done() {
+		return false
+	}
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+	// Another replica may have cut a batch in the meantime
+	return s.cursor.done() && s.shared.source.done()
+}
+
+func (s *replicaSource) nextBatch(size int, maxFrameSize int) (*Batch, error) {
+	if b, _ := s.cursor.nextBatch(size, maxFrameSize); b != nil {
+		return b, nil
+	}
+
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+	if b, _ := s.cursor.nextBatch(size, maxFrameSize); b != nil {
+		return b, nil
+	}
+	if maxFrameSize > s.shared.maxFrameSize {
+		maxFrameSize = s.shared.maxFrameSize
+	}
+	b, err := s.shared.source.nextBatch(size, maxFrameSize)
+	if err != nil || b == nil {
+		return nil, err
+	}
+	s.shared.tracker.add(s.shared.source.done())
+	return s.cursor.nextBatch(size, maxFrameSize)
+}
+
+// replicaSync Sender of the batches of a file to a replica
+type replicaSync struct {
+	replica *replica
+	// synced Closed once the sender stopped, err telling why if it did
+	// not deliver every batch
+	synced chan struct{}
+	err    error
+}
+
+// laggingReplicas Replicas of the last file sent. The ones behind the
+// quorum keep catching up from the journal once every batch was
+// committed, and are told the agency finished once they did
+type laggingReplicas struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	quorum int
+	syncs  []*replicaSync
+	// finishing FINISHED messages still being sent to the replicas
+	finishing sync.WaitGroup
+	// done Closed once every sender stopped
+	done chan struct{}
+}
+
+// stopLagging Waits up to Replication.CatchUpTimeout for the replicas of
+// the last file sent to catch up and be told the agency finished, then
+// stops the ones that did not
+func (c *Client) stopLagging() {
+	l := c.lagging
+	if l == nil {
+		return
+	}
+	c.lagging = nil
+
+	stopped := make(chan struct{})
+	go func() {
+		<-l.done
+		l.finishing.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(c.config.Replication.CatchUpTimeout):
+		l.cancel()
+		<-stopped
+	}
+	l.cancel()
+}
+
+// sendReplicated Sends every bet to all the replicas. Each replica is fed
+// by its own pipelined sender, which replays the journal from the last
+// batch the replica acknowledged, so a replica that falls behind or
+// reconnects catches up. The replica furthest ahead cuts the batches as
+// the pipelined sender would, with the size chosen by a sizer shared by
+// every replica and a frame that fits in the smallest one they accept.
+// Returns the amount of batches committed as soon as every batch is, and
+// the replicas that lag behind keep catching up until stopLagging is
+// called. The journal is closed once every replica stopped
+func (c *Client) sendReplicated(ctx context.Context, bets []Bet, journal *Journal) (int, error) {
+	quorum, err := c.config.Replication.quorum()
+	if err != nil {
+		journal.Close()
+		return 0, err
+	}
+
+	replicas := make([]*replica, len(c.config.Replication.Replicas))
+	for i, address := range c.config.Replication.Replicas {
+		replicas[i] = newReplica(newHello(c.config), address, c.config.Failover, c.dialer, c.tracer)
+	}
+	tracker := newCommitTracker(quorum)
+	shared := &sharedBatches{
+		source:       &journaledSource{source: newBatcher(bets), journal: journal},
+		tracker:      tracker,
+		maxFrameSize: c.connectReplicas(ctx, replicas),
+	}
+	if shared.source.done() {
+		tracker.finish()
+	}
+
+	syncCtx, cancel := context.WithCancel(ctx)
+	lagging := &laggingReplicas{ctx: syncCtx, cancel: cancel, quorum: quorum, done: make(chan struct{})}
+	sizer := newBatchSizer(c.config.Batch, c.config.ID, c.metrics)
+	results := make(chan error, len(replicas))
+	for _, r := range replicas {
+		r := r
+		sender := newPipelineSender(c, r, &replicaSource{cursor: newJournalCursor(journal, r.address()), shared: shared})
+		sender.sizer = sizer
+		sender.onAck = func(b *Batch) {
+			if err := journal.AppendAck(r.address(), b.Seq); err != nil {
+				log.Warningf("action: journal_ack | result: fail | client_id: %v | replica: %v | seq: %v | error: %v",
+					c.config.ID,
+					r.address(),
+					b.Seq,
+					err,
+				)
+			}
+			if tracker.ack(b.Seq) {
+				c.metrics.AddAcked(len(b.Bets))
+				log.Debugf("action: batch_commit | result: success | client_id: %v | seq: %v | quorum: %v",
+					c.config.ID,
+					b.Seq,
+					quorum,
+				)
+			}
+		}
+
+		s := &replicaSync{replica: r, synced: make(chan struct{})}
+		lagging.syncs = append(lagging.syncs, s)
+		go func() {
+			err := sender.run(syncCtx)
+			if err != nil {
+				log.Errorf("action: replica_sync | result: fail | client_id: %v | replica: %v | acked: %v | batches: %v | error: %v",
+					c.config.ID,
+					r.address(),
+					journal.Acked(r.address()),
+					journal.Len(),
+					err,
+				)
+			} else {
+				log.Infof("action: replica_sync | result: success | client_id: %v | replica: %v | acked: %v",
+					c.config.ID,
+					r.address(),
+					journal.Acked(r.address()),
+				)
+			}
+			s.err = err
+			close(s.synced)
+			results <- err
+		}()
+	}
+
+	for pending := len(replicas); pending > 0; {
+		select {
+		case <-tracker.done:
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					<-results
+				}
+				journal.Close()
+				close(lagging.done)
+			}(pending)
+			c.lagging = lagging
+			return tracker.committedCount(), nil
+		case <-results:
+			pending--
+		}
+	}
+	cancel()
+	journal.Close()
+
+	// Every replica stopped before the last batch was committed
+	seq := uint32(1)
+	acks, ok := tracker.state(seq)
+	for ; ok; acks, ok = tracker.state(seq) {
+		seq++
+	}
+	return tracker.committedCount(), errors.Errorf("batch %v reached %v of %v acks required", seq, acks, quorum)
+}
+
+// finishReplicated Tells every replica that the agency finished once the
+// replica caught up, and returns as soon as a write quorum of them
+// answered with the summary of the bets sent. The replicas behind are
+// told in the background until stopLagging. If the quorum cannot be
+// reached, the summary of a replica that stored other bets is returned,
+// if any answered with one. The address of the replica whose summary is
+// returned comes along with it
+func (c *Client) finishReplicated(ctx context.Context, sent Submission) (*Submission, string, error) {
+	type finished struct {
+		address string
+		stored  *Submission
+		err     error
+	}
+
+	l := c.lagging
+	results := make(chan finished, len(l.syncs))
+	for _, s := range l.syncs {
+		s := s
+		l.finishing.Add(1)
+		go func() {
+			defer l.finishing.Done()
+			stored, err := c.finishReplica(l.ctx, s, sent)
+			results <- finished{address: s.replica.address(), stored: stored, err: err}
+		}()
+	}
+
+	matched := 0
+	var mismatched finished
+	var err error
+	for range l.syncs {
+		var r finished
+		select {
+		case r = <-results:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		switch {
+		case r.err != nil:
+			err = r.err
+		case r.stored != nil && sent.Matches(*r.stored):
+			matched++
+			if matched == l.quorum {
+				return r.stored, r.address, nil
+			}
+		case r.stored != nil:
+			mismatched = r
+		}
+	}
+	if mismatched.stored != nil {
+		return mismatched.stored, mismatched.address, nil
+	}
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "%v of %v summaries required", matched, l.quorum)
+	}
+	return nil, "", errors.Errorf("%v of %v summaries required", matched, l.quorum)
+}
+
+// finishReplica Waits for the sender of s to deliver every batch and
+// tells the replica that the agency finished. Returns the summary of the
+// bets the replica stored, nil if it did not report one
+func (c *Client) finishReplica(ctx context.Context, s *replicaSync, sent Submission) (*Submission, error) {
+	select {
+	case <-s.synced:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var stored *Submission
+	var request uint32
+	err := c.retryOn(ctx, s.replica, &request, "finish_bets", func(conn net.Conn) (bool, error) {
+		f := Frame{Type: MsgFinished, Flags: s.replica.session.Flags(), Payload: sent.Encode()}
+		f, span := c.tracer.request(f)
+		request = f.Request
+		if err := WriteFrame(conn, f); err != nil {
+			span.Fail(err)
+			return false, err
+		}
+		var progress bool
+		var err error
+		stored, progress, err = c.readFinished(conn, span)
+		return progress, err
+	})
+	if err != nil {
+		log.Errorf("action: finish_bets | result: fail | client_id: %v | request_id: %v | replica: %v | error: %v",
+			c.config.ID,
+			request,
+			s.replica.address(),
+			err,
+		)
+		return nil, err
+	}
+	log.Debugf("action: finish_bets | result: success | client_id: %v | request_id: %v | replica: %v",
+		c.config.ID,
+		request,
+		s.replica.address(),
+	)
+	return stored, nil
+}
+
+// connectReplicas Connects to every replica, leaving the connections for
+// their senders. Returns the biggest frame a batch can take so that it is
+// accepted by every replica reached. Replicas that cannot be reached are
+// assumed to accept the frames the client asks for
+func (c *Client) connectReplicas(ctx context.Context, replicas []*replica) int {
+	session := Session{MaxFrameSize: MaxFrameSize, Features: newHello(c.config).Features}
+	maxFrameSize := session.maxBatchFrameSize()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, r := range replicas {
+		wg.Add(1)
+		go func(r *replica) {
+			defer wg.Done()
+			conn, err := r.connect(ctx)
+			if err != nil {
+				log.Warningf("action: connect | result: fail | client_id: %v | replica: %v | error: %v",
+					c.config.ID,
+					r.address(),
+					err,
+				)
+				return
+			}
+			r.idle = conn
+			mu.Lock()
+			defer mu.Unlock()
+			if size := r.session.maxBatchFrameSize(); size < maxFrameSize {
+				maxFrameSize = size
+			}
+		}(r)
+	}
+	wg.Wait()
+	return maxFrameSize
+}
@@ -0,0 +1,214 @@
+package common_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// refusingReplica Returns the address of a port nobody listens on
+func refusingReplica(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+// droppingReplica Returns the address of a listener that closes every
+// connection as soon as it accepts it
+func droppingReplica(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// replicatedConfig Configuration of a client that sends the bets of
+// betsFile to every replica, the first one taking the FINISHED message
+func replicatedConfig(betsFile string, quorum int, replicas ...string) common.ClientConfig {
+	config := testConfig(replicas[0], betsFile)
+	config.Replication = common.ReplicationConfig{Replicas: replicas, WriteQuorum: quorum}
+	config.Pipeline.MaxReconnects = 1
+	return config
+}
+
+// TestReplicationQuorumMet The send succeeds once the write quorum
+// acknowledged every batch, even if the rest of the replicas refuse or
+// drop the connection
+func TestReplicationQuorumMet(t *testing.T) {
+	first, firstServer := startServer(t, testserver.DefaultConfig())
+	second, secondServer := startServer(t, testserver.DefaultConfig())
+
+	const bets = 100
+	config := replicatedConfig(writeBetsFile(t, bets), 2, first, second, refusingReplica(t), droppingReplica(t))
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	// Every batch counts once, however many replicas stored it
+	if summary.BetsSent != bets || summary.BetsAcked != bets || summary.Batches != bets/10 {
+		t.Fatalf("summary counts %v bets sent, %v acked in %v batches, expected %v in %v",
+			summary.BetsSent, summary.BetsAcked, summary.Batches, bets, bets/10)
+	}
+	assertStored(t, firstServer, bets)
+	assertStored(t, secondServer, bets)
+}
+
+// TestReplicationQuorumNotMet The send fails if fewer replicas than the
+// write quorum can acknowledge the batches
+func TestReplicationQuorumNotMet(t *testing.T) {
+	address, _ := startServer(t, testserver.DefaultConfig())
+
+	config := replicatedConfig(writeBetsFile(t, 100), 2, address, refusingReplica(t), droppingReplica(t))
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status == common.SessionSuccess {
+		t.Fatal("session succeeded without the write quorum")
+	}
+	if !strings.Contains(summary.Error, "acks required") {
+		t.Fatalf("session failed with %q, expected the quorum not to be reached", summary.Error)
+	}
+}
+
+// TestReplicationSlowReplica The send returns as soon as the write quorum
+// acknowledged every batch, without waiting for a slow replica
+func TestReplicationSlowReplica(t *testing.T) {
+	first, firstServer := startServer(t, testserver.DefaultConfig())
+	second, secondServer := startServer(t, testserver.DefaultConfig())
+	slowConfig := testserver.DefaultConfig()
+	slowConfig.Latency = 300 * time.Millisecond
+	slow, _ := startServer(t, slowConfig)
+
+	// Twenty batches take the slow replica six seconds with a window of one
+	const bets = 200
+	config := replicatedConfig(writeBetsFile(t, bets), 2, first, second, slow)
+	start := time.Now()
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("session took %v, it waited for the slow replica", elapsed)
+	}
+	assertStored(t, firstServer, bets)
+	assertStored(t, secondServer, bets)
+}
+
+// TestReplicationLaggingReplica A replica whose connection is lost
+// catches up from the last batch it acknowledged, as recorded in the
+// journal, without the batches it already stored being sent again
+func TestReplicationLaggingReplica(t *testing.T) {
+	first, firstServer := startServer(t, testserver.DefaultConfig())
+	lagging, laggingServer := startServer(t, testserver.DefaultConfig())
+
+	const bets, cutAfter = 100, 3
+	sent := 0
+	dialer := &recordingDialer{cut: func(e frameEvent) bool {
+		if e.address != lagging || e.frame.Type != common.MsgBatch {
+			return false
+		}
+		sent++
+		return sent == cutAfter
+	}}
+	config := replicatedConfig(writeBetsFile(t, bets), 2, first, lagging)
+	summary := common.NewClient(config, dialer).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+
+	conns := dialer.connsTo(lagging)
+	if len(conns) < 2 {
+		t.Fatalf("the lagging replica was reached on %v connections, expected it to reconnect", len(conns))
+	}
+	acked := make(map[uint32]bool)
+	for _, seq := range seqs(dialer.frames(conns[0], false, common.MsgAck)) {
+		acked[seq] = true
+	}
+	resent := seqs(dialer.frames(conns[1], true, common.MsgBatch))
+	if len(resent) == 0 || resent[0] != uint32(len(acked)+1) {
+		t.Fatalf("batches %v sent after reconnecting, expected to resume after the %v acked", resent, len(acked))
+	}
+	assertStored(t, firstServer, bets)
+	assertStored(t, laggingServer, bets)
+}
+
+// TestReplicationSmallestFrameSize Batches are cut to fit the smallest
+// frame accepted by the replicas
+func TestReplicationSmallestFrameSize(t *testing.T) {
+	first, firstServer := startServer(t, testserver.DefaultConfig())
+	smallConfig := testserver.DefaultConfig()
+	smallConfig.MaxFrameSize = 512
+	small, smallServer := startServer(t, smallConfig)
+
+	const bets = 100
+	config := replicatedConfig(writeBetsFile(t, bets), 2, first, small)
+	config.Batch.MaxAmount = 100
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	assertStored(t, firstServer, bets)
+	assertStored(t, smallServer, bets)
+}
+
+// TestReplicationRecoveredReplica A replica that cannot be reached when
+// the session starts catches up once it recovers, even after the quorum
+// committed every batch, and is told the agency finished
+func TestReplicationRecoveredReplica(t *testing.T) {
+	serverConfig := testserver.DefaultConfig()
+	serverConfig.Latency = 10 * time.Millisecond
+	first, firstServer := startServer(t, serverConfig)
+	second, secondServer := startServer(t, serverConfig)
+	recovering, recoveringServer := startServer(t, serverConfig)
+
+	// The replica recovers once the quorum stored a fifth of the bets
+	const bets = 200
+	dialer := &recordingDialer{dialer: common.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == recovering && len(firstServer.Bets(testAgency)) < bets/5 {
+			return nil, errors.New("connection refused")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	})}
+	config := replicatedConfig(writeBetsFile(t, bets), 2, first, second, recovering)
+	config.Failover.Cooldown = 10 * time.Millisecond
+	config.Pipeline.MaxReconnects = 100
+	config.Replication.CatchUpTimeout = 5 * time.Second
+	summary := common.NewClient(config, dialer).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+
+	assertStored(t, firstServer, bets)
+	assertStored(t, secondServer, bets)
+	assertStored(t, recoveringServer, bets)
+	finished := false
+	for _, conn := range dialer.connsTo(recovering) {
+		if len(dialer.frames(conn, true, common.MsgFinished)) > 0 {
+			finished = true
+		}
+	}
+	if !finished {
+		t.Fatal("the recovered replica was not told the agency finished")
+	}
+}
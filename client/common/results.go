@@ -0,0 +1,335 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ResultsConfig Configuration of the wait for the results of the draw
+type ResultsConfig struct {
+	// Wait Whether the client waits for the winners of its agency once
+	// every bet was sent
+	Wait bool
+	// PollInterval Time between queries when the server cannot push the
+	// results
+	PollInterval time.Duration
+	// Output File the winners are written to, with the details of their
+	// bets, if not empty
+	Output string
+	// Format Format of Output, see WinnersFormatAuto
+	Format string
+}
+
+// DrawResult Outcome of the draw for the agency of the client
+type DrawResult struct {
+	WinningNumber string
+	// Winners Documents of the winners of the agency
+	Winners []string
+}
+
+// errUnsupported Returned when the server does not implement a message
+var errUnsupported = errors.New("message not supported by the server")
+
+// finishBets Tells the server that every bet of the agency was sent,
+// along with the summary of the bets submitted. Returns the summary of
+// the bets the server stored, or nil if it did not report one, and the
+// address of the server. If replicas are configured, it is told to them
+// instead
+func (c *Client) finishBets(ctx context.Context, sent Submission) (*Submission, string, error) {
+	if c.lagging != nil {
+		return c.finishReplicated(ctx, sent)
+	}
+
+	var stored *Submission
+	err := c.retry(ctx, "finish_bets", func(conn net.Conn) (bool, error) {
+		span, err := c.request(conn, Frame{Type: MsgFinished, Payload: sent.Encode()})
+		if err != nil {
+			return false, err
+		}
+		var progress bool
+		stored, progress, err = c.readFinished(conn, span)
+		return progress, err
+	})
+	return stored, c.address(), err
+}
+
+// readFinished Reads the answer to the FINISHED sent as the request of
+// span. Returns the summary of the bets the server stored, nil if it did
+// not report one, and whether the server answered
+func (c *Client) readFinished(conn net.Conn, span *Span) (*Submission, bool, error) {
+	response, err := c.readResponse(conn, nil)
+	if err != nil {
+		span.Fail(err)
+		return nil, false, err
+	}
+	span.Finish(MessageName(response.Type))
+	if response.Type != MsgAck {
+		return nil, false, errors.Errorf("unexpected message type %q", response.Type)
+	}
+	if len(response.Payload) == 0 {
+		return nil, true, nil
+	}
+	submission, err := DecodeSubmission(response.Payload)
+	if err != nil {
+		return nil, true, &errServer{msg: fmt.Sprintf("invalid submission summary: %v", err)}
+	}
+	return &submission, true, nil
+}
+
+// waitResults Waits for the draw and returns the winners of the agency.
+// The server pushes them if it supports subscriptions, otherwise it is
+// polled every PollInterval
+func (c *Client) waitResults(ctx context.Context) (*DrawResult, error) {
+	if !c.session.Has(FeaturePushResults) {
+		log.Infof("action: subscribe_results | result: fail | client_id: %v | request_id: %v | server: %v | error: %v not agreed | fallback: polling",
+			c.config.ID,
+			c.helloRequest,
+			c.address(),
+			FeaturePushResults,
+		)
+		return c.pollResults(ctx)
+	}
+
+	result, err := c.subscribeResults(ctx)
+	if errors.Is(err, errUnsupported) {
+		log.Infof("action: subscribe_results | result: fail | client_id: %v | request_id: %v | server: %v | error: %v | fallback: polling",
+			c.config.ID,
+			c.lastRequest,
+			c.address(),
+			err,
+		)
+		return c.pollResults(ctx)
+	}
+	return result, err
+}
+
+// subscribeResults Keeps a connection open until the server pushes the
+// results. If the connection is lost the subscription is made again on
+// a new one, and the server sends the results right away if the draw
+// took place in the meantime
+func (c *Client) subscribeResults(ctx context.Context) (*DrawResult, error) {
+	var result *DrawResult
+	err := c.retry(ctx, "subscribe_results", func(conn net.Conn) (bool, error) {
+		span, err := c.request(conn, Frame{Type: MsgSubscribeResults, Payload: []byte(c.config.ID)})
+		if err != nil {
+			return false, err
+		}
+
+		// The wait can be long, so a server that died in the meantime
+		// must be detected with heartbeats
+		hb := startHeartbeat(conn, c.config.Heartbeat, c.config.ID, c.session.Flags(), c.tracer, c.status.setHeartbeatRTT)
+		defer hb.stop()
+
+		response, err := c.readResponse(conn, hb)
+		if err != nil {
+			span.Fail(err)
+			return false, err
+		}
+		span.Finish(MessageName(response.Type))
+		if response.Type != MsgAck {
+			return false, errors.Errorf("unexpected message type %q", response.Type)
+		}
+		log.Infof("action: subscribe_results | result: success | client_id: %v | request_id: %v | server: %v",
+			c.config.ID,
+			span.Request,
+			c.address(),
+		)
+
+		response, err = c.readResponse(conn, hb)
+		if err != nil {
+			return true, err
+		}
+		result, err = c.readDrawResult(conn, hb, response)
+		return true, err
+	})
+	return result, err
+}
+
+// pollResults Queries the server over a new connection every
+// PollInterval until the draw takes place
+func (c *Client) pollResults(ctx context.Context) (*DrawResult, error) {
+	for {
+		var result *DrawResult
+		err := c.retry(ctx, "query_winners", func(conn net.Conn) (bool, error) {
+			span, err := c.request(conn, Frame{Type: MsgQueryWinners, Payload: []byte(c.config.ID)})
+			if err != nil {
+				return false, err
+			}
+			response, err := c.readResponse(conn, nil)
+			if err != nil {
+				span.Fail(err)
+				return false, err
+			}
+			span.Finish(MessageName(response.Type))
+			if response.Type == MsgNotReady {
+				return true, nil
+			}
+			result, err = c.readDrawResult(conn, nil, response)
+			return err == nil, err
+		})
+		if err != nil || result != nil {
+			return result, err
+		}
+
+		log.Debugf("action: query_winners | result: in_progress | client_id: %v | request_id: %v", c.config.ID, c.lastRequest)
+		select {
+		case <-time.After(c.config.Results.PollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// request Sends f over conn as a new request of the session. The span
+// returned must be finished once the server answers
+func (c *Client) request(conn net.Conn, f Frame) (*Span, error) {
+	f.Flags = c.session.Flags()
+	f, span := c.tracer.request(f)
+	c.lastRequest = f.Request
+	if err := WriteFrame(conn, f); err != nil {
+		span.Fail(err)
+		return nil, err
+	}
+	return span, nil
+}
+
+// retry Opens a connection and runs attempt over it until it succeeds.
+// attempt reports whether it made progress before failing, which resets
+// the count of consecutive failures. Gives up after
+// Pipeline.MaxReconnects consecutive failures, or right away on errors
+// that retrying cannot fix
+func (c *Client) retry(ctx context.Context, operation string, attempt func(conn net.Conn) (bool, error)) error {
+	return c.retryOn(ctx, c, &c.lastRequest, operation, attempt)
+}
+
+// retryOn Runs attempt as retry does over connections to p. request is
+// the request ID of the last message attempt sent, reset before every
+// attempt and logged when it fails
+func (c *Client) retryOn(ctx context.Context, p peer, request *uint32, operation string, attempt func(conn net.Conn) (bool, error)) error {
+	failures := 0
+	for {
+		// Zero until the attempt makes a request
+		*request = 0
+		conn, err := p.connect(ctx)
+		if err == nil {
+			var progress bool
+			progress, err = runWithContext(ctx, conn, attempt)
+			if progress {
+				failures = 0
+				p.succeeded()
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// The server answered, so it is healthy even if retrying is useless
+		if isFatal(err) || errors.Is(err, errUnsupported) {
+			return err
+		}
+		if conn != nil {
+			p.failed()
+		}
+
+		failures++
+		if failures > c.config.Pipeline.MaxReconnects {
+			return err
+		}
+		c.metrics.AddReconnect()
+		log.Warningf("action: reconnect | result: in_progress | client_id: %v | request_id: %v | server: %v | operation: %v | attempt: %v | error: %v",
+			c.config.ID,
+			*request,
+			p.address(),
+			operation,
+			failures,
+			err,
+		)
+
+		select {
+		case <-time.After(c.config.LoopPeriod):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// runWithContext Runs attempt over conn, closing conn once it returns or
+// as soon as ctx is cancelled so blocking reads are interrupted
+func runWithContext(ctx context.Context, conn net.Conn, attempt func(conn net.Conn) (bool, error)) (bool, error) {
+	done := make(chan struct{})
+	watcherExited := make(chan struct{})
+	go func() {
+		defer close(watcherExited)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-watcherExited
+		conn.Close()
+	}()
+
+	return attempt(conn)
+}
+
+// readResponse Reads the next response of the server, handing the PONGs
+// found on the way to hb. Compressed payloads are decompressed and error
+// responses are returned as errors
+func (c *Client) readResponse(conn net.Conn, hb *heartbeat) (Frame, error) {
+	for {
+		frame, err := ReadFrame(conn)
+		if err != nil {
+			if hbErr := hb.err(); hbErr != nil {
+				// The read failed because the heartbeat closed the connection
+				return Frame{}, hbErr
+			}
+			return Frame{}, err
+		}
+		frame, err = DecompressFrame(frame, c.config.Compression.MaxDecompressedSize)
+		if err != nil {
+			return Frame{}, err
+		}
+
+		switch frame.Type {
+		case MsgPong:
+			hb.pong(frame.Seq)
+		case MsgError:
+			return Frame{}, &errServer{msg: string(frame.Payload)}
+		case MsgUnsupported:
+			return Frame{}, errUnsupported
+		default:
+			return frame, nil
+		}
+	}
+}
+
+// readDrawResult Reads the winners that follow the MsgDrawComplete frame
+// received as first
+func (c *Client) readDrawResult(conn net.Conn, hb *heartbeat, first Frame) (*DrawResult, error) {
+	if first.Type != MsgDrawComplete {
+		return nil, errors.Errorf("unexpected message type %q", first.Type)
+	}
+	winners, err := c.readResponse(conn, hb)
+	if err != nil {
+		return nil, err
+	}
+	if winners.Type != MsgWinners {
+		return nil, errors.Errorf("unexpected message type %q", winners.Type)
+	}
+
+	result := &DrawResult{WinningNumber: string(first.Payload)}
+	if len(winners.Payload) > 0 {
+		result.Winners = strings.Split(string(winners.Payload), ";")
+	}
+	return result, nil
+}
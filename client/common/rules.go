@@ -0,0 +1,423 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Types of validation rules
+const (
+	// RuleRange Every one of Fields is a number between Min and Max, both
+	// optional and inclusive
+	RuleRange = "range"
+	// RuleRegex Every one of Fields matches Pattern
+	RuleRegex = "regex"
+	// RuleDateWindow Every one of Fields is a date between From and To,
+	// both optional and inclusive
+	RuleDateWindow = "date_window"
+	// RuleAgeMin Every one of Fields is a birthdate at least Years ago
+	RuleAgeMin = "age_min"
+	// RuleUnique No two rows of a file have the same values in Fields
+	RuleUnique = "unique"
+	// RuleRequired Every one of Fields has a value other than blanks
+	RuleRequired = "required"
+)
+
+// Severities of validation rules
+const (
+	// SeverityReject The row is left out of the submission
+	SeverityReject = "reject"
+	// SeverityWarn The row is submitted and the violation reported
+	SeverityWarn = "warn"
+	// SeverityAbort Nothing of the file is submitted
+	SeverityAbort = "abort"
+)
+
+// maxSampleLines Lines kept in the report for every rule
+const maxSampleLines = 10
+
+// dateToday Value of From or To that stands for the current date
+const dateToday = "today"
+
+// ValidationConfig Configuration of the validation applied to every row
+// before the built-in checks
+type ValidationConfig struct {
+	Rules []*Rule
+	// Report Path the report of every file validated is written to as
+	// JSON, if not empty
+	Report string
+}
+
+// Rule Validation rule, as read from the rules file
+type Rule struct {
+	Name     string   `yaml:"name"`
+	Type     string   `yaml:"type"`
+	Severity string   `yaml:"severity"`
+	Field    string   `yaml:"field"`
+	Fields   []string `yaml:"fields"`
+	Min      *float64 `yaml:"min"`
+	Max      *float64 `yaml:"max"`
+	Pattern  string   `yaml:"pattern"`
+	// From First date allowed, as YYYY-MM-DD or today
+	From string `yaml:"from"`
+	// To Last date allowed, as YYYY-MM-DD or today
+	To    string `yaml:"to"`
+	Years int    `yaml:"years"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadRules Reads the rules of a YAML file with a list of rules under
+// the rules key, checking that every one of them can be applied
+func LoadRules(path string) ([]*Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Rules []*Rule `yaml:"rules"`
+	}
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, errors.Wrapf(err, "invalid rules file %v", path)
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range file.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%v_%v", rule.Type, i+1)
+		}
+		if names[rule.Name] {
+			return nil, errors.Errorf("rule %v defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if err := rule.compile(); err != nil {
+			return nil, errors.Wrapf(err, "rule %v", rule.Name)
+		}
+	}
+	return file.Rules, nil
+}
+
+// compile Checks the parameters of the rule and prepares them
+func (r *Rule) compile() error {
+	switch r.Severity {
+	case SeverityReject, SeverityWarn, SeverityAbort:
+	default:
+		return errors.Errorf("unknown severity %q, expected %v, %v or %v", r.Severity, SeverityReject, SeverityWarn, SeverityAbort)
+	}
+
+	if r.Field != "" {
+		r.Fields = append([]string{r.Field}, r.Fields...)
+	}
+	if len(r.Fields) == 0 {
+		return errors.New("no fields given")
+	}
+	for _, field := range r.Fields {
+		if !containsString(betFields, field) {
+			return errors.Errorf("unknown field %q, expected one of %v", field, strings.Join(betFields, ", "))
+		}
+	}
+
+	switch r.Type {
+	case RuleRange:
+		if r.Min == nil && r.Max == nil {
+			return errors.New("range without min nor max")
+		}
+	case RuleRegex:
+		pattern, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.pattern = pattern
+	case RuleDateWindow:
+		if r.From == "" && r.To == "" {
+			return errors.New("date window without from nor to")
+		}
+		for _, date := range []string{r.From, r.To} {
+			if _, err := parseRuleDate(date, time.Now()); date != "" && err != nil {
+				return err
+			}
+		}
+	case RuleAgeMin:
+		if r.Years <= 0 {
+			return errors.Errorf("invalid years %v", r.Years)
+		}
+	case RuleUnique, RuleRequired:
+	default:
+		return errors.Errorf("unknown type %q", r.Type)
+	}
+	return nil
+}
+
+// parseRuleDate Parses a date of a rule, resolving today against now
+func parseRuleDate(date string, now time.Time) (time.Time, error) {
+	if date == dateToday {
+		return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), nil
+	}
+	t, err := time.Parse(birthdateLayout, date)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid date %q, expected YYYY-MM-DD or %v", date, dateToday)
+	}
+	return t, nil
+}
+
+// field Value of the bet field with the given name
+func (b Bet) field(name string) string {
+	switch name {
+	case "first_name":
+		return b.FirstName
+	case "last_name":
+		return b.LastName
+	case "document":
+		return b.Document
+	case "birthdate":
+		return b.Birthdate
+	case "number":
+		return b.Number
+	}
+	return ""
+}
+
+// check Returns why the bet violates the rule, or an empty string if it
+// does not. seen holds the keys of the rows accepted before for unique
+// rules, along with their lines
+func (r *Rule) check(b Bet, now time.Time, seen map[string]int) string {
+	switch r.Type {
+	case RuleUnique:
+		if first, ok := seen[r.key(b)]; ok {
+			return fmt.Sprintf("%v repeated from line %v", strings.Join(r.Fields, "+"), first)
+		}
+	case RuleRequired:
+		for _, field := range r.Fields {
+			if strings.TrimSpace(b.field(field)) == "" {
+				return fmt.Sprintf("missing %v", field)
+			}
+		}
+	default:
+		for _, field := range r.Fields {
+			if reason := r.checkValue(field, b.field(field), now); reason != "" {
+				return reason
+			}
+		}
+	}
+	return ""
+}
+
+// checkValue Returns why the value of field violates a rule that applies
+// to every one of its fields on its own, or an empty string if it does not
+func (r *Rule) checkValue(field string, value string, now time.Time) string {
+	switch r.Type {
+	case RuleRange:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Sprintf("%v %q is not a number", field, value)
+		}
+		if (r.Min != nil && number < *r.Min) || (r.Max != nil && number > *r.Max) {
+			return fmt.Sprintf("%v %v out of range", field, value)
+		}
+	case RuleRegex:
+		if !r.pattern.MatchString(value) {
+			return fmt.Sprintf("%v %q does not match %v", field, value, r.Pattern)
+		}
+	case RuleDateWindow:
+		date, err := time.Parse(birthdateLayout, value)
+		if err != nil {
+			return fmt.Sprintf("%v %q is not a date", field, value)
+		}
+		if from, _ := parseRuleDate(r.From, now); r.From != "" && date.Before(from) {
+			return fmt.Sprintf("%v %v before %v", field, value, r.From)
+		}
+		if to, _ := parseRuleDate(r.To, now); r.To != "" && date.After(to) {
+			return fmt.Sprintf("%v %v after %v", field, value, r.To)
+		}
+	case RuleAgeMin:
+		birthdate, err := time.Parse(birthdateLayout, value)
+		if err != nil {
+			return fmt.Sprintf("%v %q is not a date", field, value)
+		}
+		if birthdate.AddDate(r.Years, 0, 0).After(now) {
+			return fmt.Sprintf("%v younger than %v years", field, r.Years)
+		}
+	}
+	return ""
+}
+
+// key Values of the fields of a unique rule in the bet
+func (r *Rule) key(b Bet) string {
+	values := make([]string, 0, len(r.Fields))
+	for _, field := range r.Fields {
+		values = append(values, b.field(field))
+	}
+	return strings.Join(values, betFieldSeparator)
+}
+
+// RuleStats Violations of a rule found in a file
+type RuleStats struct {
+	Type       string `json:"type"`
+	Severity   string `json:"severity"`
+	Violations int    `json:"violations"`
+	// Lines First lines that violated the rule
+	Lines []int `json:"lines"`
+}
+
+// ValidationReport Outcome of validating the rows of a bets file
+type ValidationReport struct {
+	File     string                `json:"file"`
+	Rows     int                   `json:"rows"`
+	Invalid  int                   `json:"invalid"`
+	Accepted int                   `json:"accepted"`
+	Rejected int                   `json:"rejected"`
+	Warnings int                   `json:"warnings"`
+	Aborted  bool                  `json:"aborted"`
+	Rules    map[string]*RuleStats `json:"rules"`
+}
+
+// ErrAborted Returned when a rule with SeverityAbort is violated
+type ErrAborted struct {
+	Rule   string
+	Line   int
+	Reason string
+}
+
+func (e *ErrAborted) Error() string {
+	return fmt.Sprintf("rule %v aborted the file at line %v: %v", e.Rule, e.Line, e.Reason)
+}
+
+// validator Applies the rules to the rows of a file in order
+type validator struct {
+	rules  []*Rule
+	now    time.Time
+	seen   map[string]map[string]int
+	report *ValidationReport
+}
+
+func newValidator(path string, rules []*Rule) *validator {
+	v := &validator{
+		rules:  rules,
+		now:    time.Now(),
+		seen:   make(map[string]map[string]int),
+		report: &ValidationReport{File: path, Rules: make(map[string]*RuleStats)},
+	}
+	for _, rule := range rules {
+		v.report.Rules[rule.Name] = &RuleStats{Type: rule.Type, Severity: rule.Severity, Lines: []int{}}
+		if rule.Type == RuleUnique {
+			v.seen[rule.Name] = make(map[string]int)
+		}
+	}
+	return v
+}
+
+// check Applies every rule to the bet. Returns whether the bet must be
+// submitted, or an *ErrAborted if the file must not be
+func (v *validator) check(b Bet, line int) (bool, error) {
+	accepted := true
+	warned := false
+	for _, rule := range v.rules {
+		reason := rule.check(b, v.now, v.seen[rule.Name])
+		if reason == "" {
+			continue
+		}
+
+		stats := v.report.Rules[rule.Name]
+		stats.Violations++
+		if len(stats.Lines) < maxSampleLines {
+			stats.Lines = append(stats.Lines, line)
+		}
+		log.Debugf("action: validate_bet | result: fail | file: %v | line: %v | rule: %v | severity: %v | reason: %v",
+			v.report.File,
+			line,
+			rule.Name,
+			rule.Severity,
+			reason,
+		)
+
+		switch rule.Severity {
+		case SeverityAbort:
+			v.report.Aborted = true
+			return false, &ErrAborted{Rule: rule.Name, Line: line, Reason: reason}
+		case SeverityReject:
+			accepted = false
+		case SeverityWarn:
+			warned = true
+		}
+	}
+
+	if warned {
+		v.report.Warnings++
+	}
+	if !accepted {
+		v.report.Rejected++
+		return false, nil
+	}
+
+	// Only the rows submitted count as the first of their key, so a
+	// rejected row does not make the next one with its key a repetition
+	for _, rule := range v.rules {
+		if seen, ok := v.seen[rule.Name]; ok {
+			if key := rule.key(b); seen[key] == 0 {
+				seen[key] = line
+			}
+		}
+	}
+	return true, nil
+}
+
+// WriteJSON Writes the report as indented JSON
+func (r *ValidationReport) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// logValidation Logs the outcome of the validation of a file and the
+// violations of every rule
+func logValidation(clientID string, report *ValidationReport) {
+	if report == nil || len(report.Rules) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(report.Rules))
+	for name := range report.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := report.Rules[name]
+		if stats.Violations == 0 {
+			continue
+		}
+		log.Warningf("action: validation_rule | result: fail | client_id: %v | file: %v | rule: %v | severity: %v | violations: %v | lines: %v",
+			clientID,
+			report.File,
+			name,
+			stats.Severity,
+			stats.Violations,
+			stats.Lines,
+		)
+	}
+
+	result := "success"
+	if report.Aborted {
+		result = "fail"
+	}
+	log.Infof("action: validate_bets | result: %v | client_id: %v | file: %v | rows: %v | accepted: %v | rejected: %v | warnings: %v",
+		result,
+		clientID,
+		report.File,
+		report.Rows,
+		report.Accepted,
+		report.Rejected,
+		report.Warnings,
+	)
+}
@@ -0,0 +1,144 @@
+package common_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// writeFile Writes content to a file named name in a temporary directory.
+// Returns its path
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// validate Sends the bets of content with the rules of the YAML file
+// rules. Returns the documents the server stored and the validation report
+func validate(t *testing.T, rules string, content string) ([]string, *common.ValidationReport) {
+	t.Helper()
+	address, server := startServer(t, testserver.DefaultConfig())
+	loaded, err := common.LoadRules(writeFile(t, "rules.yaml", rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := testConfig(address, writeFile(t, "agency-1.csv", content))
+	config.Validation = common.ValidationConfig{Rules: loaded, Report: filepath.Join(t.TempDir(), "report.json")}
+	summary := common.NewClient(config, nil).StartClientLoop(context.Background())
+	if summary.Status == common.SessionFailed {
+		t.Fatalf("session failed: %v", summary.Error)
+	}
+
+	data, err := os.ReadFile(config.Validation.Report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report common.ValidationReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	documents := []string{}
+	for _, b := range server.Bets(testAgency) {
+		documents = append(documents, b.Document)
+	}
+	return documents, &report
+}
+
+// TestRulesEveryField A rule with several fields is violated by a row if
+// any of them violates it
+func TestRulesEveryField(t *testing.T) {
+	rules := `
+rules:
+  - name: capitalized
+    type: regex
+    severity: reject
+    fields: [first_name, last_name]
+    pattern: "^[A-Z][a-z]+$"
+  - name: positive
+    type: range
+    severity: reject
+    field: document
+    fields: [number]
+    min: 1
+`
+	content := "Ana,Perez,30000001,1990-01-02,1001\n" +
+		"Eva,perez,30000002,1990-01-02,1002\n" +
+		"eva,Perez,30000003,1990-01-02,1003\n" +
+		"Ana,Perez,30000004,1990-01-02,0\n"
+	documents, report := validate(t, rules, content)
+	if !reflect.DeepEqual(documents, []string{"30000001"}) {
+		t.Fatalf("server stored the bets of %v, expected only the first row", documents)
+	}
+	if lines := report.Rules["capitalized"].Lines; !reflect.DeepEqual(lines, []int{2, 3}) {
+		t.Fatalf("capitalized violated at lines %v, expected 2 and 3", lines)
+	}
+	if lines := report.Rules["positive"].Lines; !reflect.DeepEqual(lines, []int{4}) {
+		t.Fatalf("positive violated at lines %v, expected 4", lines)
+	}
+	if report.Rows != 4 || report.Accepted != 1 || report.Rejected != 3 {
+		t.Fatalf("report counts %v rows, %v accepted and %v rejected, expected 4, 1 and 3", report.Rows, report.Accepted, report.Rejected)
+	}
+}
+
+// TestRulesUniqueAcceptedRows A row rejected by a rule does not make the
+// next row with the same key a repetition
+func TestRulesUniqueAcceptedRows(t *testing.T) {
+	rules := `
+rules:
+  - name: unique_document
+    type: unique
+    severity: reject
+    field: document
+  - name: capitalized
+    type: regex
+    severity: reject
+    field: first_name
+    pattern: "^[A-Z][a-z]+$"
+`
+	content := "ana,Perez,30000001,1990-01-02,1001\n" +
+		"Ana,Perez,30000001,1990-01-02,1002\n" +
+		"Eva,Perez,30000001,1990-01-02,1003\n"
+	documents, report := validate(t, rules, content)
+	if !reflect.DeepEqual(documents, []string{"30000001"}) {
+		t.Fatalf("server stored the bets of %v, expected a single one", documents)
+	}
+	if lines := report.Rules["unique_document"].Lines; !reflect.DeepEqual(lines, []int{3}) {
+		t.Fatalf("unique_document violated at lines %v, expected 3 as the repetition of the accepted line 2", lines)
+	}
+}
+
+// TestLoadRulesInvalid Rules files that cannot be applied are rejected
+// when loaded
+func TestLoadRulesInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":        "rules:\n  - type: required\n    severity: reject\n    field: document\n    colour: red\n",
+		"unknown type":       "rules:\n  - type: luhn\n    severity: reject\n    field: document\n",
+		"unknown severity":   "rules:\n  - type: required\n    severity: ignore\n    field: document\n",
+		"unknown field":      "rules:\n  - type: required\n    severity: reject\n    field: email\n",
+		"no fields":          "rules:\n  - type: required\n    severity: reject\n",
+		"invalid pattern":    "rules:\n  - type: regex\n    severity: reject\n    field: document\n    pattern: \"[0-9\"\n",
+		"range without ends": "rules:\n  - type: range\n    severity: reject\n    field: number\n",
+		"invalid date":       "rules:\n  - type: date_window\n    severity: reject\n    field: birthdate\n    from: 01/02/1990\n",
+		"invalid years":      "rules:\n  - type: age_min\n    severity: reject\n    field: birthdate\n    years: 0\n",
+		"repeated name":      "rules:\n  - name: a\n    type: required\n    severity: reject\n    field: document\n  - name: a\n    type: required\n    severity: warn\n    field: number\n",
+		"not yaml":           "rules: [\n",
+	}
+	for name, rules := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := common.LoadRules(writeFile(t, "rules.yaml", rules)); err == nil {
+				t.Fatal("rules loaded, expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// ShardRing Consistent hashing ring that maps each agency to one of the
+// shards. Every shard is placed in the ring several times (virtual nodes)
+// so agencies spread evenly and adding a shard only moves the agencies
+// that land on its points
+type ShardRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard string
+}
+
+// NewShardRing Builds the ring placing vnodes points for every shard
+func NewShardRing(shards []string, vnodes int) *ShardRing {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+
+	ring := &ShardRing{}
+	for _, shard := range shards {
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, ringPoint{
+				hash:  ringHash(shard + "#" + strconv.Itoa(i)),
+				shard: shard,
+			})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		if ring.points[i].hash == ring.points[j].hash {
+			return ring.points[i].shard < ring.points[j].shard
+		}
+		return ring.points[i].hash < ring.points[j].hash
+	})
+	return ring
+}
+
+// ShardOf Returns the shard that stores the bets of the agency: the first
+// point of the ring found clockwise from the hash of the agency. If the
+// ring has no shards an empty string is returned
+func (r *ShardRing) ShardOf(agency string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := ringHash(agency)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// ringHash Position of a key in the ring. A cryptographic hash is used
+// since agency ids are short and similar, which clusters them together
+// with simpler hashes
+func ringHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
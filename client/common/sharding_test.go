@@ -0,0 +1,62 @@
+package common_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// TestShardRingStable The shard of an agency depends only on the shards of
+// the ring, not on their order nor on the process that built it, so every
+// client of a deployment agrees on it
+func TestShardRingStable(t *testing.T) {
+	shards := []string{"server1:12345", "server2:12345", "server3:12345"}
+	// Computed once; a change here moves the bets of deployed agencies
+	expected := map[string]string{
+		"1":   "server1:12345",
+		"2":   "server3:12345",
+		"3":   "server3:12345",
+		"4":   "server1:12345",
+		"5":   "server2:12345",
+		"17":  "server2:12345",
+		"250": "server3:12345",
+	}
+	ring := common.NewShardRing(shards, 100)
+	reversed := common.NewShardRing([]string{shards[2], shards[1], shards[0]}, 100)
+	for agency, shard := range expected {
+		if got := ring.ShardOf(agency); got != shard {
+			t.Fatalf("agency %v mapped to %v, expected %v", agency, got, shard)
+		}
+		if got := reversed.ShardOf(agency); got != shard {
+			t.Fatalf("agency %v mapped to %v with the shards reversed, expected %v", agency, got, shard)
+		}
+	}
+}
+
+// TestShardRingAddShard Adding a shard to a ring of N moves about 1/(N+1)
+// of the agencies, all of them to the new shard
+func TestShardRingAddShard(t *testing.T) {
+	const agencies = 10000
+	shards := []string{"server1:12345", "server2:12345", "server3:12345", "server4:12345"}
+	before := common.NewShardRing(shards, 100)
+	after := common.NewShardRing(append(shards, "server5:12345"), 100)
+
+	moved := 0
+	for i := 1; i <= agencies; i++ {
+		agency := strconv.Itoa(i)
+		from, to := before.ShardOf(agency), after.ShardOf(agency)
+		if from == to {
+			continue
+		}
+		if to != "server5:12345" {
+			t.Fatalf("agency %v moved from %v to %v, expected only moves to the new shard", agency, from, to)
+		}
+		moved++
+	}
+
+	// 1/5 of the agencies, with room for the unevenness of 100 vnodes
+	if share := float64(moved) / agencies; share < 0.12 || share > 0.28 {
+		t.Fatalf("%.1f%% of the agencies moved, expected about 20%%", share*100)
+	}
+}
@@ -0,0 +1,362 @@
+package common
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Formats of the bets files
+const (
+	// FormatAuto Picks the format from the extension of every file, see
+	// FormatOf
+	FormatAuto = "auto"
+	// FormatCSV One bet per row, with the fields separated by commas
+	FormatCSV = "csv"
+	// FormatJSONL One bet per line as a JSON object
+	FormatJSONL = "jsonl"
+	// FormatFixedWidth One bet per line, every field at a fixed range of
+	// characters
+	FormatFixedWidth = "fixed-width"
+)
+
+// Fields of a bet, in the order of the columns of the default CSV layout.
+// They name the fields in column mappings and JSON objects
+var betFields = []string{"first_name", "last_name", "document", "birthdate", "number"}
+
+// InputConfig Configuration of how the bets files are read
+type InputConfig struct {
+	// Format Format of the files, see FormatAuto
+	Format string
+	// Encoding Encoding of the files, see EncodingAuto
+	Encoding string
+	// Columns Where every field of a bet is read from, as <field>=<column>
+	// pairs. Columns are header names or 1-based positions for CSV files,
+	// keys for JSON Lines files, and 1-based inclusive ranges of
+	// characters such as 1-20 for fixed-width files. Empty means the
+	// default layout of each format, which fixed-width files lack
+	Columns []string
+	// Header Whether CSV files start with a header row. It is implied if
+	// the columns are header names
+	Header bool
+}
+
+// Validate Returns an error if the configuration cannot be used
+func (c InputConfig) Validate() error {
+	switch c.Format {
+	case FormatAuto, FormatCSV, FormatJSONL, FormatFixedWidth:
+	default:
+		return errors.Errorf("unknown format %q, expected %v, %v, %v or %v", c.Format, FormatAuto, FormatCSV, FormatJSONL, FormatFixedWidth)
+	}
+	if err := ValidateEncoding(c.Encoding); err != nil {
+		return err
+	}
+	if _, err := parseColumns(c.Columns); err != nil {
+		return err
+	}
+	if c.Format == FormatFixedWidth && len(c.Columns) == 0 {
+		return errors.New("fixed-width files need the columns of every field")
+	}
+	return nil
+}
+
+// FormatOf Returns the format of the file at path, which is format unless
+// it is FormatAuto. Then .jsonl and .ndjson files are JSON Lines, .dat
+// and .fw files are fixed-width and any other file is CSV
+func FormatOf(path string, format string) string {
+	if format != FormatAuto {
+		return format
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson":
+		return FormatJSONL
+	case ".dat", ".fw":
+		return FormatFixedWidth
+	}
+	return FormatCSV
+}
+
+// BetSource Reads the bets of a file one row at a time. The bets are
+// returned as read, without an agency, normalization or validation
+type BetSource interface {
+	// Next Returns the bet in the next row along with its line, or io.EOF
+	// once every row was read. Rows that cannot be parsed are returned as
+	// a RowError, after which the reading can go on
+	Next() (Bet, int, error)
+}
+
+// NewBetSource Returns a source reading bets in the given format from r,
+// which must hold UTF-8 text
+func NewBetSource(r io.Reader, format string, config InputConfig) (BetSource, error) {
+	columns, err := parseColumns(config.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case FormatCSV:
+		return newCSVSource(r, columns, config.Header)
+	case FormatJSONL:
+		return newJSONLSource(r, columns), nil
+	case FormatFixedWidth:
+		return newFixedWidthSource(r, columns)
+	}
+	return nil, errors.Errorf("unknown format %q", format)
+}
+
+// parseColumns Parses <field>=<column> pairs into a map from field to
+// column. Either every field is mapped or none
+func parseColumns(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+
+	columns := make(map[string]string)
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.Errorf("invalid column mapping %q, expected <field>=<column>", pair)
+		}
+		if !containsString(betFields, kv[0]) {
+			return nil, errors.Errorf("unknown field %q in column mapping, expected one of %v", kv[0], strings.Join(betFields, ", "))
+		}
+		columns[kv[0]] = kv[1]
+	}
+	for _, field := range betFields {
+		if _, ok := columns[field]; !ok {
+			return nil, errors.Errorf("missing column of field %v", field)
+		}
+	}
+	return columns, nil
+}
+
+// betFromFields Builds a bet from its fields, indexed by name
+func betFromFields(values map[string]string) Bet {
+	return Bet{
+		FirstName: values["first_name"],
+		LastName:  values["last_name"],
+		Document:  values["document"],
+		Birthdate: values["birthdate"],
+		Number:    values["number"],
+	}
+}
+
+// csvSource Reads CSV files. Fields are found by position, or by header
+// name if the columns name them
+type csvSource struct {
+	reader *csv.Reader
+	// indexes 0-based index of the column of every field
+	indexes map[string]int
+}
+
+func newCSVSource(r io.Reader, columns map[string]string, header bool) (*csvSource, error) {
+	s := &csvSource{reader: csv.NewReader(r), indexes: make(map[string]int)}
+	// Every row must have as many fields as the first one
+	s.reader.FieldsPerRecord = 0
+
+	if columns == nil {
+		s.reader.FieldsPerRecord = len(betFields)
+		for i, field := range betFields {
+			s.indexes[field] = i
+		}
+	}
+
+	named := false
+	for field, column := range columns {
+		position, err := strconv.Atoi(column)
+		if err != nil {
+			named = true
+			continue
+		}
+		if position < 1 {
+			return nil, errors.Errorf("invalid position %v of field %v", position, field)
+		}
+		s.indexes[field] = position - 1
+	}
+	if !header && !named {
+		return s, nil
+	}
+
+	names, err := s.reader.Read()
+	if err == io.EOF {
+		return s, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid header")
+	}
+	for field, column := range columns {
+		if _, ok := s.indexes[field]; ok {
+			continue
+		}
+		index := -1
+		for i, name := range names {
+			if strings.TrimSpace(name) == column {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil, errors.Errorf("column %q of field %v not found in the header", column, field)
+		}
+		s.indexes[field] = index
+	}
+	return s, nil
+}
+
+func (s *csvSource) Next() (Bet, int, error) {
+	record, err := s.reader.Read()
+	if err == io.EOF {
+		return Bet{}, 0, io.EOF
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+		return Bet{}, parseErr.StartLine, RowError{Line: parseErr.StartLine, Err: parseErr.Err}
+	}
+	if err != nil {
+		return Bet{}, 0, err
+	}
+
+	line, _ := s.reader.FieldPos(0)
+	values := make(map[string]string)
+	for _, field := range betFields {
+		index := s.indexes[field]
+		if index >= len(record) {
+			return Bet{}, line, RowError{Line: line, Err: errors.Errorf("missing column %v of field %v", index+1, field)}
+		}
+		values[field] = record[index]
+	}
+	return betFromFields(values), line, nil
+}
+
+// jsonlSource Reads JSON Lines files. Every field is read from the key
+// mapped to it, or from the key named as the field by default. Numbers
+// are accepted for any field
+type jsonlSource struct {
+	scanner *bufio.Scanner
+	line    int
+	keys    map[string]string
+}
+
+func newJSONLSource(r io.Reader, columns map[string]string) *jsonlSource {
+	s := &jsonlSource{scanner: bufio.NewScanner(r), keys: columns}
+	s.scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if s.keys == nil {
+		s.keys = make(map[string]string)
+		for _, field := range betFields {
+			s.keys[field] = field
+		}
+	}
+	return s
+}
+
+func (s *jsonlSource) Next() (Bet, int, error) {
+	for s.scanner.Scan() {
+		s.line++
+		text := strings.TrimSpace(s.scanner.Text())
+		if text == "" {
+			continue
+		}
+		// The decoder would replace invalid UTF-8 without failing
+		if !utf8.ValidString(text) {
+			return Bet{}, s.line, RowError{Line: s.line, Err: errors.Errorf("invalid UTF-8 in %q", strings.ToValidUTF8(text, "�"))}
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		var object map[string]interface{}
+		if err := decoder.Decode(&object); err != nil {
+			return Bet{}, s.line, RowError{Line: s.line, Err: errors.Wrapf(err, "invalid JSON")}
+		}
+
+		values := make(map[string]string)
+		for field, key := range s.keys {
+			switch value := object[key].(type) {
+			case nil:
+			case string:
+				values[field] = value
+			case json.Number:
+				values[field] = value.String()
+			default:
+				return Bet{}, s.line, RowError{Line: s.line, Err: errors.Errorf("%v must be a string or a number", key)}
+			}
+		}
+		return betFromFields(values), s.line, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return Bet{}, 0, err
+	}
+	return Bet{}, 0, io.EOF
+}
+
+// fixedWidthSource Reads fixed-width files. Every field is read from its
+// range of characters, without the padding around it
+type fixedWidthSource struct {
+	scanner *bufio.Scanner
+	line    int
+	// ranges 0-based start and exclusive end of every field
+	ranges map[string][2]int
+}
+
+func newFixedWidthSource(r io.Reader, columns map[string]string) (*fixedWidthSource, error) {
+	if columns == nil {
+		return nil, errors.New("fixed-width files need the columns of every field")
+	}
+
+	s := &fixedWidthSource{scanner: bufio.NewScanner(r), ranges: make(map[string][2]int)}
+	for field, column := range columns {
+		bounds := strings.SplitN(column, "-", 2)
+		if len(bounds) != 2 {
+			return nil, errors.Errorf("invalid range %q of field %v, expected <first>-<last>", column, field)
+		}
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, errors.Errorf("invalid range %q of field %v", column, field)
+		}
+		last, err := strconv.Atoi(bounds[1])
+		if err != nil || first < 1 || last < first {
+			return nil, errors.Errorf("invalid range %q of field %v", column, field)
+		}
+		s.ranges[field] = [2]int{first - 1, last}
+	}
+	return s, nil
+}
+
+func (s *fixedWidthSource) Next() (Bet, int, error) {
+	for s.scanner.Scan() {
+		s.line++
+		text := strings.TrimRight(s.scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		// Ranges are counted in characters, which invalid UTF-8 has not
+		if !utf8.ValidString(text) {
+			return Bet{}, s.line, RowError{Line: s.line, Err: errors.Errorf("invalid UTF-8 in %q", strings.ToValidUTF8(text, "�"))}
+		}
+		record := []rune(text)
+
+		values := make(map[string]string)
+		for _, field := range betFields {
+			r := s.ranges[field]
+			if r[0] >= len(record) {
+				return Bet{}, s.line, RowError{Line: s.line, Err: errors.Errorf("line too short for field %v", field)}
+			}
+			end := r[1]
+			if end > len(record) {
+				end = len(record)
+			}
+			values[field] = strings.TrimSpace(string(record[r[0]:end]))
+		}
+		return betFromFields(values), s.line, nil
+	}
+	if err := s.scanner.Err(); err != nil {
+		return Bet{}, 0, err
+	}
+	return Bet{}, 0, io.EOF
+}
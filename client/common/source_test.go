@@ -0,0 +1,65 @@
+package common_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// TestBetSourceInvalidUTF8 Rows of JSON Lines and fixed-width files with
+// invalid UTF-8 are reported as row errors instead of being read with
+// the bytes replaced, and the rows after them are still read
+func TestBetSourceInvalidUTF8(t *testing.T) {
+	tests := []struct {
+		format  string
+		columns []string
+		rows    []string
+	}{
+		{
+			format: common.FormatJSONL,
+			rows: []string{
+				`{"first_name":"Ana","last_name":"Perez","document":"30000001","birthdate":"1990-01-02","number":"1001"}`,
+				"{\"first_name\":\"Mu\xf1oz\",\"last_name\":\"Perez\",\"document\":\"30000002\",\"birthdate\":\"1990-01-02\",\"number\":\"1002\"}",
+				`{"first_name":"Eva","last_name":"Perez","document":"30000003","birthdate":"1990-01-02","number":"1003"}`,
+			},
+		},
+		{
+			format:  common.FormatFixedWidth,
+			columns: []string{"first_name=1-10", "last_name=11-20", "document=21-28", "birthdate=29-38", "number=39-42"},
+			rows: []string{
+				"Ana       Perez     300000011990-01-021001",
+				"Mu\xf1oz     Perez     300000021990-01-021002",
+				"Eva       Perez     300000031990-01-021003",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			r := strings.NewReader(strings.Join(test.rows, "\n") + "\n")
+			source, err := common.NewBetSource(r, test.format, common.InputConfig{Columns: test.columns})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, expected := range []string{"30000001", "", "30000003"} {
+				bet, line, err := source.Next()
+				if expected != "" {
+					if err != nil || bet.Document != expected {
+						t.Fatalf("line %v read as %+v, %v, expected the bet of document %v", line, bet, err, expected)
+					}
+					continue
+				}
+				var rowErr common.RowError
+				if !errors.As(err, &rowErr) || rowErr.Line != 2 || !strings.Contains(err.Error(), "invalid UTF-8") {
+					t.Fatalf("line %v read as %+v, %v, expected invalid UTF-8 in line 2", line, bet, err)
+				}
+			}
+			if _, _, err := source.Next(); err != io.EOF {
+				t.Fatalf("read %v after the last row, expected %v", err, io.EOF)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// Status Snapshot of the current state of the client
+type Status struct {
+	// Server Address of the server the client is connected to, empty
+	// if it never connected
+	Server string
+	// ServerIP Address the server name resolved to on the last connection
+	ServerIP string
+	// HeartbeatRTT Round trip time of the last heartbeat answered
+	HeartbeatRTT time.Duration
+}
+
+// statusTracker Keeps the status up to date while the client runs
+type statusTracker struct {
+	mu     sync.Mutex
+	status Status
+}
+
+func (t *statusTracker) setServer(address string, ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.Server = address
+	t.status.ServerIP = ip
+}
+
+func (t *statusTracker) setHeartbeatRTT(rtt time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.HeartbeatRTT = rtt
+}
+
+func (t *statusTracker) snapshot() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// Log Prints the status in a single line
+func (s Status) Log(clientID string) {
+	log.Infof("action: status | result: success | client_id: %v | server: %v | server_ip: %v | heartbeat_rtt: %v",
+		clientID,
+		s.Server,
+		s.ServerIP,
+		s.HeartbeatRTT,
+	)
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Final statuses of a session
+const (
+	// SessionSuccess Every bet read was stored and verified, and the
+	// winners were received if the client waited for them
+	SessionSuccess = "success"
+	// SessionPartial Some bets were stored, but others were left out or
+	// something could not be completed or verified
+	SessionPartial = "partial"
+	// SessionFailed Nothing was stored
+	SessionFailed = "failed"
+)
+
+// Exit codes of the process for every final status
+const (
+	ExitSuccess = 0
+	ExitFailed  = 1
+	ExitPartial = 3
+)
+
+// SessionSummary Outcome of a run of the client
+type SessionSummary struct {
+	Agency    string    `json:"agency"`
+	SessionID SessionID `json:"session_id"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	// BetsRead Rows read from the bets file
+	BetsRead int64 `json:"bets_read"`
+	// BetsRejected Rows left out, either invalid, rejected by a validation
+	// rule or dropped as duplicates of earlier rows of the file
+	BetsRejected int64 `json:"bets_rejected"`
+	// BetsSent Bets written in batches, counting every batch once however
+	// many replicas or connections it was written to
+	BetsSent int64 `json:"bets_sent"`
+	// BetsAcked Bets acknowledged, or committed by the write quorum of the
+	// replicas
+	BetsAcked int64 `json:"bets_acked"`
+	// Batches Batches acknowledged, or committed by the write quorum
+	Batches int64 `json:"batches"`
+	// Retries Batches written again after a reconnect or a BUSY answer
+	Retries    int64          `json:"retries"`
+	Reconnects int64          `json:"reconnects"`
+	BytesIn    int64          `json:"bytes_in"`
+	BytesOut   int64          `json:"bytes_out"`
+	AckLatency LatencySummary `json:"ack_latency"`
+	// Winners Winners announced for the agency, nil if not received
+	Winners *int   `json:"winners"`
+	Status  string `json:"status"`
+	// Error Why the session did not succeed
+	Error string `json:"error,omitempty"`
+}
+
+// summarize Builds the summary of the session started at start from the
+// metrics collected
+func (c *Client) summarize(start time.Time, status string, reason string, winners *int) *SessionSummary {
+	read, invalid := c.metrics.Read()
+	rejected, _, _ := c.metrics.Validation()
+	acked, batches := c.metrics.Acked()
+	in, out := c.metrics.Bytes()
+	return &SessionSummary{
+		Agency:       c.config.ID,
+		SessionID:    c.SessionID(),
+		Start:        start,
+		End:          time.Now(),
+		BetsRead:     read,
+		BetsRejected: invalid + rejected + c.metrics.Dropped(),
+		BetsSent:     c.metrics.Sent(),
+		BetsAcked:    acked,
+		Batches:      batches,
+		Retries:      c.metrics.Retries(),
+		Reconnects:   c.metrics.Reconnects(),
+		BytesIn:      in,
+		BytesOut:     out,
+		AckLatency:   c.metrics.AckLatency(),
+		Winners:      winners,
+		Status:       status,
+		Error:        reason,
+	}
+}
+
+// ExitCode Exit code of the process for the final status of the session
+func (s *SessionSummary) ExitCode() int {
+	switch s.Status {
+	case SessionSuccess:
+		return ExitSuccess
+	case SessionPartial:
+		return ExitPartial
+	}
+	return ExitFailed
+}
+
+// JSON Returns the summary as a single line of JSON
+func (s *SessionSummary) JSON() []byte {
+	data, _ := json.Marshal(s)
+	return data
+}
+
+// WriteJSON Writes the summary as indented JSON
+func (s *SessionSummary) WriteJSON(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
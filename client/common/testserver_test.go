@@ -0,0 +1,221 @@
+package common_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// testAgency Agency of the clients of the tests
+const testAgency = "1"
+
+func TestMain(m *testing.M) {
+	logging.SetLevel(logging.ERROR, "log")
+	os.Exit(m.Run())
+}
+
+// startServer Serves the test server on a random local port until the
+// test ends. Returns its address
+func startServer(t *testing.T, config testserver.Config) (string, *testserver.Server) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := testserver.New(config)
+	go server.Serve(listener)
+	return listener.Addr().String(), server
+}
+
+// writeBetsFile Writes a CSV file with n bets of distinct documents.
+// Returns its path
+func writeBetsFile(t *testing.T, n int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "Nombre%v,Apellido%v,%v,1990-01-02,%v\n", i, i, 30000000+i, 1000+i)
+	}
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testConfig Configuration of a client that sends the bets of betsFile to
+// the server at address without waiting for the draw
+func testConfig(address string, betsFile string) common.ClientConfig {
+	return common.ClientConfig{
+		ID:            testAgency,
+		ServerAddress: address,
+		Failover: common.FailoverConfig{
+			Selection:      common.SelectionPriority,
+			MaxFailures:    3,
+			Cooldown:       time.Second,
+			ConnectTimeout: time.Second,
+		},
+		LoopPeriod: 10 * time.Millisecond,
+		BetsFile:   betsFile,
+		Input:      common.InputConfig{Format: common.FormatAuto, Encoding: common.EncodingAuto},
+		Dedup:      common.DedupConfig{Policy: common.DuplicatesOff},
+		Batch:      common.BatchConfig{MaxAmount: 10, MinAmount: 1},
+		Pipeline:   common.PipelineConfig{Window: 1, MaxReconnects: 3},
+		Compression: common.CompressionConfig{
+			MaxDecompressedSize: 64 * 1024,
+		},
+	}
+}
+
+// assertStored Fails the test unless the server stored every bet of a
+// file written by writeBetsFile with n bets
+func assertStored(t *testing.T, server *testserver.Server, n int) {
+	t.Helper()
+	documents := make(map[string]bool)
+	for _, b := range server.Bets(testAgency) {
+		documents[b.Document] = true
+	}
+	for i := 0; i < n; i++ {
+		if document := fmt.Sprint(30000000 + i); !documents[document] {
+			t.Fatalf("bet of document %v was not stored", document)
+		}
+	}
+}
+
+// frameEvent Frame written or read by the client on a connection
+type frameEvent struct {
+	conn    int
+	address string
+	sent    bool
+	frame   common.Frame
+}
+
+// recordingDialer Dialer that records every frame the client writes and
+// reads, numbering the connections from 1
+type recordingDialer struct {
+	dialer common.Dialer
+	// cut Closes a connection right after the client wrote a frame on it
+	// if it returns true
+	cut func(e frameEvent) bool
+
+	mu     sync.Mutex
+	conns  int
+	events []frameEvent
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns++
+	return &recordingConn{Conn: conn, dialer: d, id: d.conns, address: address}, nil
+}
+
+// connsTo Returns the connections opened to address, in order
+func (d *recordingDialer) connsTo(address string) []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var conns []int
+	for _, e := range d.events {
+		if e.address == address && (len(conns) == 0 || conns[len(conns)-1] != e.conn) {
+			conns = append(conns, e.conn)
+		}
+	}
+	return conns
+}
+
+// frames Returns the frames of conn of the given type, sent or read
+func (d *recordingDialer) frames(conn int, sent bool, frameType byte) []common.Frame {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var frames []common.Frame
+	for _, e := range d.events {
+		if e.conn == conn && e.sent == sent && e.frame.Type == frameType {
+			frames = append(frames, e.frame)
+		}
+	}
+	return frames
+}
+
+// snapshot Returns every frame recorded so far, in the order the client
+// wrote or read them
+func (d *recordingDialer) snapshot() []frameEvent {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]frameEvent(nil), d.events...)
+}
+
+// recordingConn Connection whose frames are recorded by its dialer
+type recordingConn struct {
+	net.Conn
+	dialer  *recordingDialer
+	id      int
+	address string
+	written []byte
+	read    []byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if events := c.record(&c.written, b[:n], true); c.dialer.cut != nil {
+		for _, e := range events {
+			if c.dialer.cut(e) {
+				c.Conn.Close()
+			}
+		}
+	}
+	return n, err
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.record(&c.read, b[:n], false)
+	return n, err
+}
+
+// record Appends data to buf and records every whole frame in it
+func (c *recordingConn) record(buf *[]byte, data []byte, sent bool) []frameEvent {
+	c.dialer.mu.Lock()
+	defer c.dialer.mu.Unlock()
+	*buf = append(*buf, data...)
+	var events []frameEvent
+	for {
+		r := bytes.NewReader(*buf)
+		f, err := common.ReadFrame(r)
+		if err != nil {
+			return events
+		}
+		*buf = (*buf)[len(*buf)-r.Len():]
+		e := frameEvent{conn: c.id, address: c.address, sent: sent, frame: f}
+		c.dialer.events = append(c.dialer.events, e)
+		events = append(events, e)
+	}
+}
+
+// seqs Returns the seqs of frames
+func seqs(frames []common.Frame) []uint32 {
+	var seqs []uint32
+	for _, f := range frames {
+		seqs = append(seqs, f.Seq)
+	}
+	return seqs
+}
@@ -0,0 +1,265 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+// Processes that write spans
+const (
+	TraceClient = "client"
+	TraceServer = "server"
+)
+
+// Outcomes of a span other than the name of the response received
+const (
+	// SpanLost The connection was lost or closed before the response
+	SpanLost = "lost"
+	// SpanTimeout The response did not arrive in time
+	SpanTimeout = "timeout"
+)
+
+// SessionID Identifies a run of the client in the frames it sends and in
+// the logs of both sides
+type SessionID uint64
+
+// NewSessionID Returns a random session ID
+func NewSessionID() SessionID {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		// The clock still tells apart runs that do not start together
+		return SessionID(time.Now().UnixNano())
+	}
+	return SessionID(binary.BigEndian.Uint64(buf[:]))
+}
+
+// ParseSessionID Parses a session ID formatted with String
+func ParseSessionID(s string) (SessionID, error) {
+	id, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid session id %q", s)
+	}
+	return SessionID(id), nil
+}
+
+// String Formats the session ID as 16 hexadecimal digits
+func (id SessionID) String() string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// MarshalText Formats the session ID as String does
+func (id SessionID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// TraceConfig Configuration of how the requests of the client are traced
+type TraceConfig struct {
+	// Session Session ID of the run. A random one is used if zero
+	Session SessionID
+	// Writer Where the span of every request is written. Nothing is
+	// written if nil
+	Writer *TraceWriter
+}
+
+// Span Request made by one side and its outcome, as seen by that side.
+// The spans of both sides for the same request share their session and
+// request IDs
+type Span struct {
+	Process   string    `json:"process"`
+	Session   SessionID `json:"session_id"`
+	Request   uint32    `json:"request_id"`
+	Agency    string    `json:"agency,omitempty"`
+	Operation string    `json:"operation"`
+	Seq       uint32    `json:"seq"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	// Duration Milliseconds between Start and End
+	Duration float64 `json:"duration_ms"`
+	// Outcome Name of the response, or SpanLost or SpanTimeout
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+
+	writer *TraceWriter
+}
+
+// Finish Ends the span with the given outcome and writes it. Only the
+// first call has effect
+func (s *Span) Finish(outcome string) {
+	s.finish(outcome, "")
+}
+
+// Fail Ends the span with the outcome err stands for and writes it. Only
+// the first call has effect
+func (s *Span) Fail(err error) {
+	s.finish(failureOutcome(err), err.Error())
+}
+
+func (s *Span) finish(outcome string, msg string) {
+	if s == nil || !s.End.IsZero() {
+		return
+	}
+	s.End = time.Now()
+	s.Duration = float64(s.End.Sub(s.Start)) / float64(time.Millisecond)
+	s.Outcome = outcome
+	s.Error = msg
+	s.writer.write(s)
+}
+
+// failureOutcome Outcome of a request that failed with err
+func failureOutcome(err error) string {
+	var serverErr *errServer
+	var handshakeErr *errHandshake
+	switch {
+	case errors.As(err, &serverErr) || errors.As(err, &handshakeErr):
+		return MessageName(MsgError)
+	case errors.Is(err, errUnsupported):
+		return MessageName(MsgUnsupported)
+	}
+	return SpanLost
+}
+
+// TraceWriter Writes spans to a file as JSON lines, so the ones of every
+// process can be lined up by session and request ID. It can be shared by
+// several goroutines, and a nil writer writes nothing
+type TraceWriter struct {
+	mu      sync.Mutex
+	file    *os.File
+	process string
+}
+
+// NewTraceWriter Opens the file at path to append the spans of process
+// to it. Returns nil if path is empty
+func NewTraceWriter(path string, process string) (*TraceWriter, error) {
+	if path == "" {
+		return nil, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &TraceWriter{file: file, process: process}, nil
+}
+
+// StartSpan Starts the span of the request carried by f, identified by
+// its session and request IDs
+func (w *TraceWriter) StartSpan(f Frame, agency string) *Span {
+	span := &Span{
+		Session:   f.Session,
+		Request:   f.Request,
+		Agency:    agency,
+		Operation: MessageName(f.Type),
+		Seq:       f.Seq,
+		Start:     time.Now(),
+		writer:    w,
+	}
+	if w != nil {
+		span.Process = w.process
+	}
+	return span
+}
+
+func (w *TraceWriter) write(s *Span) {
+	if w == nil {
+		return
+	}
+	data, err := json.Marshal(s)
+	if err == nil {
+		w.mu.Lock()
+		_, err = w.file.Write(append(data, '\n'))
+		w.mu.Unlock()
+	}
+	if err != nil {
+		log.Warningf("action: trace | result: fail | process: %v | file: %v | error: %v", w.process, w.file.Name(), err)
+	}
+}
+
+// Close Closes the file of the writer
+func (w *TraceWriter) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// requestTracer Stamps the frames the client sends with its session ID
+// and a new request ID each, and starts the span of every request
+type requestTracer struct {
+	agency  string
+	session SessionID
+	// last Request ID given to the last frame, accessed atomically
+	last   uint32
+	writer *TraceWriter
+}
+
+func newRequestTracer(agency string, config TraceConfig) *requestTracer {
+	session := config.Session
+	if session == 0 {
+		session = NewSessionID()
+	}
+	return &requestTracer{agency: agency, session: session, writer: config.Writer}
+}
+
+// request Returns f stamped as a new request, along with its span
+func (t *requestTracer) request(f Frame) (Frame, *Span) {
+	f.Session = t.session
+	f.Request = atomic.AddUint32(&t.last, 1)
+	return f, t.writer.StartSpan(f, t.agency)
+}
+
+// sessionFormatter Adds the session ID to the action lines formatted
+type sessionFormatter struct {
+	formatter logging.Formatter
+	session   SessionID
+}
+
+// NewSessionFormatter Returns a formatter that formats records with
+// formatter and adds the session ID to every action line, right after its
+// client_id field, or after its result or action field if it has none
+func NewSessionFormatter(formatter logging.Formatter, session SessionID) logging.Formatter {
+	return &sessionFormatter{formatter: formatter, session: session}
+}
+
+func (f *sessionFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	var buf bytes.Buffer
+	if err := f.formatter.Format(calldepth+1, r, &buf); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, withSessionID(buf.String(), f.session))
+	return err
+}
+
+// withSessionID Adds the session_id field to an action line
+func withSessionID(line string, session SessionID) string {
+	start := strings.Index(line, "action: ")
+	if start < 0 {
+		return line
+	}
+	field := " | session_id: " + session.String()
+	for _, after := range []string{"| client_id: ", "| result: ", "action: "} {
+		i := strings.Index(line[start:], after)
+		if i < 0 {
+			continue
+		}
+		i += start
+		end := strings.Index(line[i+len(after):], " | ")
+		if end < 0 {
+			return line + field
+		}
+		end += i + len(after)
+		return line[:end] + field + line[end:]
+	}
+	return line
+}
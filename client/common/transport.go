@@ -0,0 +1,84 @@
+package common
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// unixScheme Prefix of the server addresses that are unix domain sockets
+const unixScheme = "unix://"
+
+// Dialer Opens the connections to the servers. It is satisfied by
+// *net.Dialer, and can be replaced to use other transports such as
+// in-memory connections created with net.Pipe
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialerFunc Adapter to use an ordinary function as a Dialer
+type DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// DialContext Calls f(ctx, network, address)
+func (f DialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// ParseServerAddress Returns the network and address to dial for a server
+// address. unix:///path/to.sock is a unix domain socket and anything else
+// is a host:port TCP address
+func ParseServerAddress(address string) (string, string) {
+	if strings.HasPrefix(address, unixScheme) {
+		return "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	return "tcp", address
+}
+
+// withTimeout Returns a context cancelled after timeout. The timeout is
+// not applied if it is not positive
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// countingDialer Dialer whose connections add the bytes they read and
+// write to the metrics
+type countingDialer struct {
+	dialer  Dialer
+	metrics *Metrics
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, metrics: d.metrics}, nil
+}
+
+func (d *countingDialer) resolvesRemotely() bool {
+	resolver, ok := d.dialer.(remoteResolver)
+	return ok && resolver.resolvesRemotely()
+}
+
+// countingConn Connection that adds the bytes it reads and writes to the
+// metrics
+type countingConn struct {
+	net.Conn
+	metrics *Metrics
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.metrics.AddBytes(n, 0)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.metrics.AddBytes(0, n)
+	return n, err
+}
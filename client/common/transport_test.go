@@ -0,0 +1,57 @@
+package common_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// TestDialerPipe A client whose dialer hands out in-memory connections
+// created with net.Pipe sends every bet to a server on the other end
+func TestDialerPipe(t *testing.T) {
+	server := testserver.New(testserver.DefaultConfig())
+	dials := 0
+	dialer := common.DialerFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dials++
+		client, conn := net.Pipe()
+		go server.HandleConnection(conn)
+		return client, nil
+	})
+
+	// The address is resolved but never dialed
+	const bets = 100
+	config := testConfig("127.0.0.1:1", writeBetsFile(t, bets))
+	config.Pipeline.Window = 4
+	summary := common.NewClient(config, dialer).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	if dials == 0 {
+		t.Fatal("the client did not use the dialer")
+	}
+	assertStored(t, server, bets)
+}
+
+// TestDialerUnixSocket A server address with the unix scheme is reached
+// over the unix domain socket at its path
+func TestDialerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := testserver.New(testserver.DefaultConfig())
+	go server.Serve(listener)
+
+	const bets = 100
+	summary := common.NewClient(testConfig("unix://"+path, writeBetsFile(t, bets)), nil).StartClientLoop(context.Background())
+	if summary.Status != common.SessionSuccess {
+		t.Fatalf("session ended as %v: %v", summary.Status, summary.Error)
+	}
+	assertStored(t, server, bets)
+}
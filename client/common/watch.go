@@ -0,0 +1,463 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// Outcomes of a file in the watch ledger
+const (
+	watchStarted   = "started"
+	watchProcessed = "processed"
+	watchFailed    = "failed"
+)
+
+// doneMarkerSuffix Suffix of the empty file that marks the file with the
+// same name without it as completely written
+const doneMarkerSuffix = ".done"
+
+// WatchConfig Configuration of the watch mode, in which the client
+// submits every bets file dropped in a directory
+type WatchConfig struct {
+	// Dir Directory watched for new bets files
+	Dir string
+	// StablePeriod Time the size of a file must stay the same before it is
+	// considered completely written
+	StablePeriod time.Duration
+	// RequireMarker Whether files are only picked up once their .done
+	// marker exists, no matter how long their size stayed the same
+	RequireMarker bool
+	// ProcessedDir Directory files submitted are moved to. Relative paths
+	// are relative to Dir
+	ProcessedDir string
+	// FailedDir Directory files that could not be submitted are moved to.
+	// Relative paths are relative to Dir
+	FailedDir string
+	// LedgerPath File recording every file handled, so none is submitted
+	// twice even across restarts. Defaults to .ledger.jsonl in Dir
+	LedgerPath string
+}
+
+func (c WatchConfig) path(dir string) string {
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(c.Dir, dir)
+}
+
+func (c WatchConfig) ledgerPath() string {
+	if c.LedgerPath == "" {
+		return filepath.Join(c.Dir, ".ledger.jsonl")
+	}
+	return c.LedgerPath
+}
+
+// ledgerEntry Line of the watch ledger
+type ledgerEntry struct {
+	File   string `json:"file"`
+	Digest string `json:"digest"`
+	Status string `json:"status"`
+	Time   string `json:"time"`
+}
+
+// watchLedger Append-only record of the files handled by the watch mode.
+// Files are identified by the SHA-256 of their content, so a file is
+// recognized even if it was renamed
+type watchLedger struct {
+	file    *os.File
+	entries map[string]ledgerEntry
+}
+
+// openLedger Loads the entries of the ledger at path and opens it to
+// append new ones, creating it if needed
+func openLedger(path string) (*watchLedger, error) {
+	l := &watchLedger{entries: make(map[string]ledgerEntry)}
+	if existing, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(existing)
+		for scanner.Scan() {
+			var entry ledgerEntry
+			// A line cut by a crash is ignored, its file is handled again
+			// from the entries before it
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+				l.entries[entry.Digest] = entry
+			}
+		}
+		existing.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, errors.Wrapf(err, "could not read ledger %v", path)
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open ledger %v", path)
+	}
+	l.file = file
+	return l, nil
+}
+
+func (l *watchLedger) lookup(digest string) (ledgerEntry, bool) {
+	entry, ok := l.entries[digest]
+	return entry, ok
+}
+
+// record Appends an entry and syncs it to disk before returning, since a
+// file must not be submitted before its entry is durable
+func (l *watchLedger) record(file string, digest string, status string) error {
+	entry := ledgerEntry{File: file, Digest: digest, Status: status, Time: time.Now().Format(time.RFC3339)}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.entries[digest] = entry
+	return nil
+}
+
+func (l *watchLedger) close() error {
+	return l.file.Close()
+}
+
+// watchRowError Row that could not be loaded, as written in the result
+type watchRowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// watchResult Outcome of a file, written next to it once moved
+type watchResult struct {
+	File     string          `json:"file"`
+	Digest   string          `json:"digest"`
+	Status   string          `json:"status"`
+	Bets     int             `json:"bets"`
+	Started  string          `json:"started"`
+	Finished string          `json:"finished"`
+	Error    string          `json:"error,omitempty"`
+	Rows     []watchRowError `json:"invalid_rows,omitempty"`
+	// Validation Outcome of the validation rules, if any is configured
+	Validation *ValidationReport `json:"validation,omitempty"`
+}
+
+// watchedFile File of the watched directory waiting to be completely
+// written
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// changedAt Last time its size or modification time changed
+	changedAt time.Time
+}
+
+// watcher Submits the files dropped in a directory one at a time
+type watcher struct {
+	client  *Client
+	config  WatchConfig
+	ledger  *watchLedger
+	pending map[string]*watchedFile
+}
+
+// Watch Submits every bets file dropped in Watch.Dir through the usual
+// batching path until ctx is cancelled. A file is picked up once its
+// .done marker exists or, unless a marker is required, once its size
+// stayed the same for Watch.StablePeriod. Submitted files are moved to
+// Watch.ProcessedDir and the rest to Watch.FailedDir, each with a JSON
+// result next to it. Files already present when the client starts are
+// handled too
+func (c *Client) Watch(ctx context.Context) error {
+	config := c.config.Watch
+	if config.Dir == "" {
+		return errors.New("no directory to watch")
+	}
+	for _, dir := range []string{config.path(config.ProcessedDir), config.path(config.FailedDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	ledger, err := openLedger(config.ledgerPath())
+	if err != nil {
+		return err
+	}
+	defer ledger.close()
+	defer c.stopLagging()
+
+	notifier, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer notifier.Close()
+	if err := notifier.Add(config.Dir); err != nil {
+		return errors.Wrapf(err, "could not watch %v", config.Dir)
+	}
+
+	w := &watcher{client: c, config: config, ledger: ledger, pending: make(map[string]*watchedFile)}
+	log.Infof("action: watch | result: in_progress | client_id: %v | dir: %v", c.config.ID, config.Dir)
+
+	interval := config.StablePeriod / 2
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	w.scan()
+	for {
+		if err := w.processReady(ctx); err != nil {
+			return err
+		}
+
+		select {
+		case event, ok := <-notifier.Events:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			name := filepath.Base(event.Name)
+			if strings.HasSuffix(name, doneMarkerSuffix) {
+				name = strings.TrimSuffix(name, doneMarkerSuffix)
+			}
+			w.track(name)
+		case err, ok := <-notifier.Errors:
+			if !ok {
+				return errors.New("watcher closed")
+			}
+			log.Warningf("action: watch | result: fail | client_id: %v | dir: %v | error: %v", c.config.ID, config.Dir, err)
+		case <-ticker.C:
+			w.scan()
+		case <-ctx.Done():
+			log.Infof("action: watch | result: success | client_id: %v | dir: %v", c.config.ID, config.Dir)
+			return nil
+		}
+	}
+}
+
+// ignored Returns whether name is not a bets file: hidden files, .done
+// markers and files still being written under a temporary name
+func ignored(name string) bool {
+	return strings.HasPrefix(name, ".") ||
+		strings.HasSuffix(name, doneMarkerSuffix) ||
+		strings.HasSuffix(name, ".tmp") ||
+		strings.HasSuffix(name, ".part")
+}
+
+// scan Tracks every file of the directory, catching up with the events
+// that were missed
+func (w *watcher) scan() {
+	entries, err := os.ReadDir(w.config.Dir)
+	if err != nil {
+		log.Warningf("action: watch | result: fail | client_id: %v | dir: %v | error: %v", w.client.config.ID, w.config.Dir, err)
+		return
+	}
+	for _, entry := range entries {
+		w.track(entry.Name())
+	}
+}
+
+// track Records the size of the file, forgetting it if it is gone
+func (w *watcher) track(name string) {
+	if ignored(name) {
+		return
+	}
+	info, err := os.Stat(filepath.Join(w.config.Dir, name))
+	if err != nil || !info.Mode().IsRegular() {
+		delete(w.pending, name)
+		return
+	}
+
+	f, ok := w.pending[name]
+	if !ok {
+		f = &watchedFile{}
+		w.pending[name] = f
+	}
+	if !ok || f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+		f.size = info.Size()
+		f.modTime = info.ModTime()
+		f.changedAt = time.Now()
+	}
+}
+
+// ready Returns whether the file is completely written
+func (w *watcher) ready(name string, f *watchedFile) bool {
+	if _, err := os.Stat(filepath.Join(w.config.Dir, name+doneMarkerSuffix)); err == nil {
+		return true
+	}
+	return !w.config.RequireMarker && time.Since(f.changedAt) >= w.config.StablePeriod
+}
+
+// processReady Handles every file completely written, oldest first. Only
+// errors that stop the watch mode are returned
+func (w *watcher) processReady(ctx context.Context) error {
+	var ready []string
+	for name, f := range w.pending {
+		if w.ready(name, f) {
+			ready = append(ready, name)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		a, b := w.pending[ready[i]], w.pending[ready[j]]
+		if !a.modTime.Equal(b.modTime) {
+			return a.modTime.Before(b.modTime)
+		}
+		return ready[i] < ready[j]
+	})
+
+	for _, name := range ready {
+		delete(w.pending, name)
+		if err := w.process(ctx, name); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// process Submits the file unless the ledger shows it was handled
+// before, then moves it along with its result. A file whose submission
+// started in a previous run but never ended is failed instead of
+// submitted again, since some of its bets may be stored already
+func (w *watcher) process(ctx context.Context, name string) error {
+	path := filepath.Join(w.config.Dir, name)
+	result := watchResult{File: name, Started: time.Now().Format(time.RFC3339)}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		log.Warningf("action: watch_file | result: fail | client_id: %v | file: %v | error: %v", w.client.config.ID, name, err)
+		return nil
+	}
+	result.Digest = digest
+
+	if entry, ok := w.ledger.lookup(digest); ok {
+		switch {
+		case entry.Status == watchStarted:
+			result.Status = watchFailed
+			result.Error = "the submission was interrupted in a previous run, some bets may be stored already"
+		case entry.File == name:
+			// The file was handled but the client stopped before moving it
+			result.Status = entry.Status
+			return w.finish(name, result)
+		default:
+			// The ledger keeps the outcome of the original file
+			result.Status = watchFailed
+			result.Error = "same content as " + entry.File + ", already " + entry.Status
+			return w.finish(name, result)
+		}
+		if err := w.ledger.record(name, digest, result.Status); err != nil {
+			return err
+		}
+		return w.finish(name, result)
+	}
+
+	if err := w.ledger.record(name, digest, watchStarted); err != nil {
+		return err
+	}
+	bets, report, err := w.client.sendFile(ctx, path)
+	if ctx.Err() != nil {
+		// Left as started, so it is failed on the next run
+		log.Warningf("action: watch_file | result: fail | client_id: %v | file: %v | error: interrupted", w.client.config.ID, name)
+		return nil
+	}
+
+	result.Status = watchProcessed
+	result.Bets = len(bets)
+	if len(w.client.config.Validation.Rules) > 0 {
+		result.Validation = report
+	}
+	if err != nil {
+		result.Status = watchFailed
+		result.Error = err.Error()
+		var rowErrors *RowErrors
+		if errors.As(err, &rowErrors) {
+			for _, row := range rowErrors.Rows {
+				result.Rows = append(result.Rows, watchRowError{Line: row.Line, Error: row.Err.Error()})
+			}
+		}
+	}
+	if err := w.ledger.record(name, digest, result.Status); err != nil {
+		return err
+	}
+	return w.finish(name, result)
+}
+
+// finish Moves the file to the directory of its status, writes its
+// result next to it and removes its marker. A file that cannot be moved
+// is left in place, and as its outcome is in the ledger the move is
+// retried once it is found again
+func (w *watcher) finish(name string, result watchResult) error {
+	dir := w.config.path(w.config.ProcessedDir)
+	if result.Status != watchProcessed {
+		dir = w.config.path(w.config.FailedDir)
+	}
+
+	target := filepath.Join(dir, name)
+	if _, err := os.Stat(target); err == nil {
+		target += "." + time.Now().Format("20060102T150405")
+	}
+	if err := os.Rename(filepath.Join(w.config.Dir, name), target); err != nil {
+		log.Errorf("action: move_file | result: fail | client_id: %v | file: %v | target: %v | error: %v",
+			w.client.config.ID,
+			name,
+			target,
+			err,
+		)
+		return nil
+	}
+	os.Remove(filepath.Join(w.config.Dir, name+doneMarkerSuffix))
+
+	result.Finished = time.Now().Format(time.RFC3339)
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(target+".json", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+
+	if result.Status == watchProcessed {
+		log.Infof("action: watch_file | result: success | client_id: %v | file: %v | bets: %v | moved_to: %v",
+			w.client.config.ID,
+			name,
+			result.Bets,
+			target,
+		)
+	} else {
+		log.Errorf("action: watch_file | result: fail | client_id: %v | file: %v | moved_to: %v | error: %v",
+			w.client.config.ID,
+			name,
+			target,
+			result.Error,
+		)
+	}
+	return nil
+}
+
+// fileDigest Hex encoded SHA-256 of the content of the file at path
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,171 @@
+package common_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+// watchConfig Configuration of a client that watches dir and submits the
+// files to the server at address
+func watchConfig(address string, dir string) common.ClientConfig {
+	config := testConfig(address, "")
+	config.Watch = common.WatchConfig{
+		Dir:          dir,
+		StablePeriod: 100 * time.Millisecond,
+		ProcessedDir: "processed",
+		FailedDir:    "failed",
+	}
+	return config
+}
+
+// startWatch Runs the watch mode of a client with config until the
+// returned function is called
+func startWatch(t *testing.T, config common.ClientConfig) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- common.NewClient(config, nil).Watch(ctx)
+	}()
+	return func() {
+		t.Helper()
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("watch failed: %v", err)
+		}
+	}
+}
+
+// waitFor Waits up to timeout for condition to hold
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return condition()
+}
+
+// exists Returns whether a file exists at path
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// TestWatchLedgerRestart A file submitted before a restart is recognized
+// by the ledger when it is dropped again, and is not submitted twice
+func TestWatchLedgerRestart(t *testing.T) {
+	address, server := startServer(t, testserver.DefaultConfig())
+	dir := t.TempDir()
+	const bets = 20
+	content, err := os.ReadFile(writeBetsFile(t, bets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := watchConfig(address, dir)
+
+	for run := 1; run <= 2; run++ {
+		stop := startWatch(t, config)
+		if err := os.WriteFile(filepath.Join(dir, "agency-1.csv"), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(t, 5*time.Second, func() bool { return !exists(filepath.Join(dir, "agency-1.csv")) }) {
+			t.Fatalf("run %v did not handle the file", run)
+		}
+		stop()
+	}
+
+	if n := len(server.Bets(testAgency)); n != bets {
+		t.Fatalf("server stored %v bets, expected the %v of a single submission", n, bets)
+	}
+	results, err := filepath.Glob(filepath.Join(dir, "processed", "agency-1.csv*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("%v results written, expected one per run", len(results))
+	}
+}
+
+// TestWatchStableSize A file still being written is only picked up once
+// its size stayed the same for the stable period
+func TestWatchStableSize(t *testing.T) {
+	address, server := startServer(t, testserver.DefaultConfig())
+	dir := t.TempDir()
+	const bets = 20
+	content, err := os.ReadFile(writeBetsFile(t, bets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := watchConfig(address, dir)
+	config.Watch.StablePeriod = 300 * time.Millisecond
+	defer startWatch(t, config)()
+
+	// A piece of the file is written every 50ms, well within the period
+	path := filepath.Join(dir, "agency-1.csv")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	for written := 0; written < len(content); written += 64 {
+		end := written + 64
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := file.Write(content[written:end]); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if n := len(server.Bets(testAgency)); n > 0 {
+			t.Fatalf("server stored %v bets while the file was being written", n)
+		}
+	}
+
+	if !waitFor(t, 5*time.Second, func() bool { return exists(filepath.Join(dir, "processed", "agency-1.csv.json")) }) {
+		t.Fatal("the file was not submitted once its size was stable")
+	}
+	assertStored(t, server, bets)
+}
+
+// TestWatchDoneMarker If a marker is required, a file is picked up once
+// its .done marker appears, however long its size stayed the same
+func TestWatchDoneMarker(t *testing.T) {
+	address, server := startServer(t, testserver.DefaultConfig())
+	dir := t.TempDir()
+	const bets = 20
+	content, err := os.ReadFile(writeBetsFile(t, bets))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := watchConfig(address, dir)
+	config.Watch.StablePeriod = 10 * time.Millisecond
+	config.Watch.RequireMarker = true
+	defer startWatch(t, config)()
+
+	path := filepath.Join(dir, "agency-1.csv")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if waitFor(t, 500*time.Millisecond, func() bool { return !exists(path) }) {
+		t.Fatal("the file was submitted without its marker")
+	}
+
+	if err := os.WriteFile(path+".done", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, 5*time.Second, func() bool { return exists(filepath.Join(dir, "processed", "agency-1.csv.json")) }) {
+		t.Fatal("the file was not submitted once its marker appeared")
+	}
+	assertStored(t, server, bets)
+	if exists(path + ".done") {
+		t.Fatal("the marker was left behind")
+	}
+}
@@ -0,0 +1,213 @@
+package common
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Formats of the winners file
+const (
+	// WinnersFormatAuto JSON if the file ends in .json, CSV otherwise
+	WinnersFormatAuto = "auto"
+	WinnersFormatCSV  = "csv"
+	WinnersFormatJSON = "json"
+)
+
+// Outcomes of checking a winner against the local bets
+const (
+	// WinnerVerified Announced by the server and confirmed by a local bet
+	WinnerVerified = "verified"
+	// WinnerServerOnly Announced by the server but no local bet of the
+	// document has the winning number
+	WinnerServerOnly = "server_only"
+	// WinnerLocalOnly A local bet has the winning number but the server
+	// did not announce its document
+	WinnerLocalOnly = "local_only"
+)
+
+// ValidateWinnersFormat Returns an error if format is not one of the
+// supported formats of the winners file
+func ValidateWinnersFormat(format string) error {
+	switch format {
+	case WinnersFormatAuto, WinnersFormatCSV, WinnersFormatJSON:
+		return nil
+	}
+	return errors.Errorf("unknown format %q, expected %v, %v or %v", format, WinnersFormatAuto, WinnersFormatCSV, WinnersFormatJSON)
+}
+
+// Winner Winner of the agency with the details of its bet, joined from
+// the local bets by document
+type Winner struct {
+	Document  string `json:"document"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Birthdate string `json:"birthdate"`
+	Number    string `json:"number"`
+	Status    string `json:"status"`
+}
+
+// WinnersReport Winners of the agency as announced by the server and as
+// found applying the winning number to the local bets
+type WinnersReport struct {
+	Agency        string   `json:"agency"`
+	WinningNumber string   `json:"winning_number"`
+	ServerWinners int      `json:"server_winners"`
+	LocalWinners  int      `json:"local_winners"`
+	ServerOnly    int      `json:"server_only"`
+	LocalOnly     int      `json:"local_only"`
+	Winners       []Winner `json:"winners"`
+}
+
+// Consistent Returns whether the server announced exactly the winners
+// found in the local bets
+func (r *WinnersReport) Consistent() bool {
+	return r.ServerOnly == 0 && r.LocalOnly == 0
+}
+
+// VerifyWinners Joins the winners announced by the server with the local
+// bets of the agency, and checks them against the winners found applying
+// the winning number to those bets. Winners are sorted by document
+func VerifyWinners(agency string, bets []Bet, result *DrawResult) *WinnersReport {
+	report := &WinnersReport{Agency: agency, WinningNumber: result.WinningNumber, Winners: []Winner{}}
+
+	// byDocument First local bet of every document, the winning one if any
+	byDocument := make(map[string]Bet)
+	local := make(map[string]bool)
+	for _, b := range bets {
+		if b.Number == result.WinningNumber && !local[b.Document] {
+			local[b.Document] = true
+			byDocument[b.Document] = b
+		}
+		if _, ok := byDocument[b.Document]; !ok {
+			byDocument[b.Document] = b
+		}
+	}
+	report.LocalWinners = len(local)
+
+	announced := make(map[string]bool)
+	for _, document := range result.Winners {
+		if announced[document] {
+			continue
+		}
+		announced[document] = true
+		report.ServerWinners++
+
+		winner := Winner{Document: document, Status: WinnerVerified}
+		if !local[document] {
+			winner.Status = WinnerServerOnly
+			report.ServerOnly++
+		}
+		if b, ok := byDocument[document]; ok {
+			winner.FirstName, winner.LastName, winner.Birthdate, winner.Number = b.FirstName, b.LastName, b.Birthdate, b.Number
+		}
+		report.Winners = append(report.Winners, winner)
+	}
+	for document := range local {
+		if announced[document] {
+			continue
+		}
+		b := byDocument[document]
+		report.LocalOnly++
+		report.Winners = append(report.Winners, Winner{
+			Document:  document,
+			FirstName: b.FirstName,
+			LastName:  b.LastName,
+			Birthdate: b.Birthdate,
+			Number:    b.Number,
+			Status:    WinnerLocalOnly,
+		})
+	}
+
+	sort.Slice(report.Winners, func(i, j int) bool {
+		return report.Winners[i].Document < report.Winners[j].Document
+	})
+	return report
+}
+
+// Write Writes the winners to path in format, see WinnersFormatAuto
+func (r *WinnersReport) Write(path string, format string) error {
+	if format == WinnersFormatAuto {
+		format = WinnersFormatCSV
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			format = WinnersFormatJSON
+		}
+	}
+	if format == WinnersFormatJSON {
+		return r.writeJSON(path)
+	}
+	return r.writeCSV(path)
+}
+
+// writeCSV Writes the winners as CSV, one per row
+func (r *WinnersReport) writeCSV(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"agency", "winning_number", "document", "first_name", "last_name", "birthdate", "number", "status"})
+	for _, winner := range r.Winners {
+		w.Write([]string{
+			r.Agency,
+			r.WinningNumber,
+			winner.Document,
+			winner.FirstName,
+			winner.LastName,
+			winner.Birthdate,
+			winner.Number,
+			winner.Status,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeJSON Writes the whole report as indented JSON
+func (r *WinnersReport) writeJSON(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// logWinners Logs the outcome of checking the winners against the local
+// bets, and every winner in disagreement
+func logWinners(clientID string, report *WinnersReport) {
+	for _, winner := range report.Winners {
+		if winner.Status == WinnerVerified {
+			continue
+		}
+		log.Warningf("action: verify_winner | result: fail | client_id: %v | document: %v | number: %v | status: %v",
+			clientID,
+			winner.Document,
+			winner.Number,
+			winner.Status,
+		)
+	}
+
+	logf, result := log.Infof, "success"
+	if !report.Consistent() {
+		logf, result = log.Errorf, "fail"
+	}
+	logf("action: verify_winners | result: %v | client_id: %v | winning_number: %v | server_winners: %v | local_winners: %v | server_only: %v | local_only: %v",
+		result,
+		clientID,
+		report.WinningNumber,
+		report.ServerWinners,
+		report.LocalWinners,
+		report.ServerOnly,
+		report.LocalOnly,
+	)
+}
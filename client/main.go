@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/op/go-logging"
@@ -34,17 +40,107 @@ func InitConfig() (*viper.Viper, error) {
 	// Add env variables supported
 	v.BindEnv("id")
 	v.BindEnv("server", "address")
+	v.BindEnv("server", "addresses")
+	v.BindEnv("server", "selection")
+	v.BindEnv("server", "max_failures")
+	v.BindEnv("server", "cooldown")
+	v.BindEnv("server", "connect_timeout")
+	v.BindEnv("server", "shards")
+	v.BindEnv("server", "shard_vnodes")
 	v.BindEnv("loop", "period")
 	v.BindEnv("loop", "amount")
+	v.BindEnv("bets", "file")
+	v.BindEnv("bets", "encoding")
+	v.BindEnv("input", "format")
+	v.BindEnv("input", "columns")
+	v.BindEnv("input", "header")
+	v.BindEnv("validation", "rules")
+	v.BindEnv("validation", "report")
+	v.BindEnv("dedup", "key")
+	v.BindEnv("dedup", "policy")
+	v.BindEnv("dedup", "expected_bets")
+	v.BindEnv("dedup", "false_positive_rate")
+	v.BindEnv("watch", "dir")
+	v.BindEnv("watch", "stable_period")
+	v.BindEnv("watch", "require_marker")
+	v.BindEnv("watch", "processed_dir")
+	v.BindEnv("watch", "failed_dir")
+	v.BindEnv("watch", "ledger_path")
+	v.BindEnv("batch", "maxAmount")
+	v.BindEnv("batch", "adaptive")
+	v.BindEnv("batch", "minAmount")
+	v.BindEnv("batch", "targetLatency")
+	v.BindEnv("pipeline", "window")
+	v.BindEnv("pipeline", "max_reconnects")
+	v.BindEnv("journal", "path")
+	v.BindEnv("replication", "replicas")
+	v.BindEnv("replication", "write_quorum")
+	v.BindEnv("replication", "catch_up_timeout")
+	v.BindEnv("rate", "bets_per_second")
+	v.BindEnv("rate", "bytes_per_second")
+	v.BindEnv("rate", "burst_bets")
+	v.BindEnv("rate", "burst_bytes")
+	v.BindEnv("heartbeat", "interval")
+	v.BindEnv("heartbeat", "timeout")
+	v.BindEnv("heartbeat", "max_missed")
+	v.BindEnv("heartbeat", "keepalive")
+	v.BindEnv("compression", "enabled")
+	v.BindEnv("compression", "threshold")
+	v.BindEnv("compression", "max_decompressed_size")
+	v.BindEnv("integrity", "checksum")
+	v.BindEnv("reconcile", "report")
+	v.BindEnv("results", "wait")
+	v.BindEnv("results", "poll_interval")
+	v.BindEnv("results", "output")
+	v.BindEnv("results", "format")
+	v.BindEnv("summary", "path")
+	v.BindEnv("trace", "file")
+	v.BindEnv("proxy", "url")
 	v.BindEnv("log", "level")
 
+	v.SetDefault("server.selection", common.SelectionPriority)
+	v.SetDefault("bets.encoding", common.EncodingAuto)
+	v.SetDefault("input.format", common.FormatAuto)
+	v.SetDefault("input.header", false)
+	v.SetDefault("dedup.key", []string{"document", "number"})
+	v.SetDefault("dedup.policy", common.DuplicatesWarn)
+	v.SetDefault("dedup.expected_bets", 1000000)
+	v.SetDefault("dedup.false_positive_rate", 0.01)
+	v.SetDefault("watch.stable_period", "2s")
+	v.SetDefault("watch.require_marker", false)
+	v.SetDefault("watch.processed_dir", "processed")
+	v.SetDefault("watch.failed_dir", "failed")
+	v.SetDefault("server.max_failures", 3)
+	v.SetDefault("server.cooldown", "30s")
+	v.SetDefault("server.connect_timeout", "5s")
+	v.SetDefault("server.shard_vnodes", 100)
+	v.SetDefault("batch.maxAmount", 10)
+	v.SetDefault("batch.adaptive", false)
+	v.SetDefault("batch.minAmount", 1)
+	v.SetDefault("batch.targetLatency", "200ms")
+	v.SetDefault("pipeline.window", 1)
+	v.SetDefault("pipeline.max_reconnects", 3)
+	v.SetDefault("replication.catch_up_timeout", "30s")
+	v.SetDefault("heartbeat.interval", "10s")
+	v.SetDefault("heartbeat.timeout", "5s")
+	v.SetDefault("heartbeat.max_missed", 3)
+	v.SetDefault("heartbeat.keepalive", "15s")
+	v.SetDefault("compression.enabled", false)
+	v.SetDefault("compression.threshold", 256)
+	v.SetDefault("compression.max_decompressed_size", 64*1024)
+	v.SetDefault("integrity.checksum", false)
+	v.SetDefault("reconcile.report", "reconcile_report")
+	v.SetDefault("results.wait", true)
+	v.SetDefault("results.poll_interval", "1s")
+	v.SetDefault("results.format", common.WinnersFormatAuto)
+
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
 	// can be loaded from the environment variables so we shouldn't
 	// return an error in that case
 	v.SetConfigFile("./config.yaml")
 	if err := v.ReadInConfig(); err != nil {
-		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
+		fmt.Fprintln(os.Stderr, "Configuration could not be read from config file. Using env variables instead")
 	}
 
 	// Parse time.Duration variables and return an error if those variables cannot be parsed
@@ -53,18 +149,94 @@ func InitConfig() (*viper.Viper, error) {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
 
+	if _, err := time.ParseDuration(v.GetString("server.cooldown")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_COOLDOWN env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("server.connect_timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_CONNECT_TIMEOUT env var as time.Duration.")
+	}
+
+	switch v.GetString("server.selection") {
+	case common.SelectionPriority, common.SelectionRoundRobin:
+	default:
+		return nil, errors.Errorf("Invalid CLI_SERVER_SELECTION %q. Must be %q or %q.",
+			v.GetString("server.selection"),
+			common.SelectionPriority,
+			common.SelectionRoundRobin,
+		)
+	}
+
+	if err := common.ValidateEncoding(v.GetString("bets.encoding")); err != nil {
+		return nil, errors.Wrapf(err, "Invalid CLI_BETS_ENCODING.")
+	}
+	if _, err := time.ParseDuration(v.GetString("watch.stable_period")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_WATCH_STABLE_PERIOD env var as time.Duration.")
+	}
+
+	if err := inputConfig(v).Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid CLI_INPUT_FORMAT or CLI_INPUT_COLUMNS.")
+	}
+
+	if _, err := validationConfig(v); err != nil {
+		return nil, errors.Wrapf(err, "Invalid CLI_VALIDATION_RULES.")
+	}
+
+	if err := dedupConfig(v).Validate(); err != nil {
+		return nil, errors.Wrapf(err, "Invalid CLI_DEDUP_KEY or CLI_DEDUP_POLICY.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("batch.targetLatency")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BATCH_TARGETLATENCY env var as time.Duration.")
+	}
+
+	if minAmount, maxAmount := v.GetInt("batch.minAmount"), v.GetInt("batch.maxAmount"); minAmount < 1 || minAmount > maxAmount {
+		return nil, errors.Errorf("Invalid CLI_BATCH_MINAMOUNT %v. Must be between 1 and CLI_BATCH_MAXAMOUNT %v.", minAmount, maxAmount)
+	}
+
+	if _, err := time.ParseDuration(v.GetString("replication.catch_up_timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_REPLICATION_CATCH_UP_TIMEOUT env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("heartbeat.interval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_HEARTBEAT_INTERVAL env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("heartbeat.timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_HEARTBEAT_TIMEOUT env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("heartbeat.keepalive")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_HEARTBEAT_KEEPALIVE env var as time.Duration.")
+	}
+
+	if _, err := time.ParseDuration(v.GetString("results.poll_interval")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_RESULTS_POLL_INTERVAL env var as time.Duration.")
+	}
+	if err := common.ValidateWinnersFormat(v.GetString("results.format")); err != nil {
+		return nil, errors.Wrapf(err, "Invalid CLI_RESULTS_FORMAT.")
+	}
+
+	if v.GetInt("rate.burst_bets") < 0 || v.GetInt("rate.burst_bytes") < 0 {
+		return nil, errors.Errorf("Invalid CLI_RATE_BURST_BETS %v or CLI_RATE_BURST_BYTES %v. Must not be negative.",
+			v.GetInt("rate.burst_bets"),
+			v.GetInt("rate.burst_bytes"),
+		)
+	}
+
 	return v, nil
 }
 
 // InitLogger Receives the log level to be set in go-logging as a string. This method
 // parses the string and set the level to the logger. If the level string is not
-// valid an error is returned
-func InitLogger(logLevel string) error {
-	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
+// valid an error is returned. Every action line carries the session ID given.
+// Logs are written to stderr, leaving stdout for the output of the commands
+func InitLogger(logLevel string, session common.SessionID) error {
+	baseBackend := logging.NewLogBackend(os.Stderr, "", 0)
 	format := logging.MustStringFormatter(
 		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
 	)
-	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+	backendFormatter := logging.NewBackendFormatter(baseBackend, common.NewSessionFormatter(format, session))
 
 	backendLeveled := logging.AddModuleLevel(backendFormatter)
 	logLevelCode, err := logging.LogLevel(logLevel)
@@ -78,38 +250,309 @@ func InitLogger(logLevel string) error {
 	return nil
 }
 
+// inputConfig Configuration of how the bets files are read
+func inputConfig(v *viper.Viper) common.InputConfig {
+	return common.InputConfig{
+		Format:   v.GetString("input.format"),
+		Encoding: v.GetString("bets.encoding"),
+		Columns:  v.GetStringSlice("input.columns"),
+		Header:   v.GetBool("input.header"),
+	}
+}
+
+// validationConfig Configuration of the validation of the bets, reading
+// the rules from the file at validation.rules if set
+func validationConfig(v *viper.Viper) (common.ValidationConfig, error) {
+	config := common.ValidationConfig{Report: v.GetString("validation.report")}
+	if path := v.GetString("validation.rules"); path != "" {
+		rules, err := common.LoadRules(path)
+		if err != nil {
+			return config, err
+		}
+		config.Rules = rules
+	}
+	return config, nil
+}
+
+// dedupConfig Configuration of how duplicate bets are found
+func dedupConfig(v *viper.Viper) common.DedupConfig {
+	return common.DedupConfig{
+		Key:               v.GetStringSlice("dedup.key"),
+		Policy:            v.GetString("dedup.policy"),
+		ExpectedBets:      v.GetInt("dedup.expected_bets"),
+		FalsePositiveRate: v.GetFloat64("dedup.false_positive_rate"),
+	}
+}
+
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
+	log.Infof("action: config | result: success | client_id: %s | server_address: %s | server_addresses: %v | server_selection: %s | server_shards: %v | loop_amount: %v | loop_period: %v | bets_file: %s | bets_encoding: %s | input_format: %s | input_columns: %v | input_header: %v | validation_rules: %s | validation_report: %s | dedup_key: %v | dedup_policy: %s | watch_dir: %s | watch_stable_period: %v | watch_require_marker: %v | batch_max_amount: %v | batch_adaptive: %v | batch_min_amount: %v | batch_target_latency: %v | pipeline_window: %v | journal_path: %s | replication_replicas: %v | replication_write_quorum: %v | replication_catch_up_timeout: %v | rate_bets_per_second: %v | rate_bytes_per_second: %v | rate_burst_bets: %v | rate_burst_bytes: %v | heartbeat_interval: %v | heartbeat_timeout: %v | compression_enabled: %v | compression_threshold: %v | integrity_checksum: %v | results_wait: %v | results_poll_interval: %v | results_output: %s | results_format: %s | summary_path: %s | trace_file: %s | reconcile_report: %s | proxy_url: %s | log_level: %s",
 		v.GetString("id"),
 		v.GetString("server.address"),
+		v.GetStringSlice("server.addresses"),
+		v.GetString("server.selection"),
+		v.GetStringSlice("server.shards"),
 		v.GetInt("loop.amount"),
 		v.GetDuration("loop.period"),
+		v.GetString("bets.file"),
+		v.GetString("bets.encoding"),
+		v.GetString("input.format"),
+		v.GetStringSlice("input.columns"),
+		v.GetBool("input.header"),
+		v.GetString("validation.rules"),
+		v.GetString("validation.report"),
+		v.GetStringSlice("dedup.key"),
+		v.GetString("dedup.policy"),
+		v.GetString("watch.dir"),
+		v.GetDuration("watch.stable_period"),
+		v.GetBool("watch.require_marker"),
+		v.GetInt("batch.maxAmount"),
+		v.GetBool("batch.adaptive"),
+		v.GetInt("batch.minAmount"),
+		v.GetDuration("batch.targetLatency"),
+		v.GetInt("pipeline.window"),
+		v.GetString("journal.path"),
+		v.GetStringSlice("replication.replicas"),
+		v.GetInt("replication.write_quorum"),
+		v.GetDuration("replication.catch_up_timeout"),
+		v.GetFloat64("rate.bets_per_second"),
+		v.GetFloat64("rate.bytes_per_second"),
+		v.GetInt("rate.burst_bets"),
+		v.GetInt("rate.burst_bytes"),
+		v.GetDuration("heartbeat.interval"),
+		v.GetDuration("heartbeat.timeout"),
+		v.GetBool("compression.enabled"),
+		v.GetInt("compression.threshold"),
+		v.GetBool("integrity.checksum"),
+		v.GetBool("results.wait"),
+		v.GetDuration("results.poll_interval"),
+		v.GetString("results.output"),
+		v.GetString("results.format"),
+		v.GetString("summary.path"),
+		v.GetString("trace.file"),
+		v.GetString("reconcile.report"),
+		redactURL(v.GetString("proxy.url")),
 		v.GetString("log.level"),
 	)
 }
 
+// redactURL Hides the password of an url so it can be logged
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid>"
+	}
+	return parsed.Redacted()
+}
+
+// PrintShardOf Prints the shard that stores the bets of the given agency.
+// Returns an error if no shards are configured
+func PrintShardOf(v *viper.Viper, agency string) error {
+	shards := v.GetStringSlice("server.shards")
+	if len(shards) == 0 {
+		return errors.New("No shards configured. Set server.shards or CLI_SERVER_SHARDS.")
+	}
+
+	ring := common.NewShardRing(shards, v.GetInt("server.shard_vnodes"))
+	fmt.Println(ring.ShardOf(agency))
+	return nil
+}
+
 func main() {
+	traceFile := flag.String("trace-file", "", "file the span of every request is appended to as a JSON line, overrides trace.file")
+	flag.Parse()
+	args := flag.Args()
+
 	v, err := InitConfig()
 	if err != nil {
 		log.Criticalf("%s", err)
 	}
+	if *traceFile != "" {
+		v.Set("trace.file", *traceFile)
+	}
 
-	if err := InitLogger(v.GetString("log.level")); err != nil {
+	// The session ID tells apart the runs of the client in the logs and
+	// traces of every process
+	session := common.NewSessionID()
+	if err := InitLogger(v.GetString("log.level"), session); err != nil {
 		log.Criticalf("%s", err)
 	}
 
+	// Commands that only inspect the configuration are run without
+	// printing it, so their output can be used by other tools
+	if len(args) > 0 && args[0] == "shard-of" {
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: client shard-of <agency>")
+			os.Exit(2)
+		}
+		if err := PrintShardOf(v, args[1]); err != nil {
+			log.Criticalf("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Print program config with debugging purposes
 	PrintConfig(v)
 
+	validation, err := validationConfig(v)
+	if err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(1)
+	}
+
+	trace, err := common.NewTraceWriter(v.GetString("trace.file"), common.TraceClient)
+	if err != nil {
+		log.Criticalf("action: open_trace | result: fail | client_id: %v | file: %v | error: %v", v.GetString("id"), v.GetString("trace.file"), err)
+		os.Exit(1)
+	}
+
 	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		LoopAmount:    v.GetInt("loop.amount"),
-		LoopPeriod:    v.GetDuration("loop.period"),
+		ServerAddress:   v.GetString("server.address"),
+		ServerAddresses: v.GetStringSlice("server.addresses"),
+		Failover: common.FailoverConfig{
+			Selection:      v.GetString("server.selection"),
+			MaxFailures:    v.GetInt("server.max_failures"),
+			Cooldown:       v.GetDuration("server.cooldown"),
+			ConnectTimeout: v.GetDuration("server.connect_timeout"),
+		},
+		Shards:            v.GetStringSlice("server.shards"),
+		ShardVirtualNodes: v.GetInt("server.shard_vnodes"),
+		ID:                v.GetString("id"),
+		LoopAmount:        v.GetInt("loop.amount"),
+		LoopPeriod:        v.GetDuration("loop.period"),
+		BetsFile:          v.GetString("bets.file"),
+		Input:             inputConfig(v),
+		Validation:        validation,
+		Dedup:             dedupConfig(v),
+		JournalPath:       v.GetString("journal.path"),
+		Batch: common.BatchConfig{
+			MaxAmount:     v.GetInt("batch.maxAmount"),
+			Adaptive:      v.GetBool("batch.adaptive"),
+			MinAmount:     v.GetInt("batch.minAmount"),
+			TargetLatency: v.GetDuration("batch.targetLatency"),
+		},
+		Pipeline: common.PipelineConfig{
+			Window:        v.GetInt("pipeline.window"),
+			MaxReconnects: v.GetInt("pipeline.max_reconnects"),
+		},
+		Replication: common.ReplicationConfig{
+			Replicas:       v.GetStringSlice("replication.replicas"),
+			WriteQuorum:    v.GetInt("replication.write_quorum"),
+			CatchUpTimeout: v.GetDuration("replication.catch_up_timeout"),
+		},
+		Heartbeat: common.HeartbeatConfig{
+			Interval:  v.GetDuration("heartbeat.interval"),
+			Timeout:   v.GetDuration("heartbeat.timeout"),
+			MaxMissed: v.GetInt("heartbeat.max_missed"),
+			KeepAlive: v.GetDuration("heartbeat.keepalive"),
+		},
+		Compression: common.CompressionConfig{
+			Enabled:             v.GetBool("compression.enabled"),
+			Threshold:           v.GetInt("compression.threshold"),
+			MaxDecompressedSize: v.GetInt("compression.max_decompressed_size"),
+		},
+		Integrity: common.IntegrityConfig{
+			Checksum: v.GetBool("integrity.checksum"),
+		},
+		Results: common.ResultsConfig{
+			Wait:         v.GetBool("results.wait"),
+			PollInterval: v.GetDuration("results.poll_interval"),
+			Output:       v.GetString("results.output"),
+			Format:       v.GetString("results.format"),
+		},
+		Watch: common.WatchConfig{
+			Dir:           v.GetString("watch.dir"),
+			StablePeriod:  v.GetDuration("watch.stable_period"),
+			RequireMarker: v.GetBool("watch.require_marker"),
+			ProcessedDir:  v.GetString("watch.processed_dir"),
+			FailedDir:     v.GetString("watch.failed_dir"),
+			LedgerPath:    v.GetString("watch.ledger_path"),
+		},
+		Rate: common.RateConfig{
+			BetsPerSecond:  v.GetFloat64("rate.bets_per_second"),
+			BytesPerSecond: v.GetFloat64("rate.bytes_per_second"),
+			BurstBets:      v.GetInt("rate.burst_bets"),
+			BurstBytes:     v.GetInt("rate.burst_bytes"),
+		},
+		Trace: common.TraceConfig{
+			Session: session,
+			Writer:  trace,
+		},
+	}
+
+	// SIGTERM or an interrupt cancel the session, so the client stops
+	// sending and still reports what it got done
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	var dialer common.Dialer
+	if proxyURL := v.GetString("proxy.url"); proxyURL != "" {
+		dialer, err = common.NewProxyDialer(proxyURL, &net.Dialer{KeepAlive: clientConfig.Heartbeat.KeepAlive})
+		if err != nil {
+			log.Criticalf("%s", err)
+			os.Exit(1)
+		}
 	}
 
-	client := common.NewClient(clientConfig)
-	client.StartClientLoop()
+	client := common.NewClient(clientConfig, dialer)
+	if len(args) > 0 && args[0] == "reconcile" {
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: client reconcile <file>")
+			os.Exit(2)
+		}
+		os.Exit(Reconcile(ctx, client, clientConfig.ID, args[1], v.GetString("reconcile.report")))
+	}
+	if len(args) > 0 && args[0] == "watch" {
+		if err := client.Watch(ctx); err != nil {
+			log.Criticalf("action: watch | result: fail | client_id: %v | error: %v", clientConfig.ID, err)
+			os.Exit(1)
+		}
+		return
+	}
+	summary := client.StartClientLoop(ctx)
+	os.Exit(WriteSummary(summary, v.GetString("summary.path")))
+}
+
+// WriteSummary Prints the summary of the session to stdout as a single
+// line of JSON, which is all that is written there as logs go to stderr,
+// and writes a copy to path if set. Returns the exit code of the process:
+// 0 if the session fully succeeded, 3 if it partially did and 1 if it
+// failed
+func WriteSummary(summary *common.SessionSummary, path string) int {
+	fmt.Println(string(summary.JSON()))
+	if path != "" {
+		if err := summary.WriteJSON(path); err != nil {
+			log.Errorf("action: write_summary | result: fail | client_id: %v | file: %v | error: %v", summary.Agency, path, err)
+		}
+	}
+	return summary.ExitCode()
+}
+
+// Reconcile Compares the bets of file with the ones stored by the server
+// and writes the report to <report>.csv and <report>.json. Returns the
+// exit code of the command: 0 if the server stored exactly the bets of
+// file, 3 if it did not and 1 if the comparison could not be made
+func Reconcile(ctx context.Context, client *common.Client, clientID string, file string, report string) int {
+	result, err := client.Reconcile(ctx, file)
+	if err != nil {
+		log.Criticalf("action: reconcile | result: fail | client_id: %v | file: %v | error: %v", clientID, file, err)
+		return 1
+	}
+
+	if err := result.WriteCSV(report + ".csv"); err != nil {
+		log.Criticalf("action: write_report | result: fail | client_id: %v | error: %v", clientID, err)
+		return 1
+	}
+	if err := result.WriteJSON(report + ".json"); err != nil {
+		log.Criticalf("action: write_report | result: fail | client_id: %v | error: %v", clientID, err)
+		return 1
+	}
+
+	common.LogReconcileReport(clientID, result)
+	if !result.Consistent() {
+		return 3
+	}
+	return 0
 }
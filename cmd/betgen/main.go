@@ -0,0 +1,415 @@
+// Command betgen writes synthetic agency files in the input formats of
+// the client. Rows are derived from a seed, so the same flags always
+// produce the same file. The fraction of bets on the winning number can
+// be tuned, and invalid rows of every category the client rejects can be
+// injected, along with a manifest of where they are, to build fixtures
+// for the validator, the duplicate detection and load tests.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+var log = logging.MustGetLogger("log")
+
+// fixedWidthColumns Layout of the fixed-width files, as expected in
+// CLI_INPUT_COLUMNS
+var fixedWidthColumns = []string{
+	"first_name=1-20",
+	"last_name=21-40",
+	"document=41-50",
+	"birthdate=51-60",
+	"number=61-65",
+}
+
+var firstNames = []string{
+	"Santiago", "Mateo", "Juan", "Matías", "Nicolás", "Benjamín", "Martín", "Tomás",
+	"Joaquín", "Agustín", "Lucas", "Facundo", "Sofía", "Valentina", "Martina", "Lucía",
+	"Catalina", "Camila", "Julieta", "María", "Florencia", "Agustina", "Josefina", "Ana",
+	"Inés", "Carolina", "Marcos", "Ramón", "Héctor", "Julián",
+}
+
+var lastNames = []string{
+	"González", "Rodríguez", "Gómez", "Fernández", "López", "Díaz", "Martínez", "Pérez",
+	"García", "Sánchez", "Romero", "Sosa", "Álvarez", "Torres", "Ruiz", "Ramírez",
+	"Flores", "Benítez", "Acosta", "Medina", "Herrera", "Suárez", "Aguirre", "Giménez",
+	"Gutiérrez", "Pereyra", "Rojas", "Molina", "Castro", "Ortiz",
+}
+
+// row Fields of a generated row, as written
+type row struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Document  string `json:"document"`
+	Birthdate string `json:"birthdate"`
+	Number    string `json:"number"`
+	// malformed Whether the row must be written so it cannot be parsed
+	malformed bool
+}
+
+// category Kind of invalid row. Built-in ones fail the checks of the
+// client, the rest pass them but break the usual validation rules or
+// the duplicate detection
+type category struct {
+	name string
+	// corrupt Turns a valid row into an invalid one. previous holds the
+	// valid rows written so far
+	corrupt func(r *rand.Rand, row *row, previous []row)
+}
+
+var categories = []category{
+	{"missing_field", func(r *rand.Rand, row *row, previous []row) { row.LastName = "" }},
+	{"reserved_char", func(r *rand.Rand, row *row, previous []row) { row.FirstName += ";" }},
+	{"bad_document", func(r *rand.Rand, row *row, previous []row) { row.Document = row.Document[:4] + "X" + row.Document[5:] }},
+	{"bad_birthdate", func(r *rand.Rand, row *row, previous []row) { row.Birthdate = row.Birthdate[:5] + "13-45" }},
+	{"bad_number", func(r *rand.Rand, row *row, previous []row) { row.Number += "x" }},
+	{"control_char", func(r *rand.Rand, row *row, previous []row) { row.LastName += "\x07" }},
+	// invalid_utf8 A Latin-1 byte, while the rest of the file is UTF-8
+	{"invalid_utf8", func(r *rand.Rand, row *row, previous []row) { row.FirstName += "\xe9" }},
+	{"malformed_row", func(r *rand.Rand, row *row, previous []row) { row.malformed = true }},
+	{"future_birthdate", func(r *rand.Rand, row *row, previous []row) { row.Birthdate = randomDate(r, 2100, 2120) }},
+	{"minor", func(r *rand.Rand, row *row, previous []row) { row.Birthdate = randomDate(r, 2016, 2020) }},
+	{"out_of_range", func(r *rand.Rand, row *row, previous []row) { row.Number = strconv.Itoa(10000 + r.Intn(90000)) }},
+	{"duplicate", func(r *rand.Rand, row *row, previous []row) { *row = previous[r.Intn(len(previous))] }},
+}
+
+// injected Invalid row of the manifest
+type injected struct {
+	Line     int    `json:"line"`
+	Category string `json:"category"`
+}
+
+// manifest Description of a generated file
+type manifest struct {
+	File          string     `json:"file"`
+	Format        string     `json:"format"`
+	Seed          int64      `json:"seed"`
+	Agency        int        `json:"agency"`
+	Rows          int        `json:"rows"`
+	WinningNumber string     `json:"winning_number"`
+	Winners       int        `json:"winners"`
+	Columns       []string   `json:"columns,omitempty"`
+	Invalid       []injected `json:"invalid"`
+}
+
+// generator Produces valid rows from a random source
+type generator struct {
+	rand          *rand.Rand
+	winningNumber int
+	winningRate   float64
+	documents     map[string]bool
+}
+
+// randomDate Random date between the start of from and the end of to
+func randomDate(r *rand.Rand, from int, to int) string {
+	start := time.Date(from, 1, 1, 0, 0, 0, 0, time.UTC)
+	days := int(time.Date(to+1, 1, 1, 0, 0, 0, 0, time.UTC).Sub(start).Hours() / 24)
+	return start.AddDate(0, 0, r.Intn(days)).Format("2006-01-02")
+}
+
+// next Returns a valid row with a document not used before
+func (g *generator) next() row {
+	document := ""
+	for document == "" || g.documents[document] {
+		document = strconv.Itoa(10000000 + g.rand.Intn(35000000))
+	}
+	g.documents[document] = true
+
+	number := g.winningNumber
+	if g.rand.Float64() >= g.winningRate {
+		// Any number other than the winning one
+		number = g.rand.Intn(9999)
+		if number >= g.winningNumber {
+			number++
+		}
+	}
+
+	return row{
+		FirstName: firstNames[g.rand.Intn(len(firstNames))],
+		LastName:  lastNames[g.rand.Intn(len(lastNames))],
+		Document:  document,
+		Birthdate: randomDate(g.rand, 1935, 2005),
+		Number:    strconv.Itoa(number),
+	}
+}
+
+// rowWriter Writes rows in one of the input formats
+type rowWriter interface {
+	write(row) error
+	flush() error
+}
+
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvWriter) write(r row) error {
+	record := []string{r.FirstName, r.LastName, r.Document, r.Birthdate, r.Number}
+	if r.malformed {
+		record = record[:len(record)-1]
+	}
+	return w.writer.Write(record)
+}
+
+func (w *csvWriter) flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type jsonlWriter struct {
+	writer *bufio.Writer
+}
+
+func (w *jsonlWriter) write(r row) error {
+	if r.malformed {
+		_, err := fmt.Fprintf(w.writer, "{\"first_name\": %q, \"last_name\": %q\n", r.FirstName, r.LastName)
+		return err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// Marshal replaces invalid UTF-8 with U+FFFD, which would hide an
+	// invalid_utf8 row, so the original bytes are put back
+	if !utf8.ValidString(r.FirstName) {
+		valid, _ := json.Marshal(r.FirstName)
+		line = bytes.Replace(line, valid, []byte(`"`+r.FirstName+`"`), 1)
+	}
+	_, err = w.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (w *jsonlWriter) flush() error {
+	return w.writer.Flush()
+}
+
+type fixedWidthWriter struct {
+	writer *bufio.Writer
+	widths []int
+}
+
+func (w *fixedWidthWriter) write(r row) error {
+	var line strings.Builder
+	for i, value := range []string{r.FirstName, r.LastName, r.Document, r.Birthdate, r.Number} {
+		if i == len(w.widths)-1 && r.malformed {
+			break
+		}
+		line.WriteString(value)
+		if padding := w.widths[i] - utf8.RuneCountInString(value); padding > 0 {
+			line.WriteString(strings.Repeat(" ", padding))
+		}
+	}
+	_, err := w.writer.WriteString(strings.TrimRight(line.String(), " ") + "\n")
+	return err
+}
+
+func (w *fixedWidthWriter) flush() error {
+	return w.writer.Flush()
+}
+
+// newRowWriter Returns a writer of the format given
+func newRowWriter(out io.Writer, format string, header bool) (rowWriter, error) {
+	switch format {
+	case common.FormatCSV:
+		w := &csvWriter{writer: csv.NewWriter(out)}
+		if header {
+			if err := w.writer.Write([]string{"first_name", "last_name", "document", "birthdate", "number"}); err != nil {
+				return nil, err
+			}
+		}
+		return w, nil
+	case common.FormatJSONL:
+		return &jsonlWriter{writer: bufio.NewWriter(out)}, nil
+	case common.FormatFixedWidth:
+		w := &fixedWidthWriter{writer: bufio.NewWriter(out)}
+		for _, column := range fixedWidthColumns {
+			bounds := strings.SplitN(strings.SplitN(column, "=", 2)[1], "-", 2)
+			first, _ := strconv.Atoi(bounds[0])
+			last, _ := strconv.Atoi(bounds[1])
+			w.widths = append(w.widths, last-first+1)
+		}
+		return w, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected %v, %v or %v", format, common.FormatCSV, common.FormatJSONL, common.FormatFixedWidth)
+}
+
+// selectCategories Returns the categories named in a comma separated
+// list, or every category if it is all
+func selectCategories(names string) ([]category, error) {
+	if names == "all" {
+		return categories, nil
+	}
+
+	var selected []category
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, c := range categories {
+			if c.name == strings.TrimSpace(name) {
+				selected = append(selected, c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown category %q", name)
+		}
+	}
+	return selected, nil
+}
+
+func main() {
+	seed := flag.Int64("seed", 1, "seed of the random source, the same seed and flags produce the same file")
+	rows := flag.Int("rows", 1000, "valid rows to write")
+	agency := flag.Int("agency", 1, "agency the file belongs to, mixed into the seed")
+	format := flag.String("format", common.FormatCSV, "format of the file: csv, jsonl or fixed-width")
+	header := flag.Bool("header", false, "write a header row in CSV files")
+	out := flag.String("out", "", "file to write, agency-<agency>.<format> if empty or stdout if -")
+	winningNumber := flag.Int("winning-number", 7574, "number drawn by the server")
+	winningRate := flag.Float64("winning-rate", 0.01, "fraction of valid rows that bet on the winning number")
+	invalid := flag.Int("invalid", 0, "invalid rows to inject of every category")
+	categoryNames := flag.String("categories", "all", "comma separated categories of invalid rows to inject")
+	manifestPath := flag.String("manifest", "", "file to write the lines of the invalid rows to as JSON")
+	flag.Parse()
+
+	backend := logging.NewLogBackend(os.Stderr, "", 0)
+	logging.SetBackend(logging.NewBackendFormatter(backend, logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)))
+
+	if err := run(*seed, *rows, *agency, *format, *header, *out, *winningNumber, *winningRate, *invalid, *categoryNames, *manifestPath); err != nil {
+		log.Criticalf("action: generate | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+}
+
+func run(seed int64, rows int, agency int, format string, header bool, out string, winningNumber int, winningRate float64, invalid int, categoryNames string, manifestPath string) error {
+	if rows < 0 || invalid < 0 {
+		return fmt.Errorf("rows and invalid cannot be negative")
+	}
+	if winningNumber < 0 || winningNumber > 9999 {
+		return fmt.Errorf("invalid winning number %v, must be between 0 and 9999", winningNumber)
+	}
+	if winningRate < 0 || winningRate > 1 {
+		return fmt.Errorf("invalid winning rate %v, must be between 0 and 1", winningRate)
+	}
+	selected, err := selectCategories(categoryNames)
+	if err != nil {
+		return err
+	}
+	if invalid > 0 && rows == 0 {
+		return fmt.Errorf("invalid rows are derived from valid ones, rows must be positive")
+	}
+
+	r := rand.New(rand.NewSource(seed*1000003 + int64(agency)))
+	g := &generator{rand: r, winningNumber: winningNumber, winningRate: winningRate, documents: make(map[string]bool)}
+
+	// The category of every row, empty for valid ones. Invalid rows go
+	// after the first valid one, so duplicates always have an original
+	slots := make([]string, rows)
+	for _, c := range selected {
+		for i := 0; i < invalid; i++ {
+			position := 1 + r.Intn(len(slots))
+			slots = append(slots[:position], append([]string{c.name}, slots[position:]...)...)
+		}
+	}
+
+	if out == "" {
+		extension := map[string]string{common.FormatCSV: "csv", common.FormatJSONL: "jsonl", common.FormatFixedWidth: "dat"}[format]
+		out = fmt.Sprintf("agency-%v.%v", agency, extension)
+	}
+	var file io.Writer = os.Stdout
+	if out != "-" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		file = f
+	}
+	w, err := newRowWriter(file, format, header)
+	if err != nil {
+		return err
+	}
+
+	m := manifest{
+		File:          out,
+		Format:        format,
+		Seed:          seed,
+		Agency:        agency,
+		Rows:          len(slots),
+		WinningNumber: strconv.Itoa(winningNumber),
+		Invalid:       []injected{},
+	}
+	if format == common.FormatFixedWidth {
+		m.Columns = fixedWidthColumns
+	}
+
+	line := 0
+	if header && format == common.FormatCSV {
+		line++
+	}
+	var written []row
+	for _, slot := range slots {
+		line++
+		next := g.next()
+		if slot == "" {
+			written = append(written, next)
+			if next.Number == m.WinningNumber {
+				m.Winners++
+			}
+		}
+		for _, c := range selected {
+			if c.name == slot {
+				c.corrupt(r, &next, written)
+				m.Invalid = append(m.Invalid, injected{Line: line, Category: slot})
+			}
+		}
+		if err := w.write(next); err != nil {
+			return err
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	sort.Slice(m.Invalid, func(i, j int) bool { return m.Invalid[i].Line < m.Invalid[j].Line })
+	if manifestPath != "" {
+		data, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(manifestPath, append(data, '\n'), 0644); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("action: generate | result: success | file: %v | format: %v | seed: %v | agency: %v | rows: %v | winners: %v | invalid: %v",
+		out,
+		format,
+		seed,
+		agency,
+		m.Rows,
+		m.Winners,
+		len(m.Invalid),
+	)
+	if format == common.FormatFixedWidth {
+		log.Infof("action: generate | result: success | file: %v | columns: %v", out, strings.Join(fixedWidthColumns, " "))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The control API changes the faults while the proxy runs. Bodies and
+// responses are JSON, with durations written as text such as 150ms:
+//
+//	GET    /faults                    faults of both directions
+//	PUT    /faults/client_to_server   replaces the faults of a direction
+//	PUT    /faults/server_to_client
+//	GET    /partition                 partition in course, null if none
+//	POST   /partition                 starts a partition, {"mode": "drop", "duration": "5s"},
+//	                                  "start" after the request if given
+//	DELETE /partition                 ends the partition in course
+//	POST   /reset                     resets every connection open
+//	GET    /stats                     counters of connections and bytes
+
+// serveControl Serves the control API on addr until it fails
+func (p *proxy) serveControl(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/faults", p.handleFaults)
+	mux.HandleFunc("/faults/", p.handleFaults)
+	mux.HandleFunc("/partition", p.handlePartition)
+	mux.HandleFunc("/reset", p.handleReset)
+	mux.HandleFunc("/stats", p.handleStats)
+
+	log.Infof("action: serve_control | result: in_progress | addr: %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("action: serve_control | result: fail | addr: %v | error: %v", addr, err)
+	}
+}
+
+func (p *proxy) handleFaults(w http.ResponseWriter, r *http.Request) {
+	dir := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/faults"), "/")
+	switch {
+	case r.Method == http.MethodGet && dir == "":
+		writeJSON(w, map[string]faults{
+			clientToServer: p.currentFaults(clientToServer),
+			serverToClient: p.currentFaults(serverToClient),
+		})
+	case r.Method == http.MethodGet && (dir == clientToServer || dir == serverToClient):
+		writeJSON(w, p.currentFaults(dir))
+	case r.Method == http.MethodPut && (dir == clientToServer || dir == serverToClient):
+		var f faults
+		if err := readJSON(r, &f); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := f.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		p.setFaults(dir, f)
+		writeJSON(w, f)
+	case dir != "" && dir != clientToServer && dir != serverToClient:
+		writeError(w, http.StatusNotFound, errors.Errorf("unknown direction %q, expected %v or %v", dir, clientToServer, serverToClient))
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %v not allowed", r.Method))
+	}
+}
+
+func (p *proxy) handlePartition(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		p.mu.Lock()
+		var partition *activePartition
+		if p.partition != nil && time.Now().Before(p.partition.Until) {
+			partition = &activePartition{Mode: p.partition.Mode, Until: p.partition.Until}
+		}
+		p.mu.Unlock()
+		writeJSON(w, partition)
+	case http.MethodPost:
+		var partition partition
+		if err := readJSON(r, &partition); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := partition.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		p.schedule(partition)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		p.heal()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %v not allowed", r.Method))
+	}
+}
+
+func (p *proxy) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	writeJSON(w, map[string]int{"reset": p.resetAll("requested")})
+}
+
+func (p *proxy) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	writeJSON(w, stats{
+		Open:           atomic.LoadInt64(&p.stats.Open),
+		Total:          atomic.LoadInt64(&p.stats.Total),
+		Resets:         atomic.LoadInt64(&p.stats.Resets),
+		ClientToServer: p.stats.ClientToServer.load(),
+		ServerToClient: p.stats.ServerToClient.load(),
+	})
+}
+
+// load Returns a snapshot of the counters
+func (s *directionStats) load() directionStats {
+	return directionStats{
+		Read:      atomic.LoadInt64(&s.Read),
+		Forwarded: atomic.LoadInt64(&s.Forwarded),
+		Dropped:   atomic.LoadInt64(&s.Dropped),
+	}
+}
+
+// readJSON Decodes the body of r into v, rejecting unknown fields
+func readJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.Wrapf(err, "invalid body")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,448 @@
+// Command chaosproxy sits between the client and the server and injects
+// faults in the traffic of every connection, to check how both sides
+// cope with slow, fragmented and broken links. For each direction it can
+// add latency and jitter, limit the bandwidth, write chunks one byte at
+// a time to provoke short reads, reset the connection after some bytes
+// and drop every byte. Partitions cut the link for a while, either
+// silently or resetting the connections. Faults are read from a YAML
+// scenario file and can be changed while running through a small HTTP
+// control API, see control.go.
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+var log = logging.MustGetLogger("log")
+
+// readBufferSize Biggest chunk read at once from either side
+const readBufferSize = 32 * 1024
+
+// pendingChunks Chunks read and not yet forwarded before reading stops
+const pendingChunks = 256
+
+// acceptRetryDelay Wait after a failed accept, so errors that persist,
+// such as running out of file descriptors, do not spin the loop
+const acceptRetryDelay = 100 * time.Millisecond
+
+// directionStats Bytes seen in one direction of every connection
+type directionStats struct {
+	Read      int64 `json:"bytes_read"`
+	Forwarded int64 `json:"bytes_forwarded"`
+	Dropped   int64 `json:"bytes_dropped"`
+}
+
+// stats Counters of the proxy, updated atomically
+type stats struct {
+	Open           int64          `json:"connections_open"`
+	Total          int64          `json:"connections_total"`
+	Resets         int64          `json:"resets"`
+	ClientToServer directionStats `json:"client_to_server"`
+	ServerToClient directionStats `json:"server_to_client"`
+}
+
+// activePartition Partition in course
+type activePartition struct {
+	Mode  string    `json:"mode"`
+	Until time.Time `json:"until"`
+}
+
+// proxy Forwards the connections accepted to the upstream server,
+// injecting the faults configured
+type proxy struct {
+	network string
+	address string
+	stats   stats
+
+	mu        sync.Mutex
+	faults    map[string]faults
+	partition *activePartition
+	conns     map[*connection]bool
+	lastID    int64
+}
+
+// connection Pair of connections forwarded to each other
+type connection struct {
+	id     int64
+	client net.Conn
+	server net.Conn
+	once   sync.Once
+}
+
+// reset Closes both sides with a TCP RST, or just closes them if they
+// are not TCP connections
+func (c *connection) reset() {
+	c.once.Do(func() {
+		for _, conn := range []net.Conn{c.client, c.server} {
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetLinger(0)
+			}
+			conn.Close()
+		}
+	})
+}
+
+// close Closes both sides
+func (c *connection) close() {
+	c.once.Do(func() {
+		c.client.Close()
+		c.server.Close()
+	})
+}
+
+func main() {
+	listen := flag.String("listen", ":12346", "address to listen on, host:port or unix:///path/to.sock")
+	upstream := flag.String("upstream", "localhost:12345", "address of the server, host:port or unix:///path/to.sock")
+	scenarioPath := flag.String("scenario", "", "YAML file with the faults injected and the partitions scheduled")
+	control := flag.String("control", "", "address of the HTTP control API, disabled if empty")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "seed of the jitter and the fragmentation")
+	flag.Parse()
+
+	backend := logging.NewLogBackend(os.Stdout, "", 0)
+	logging.SetBackend(logging.NewBackendFormatter(backend, logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)))
+	rand.Seed(*seed)
+
+	var s scenario
+	if *scenarioPath != "" {
+		var err error
+		if s, err = loadScenario(*scenarioPath); err != nil {
+			log.Criticalf("action: load_scenario | result: fail | file: %v | error: %v", *scenarioPath, err)
+			os.Exit(1)
+		}
+	}
+
+	network, address := common.ParseServerAddress(*upstream)
+	p := &proxy{
+		network: network,
+		address: address,
+		faults: map[string]faults{
+			clientToServer: s.ClientToServer,
+			serverToClient: s.ServerToClient,
+		},
+		conns: make(map[*connection]bool),
+	}
+
+	listenNetwork, listenAddress := common.ParseServerAddress(*listen)
+	if listenNetwork == "unix" {
+		// A socket file left by a previous run would make Listen fail
+		os.Remove(listenAddress)
+	}
+	listener, err := net.Listen(listenNetwork, listenAddress)
+	if err != nil {
+		log.Criticalf("action: listen | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("action: listen | result: success | addr: %v | upstream: %v | scenario: %v | partitions: %v | seed: %v",
+		listener.Addr(),
+		*upstream,
+		*scenarioPath,
+		len(s.Partitions),
+		*seed,
+	)
+
+	if *control != "" {
+		go p.serveControl(*control)
+	}
+	for _, partition := range s.Partitions {
+		p.schedule(partition)
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Errorf("action: accept_connections | result: fail | error: %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		go p.handleConnection(conn)
+	}
+}
+
+// currentFaults Faults injected in the direction dir
+func (p *proxy) currentFaults(dir string) faults {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.faults[dir]
+}
+
+// setFaults Replaces the faults injected in the direction dir
+func (p *proxy) setFaults(dir string, f faults) {
+	p.mu.Lock()
+	p.faults[dir] = f
+	p.mu.Unlock()
+	log.Infof("action: set_faults | result: success | direction: %v | latency: %v | jitter: %v | bandwidth: %v | fragment: %v | reset_after: %v | blackhole: %v",
+		dir,
+		time.Duration(f.Latency),
+		time.Duration(f.Jitter),
+		f.Bandwidth,
+		f.Fragment,
+		f.ResetAfter,
+		f.Blackhole,
+	)
+}
+
+// partitioned Mode of the partition in course, or an empty string if
+// there is none
+func (p *proxy) partitioned() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.partition == nil || time.Now().After(p.partition.Until) {
+		return ""
+	}
+	return p.partition.Mode
+}
+
+// schedule Starts the partition once its start elapses, right away if
+// it is zero
+func (p *proxy) schedule(partition partition) {
+	if partition.Start == 0 {
+		p.startPartition(partition.Mode, time.Duration(partition.Duration))
+		return
+	}
+	time.AfterFunc(time.Duration(partition.Start), func() {
+		p.startPartition(partition.Mode, time.Duration(partition.Duration))
+	})
+}
+
+// startPartition Cuts the link for d. The connections open are reset
+// right away if the mode is partitionReset
+func (p *proxy) startPartition(mode string, d time.Duration) {
+	p.mu.Lock()
+	partition := &activePartition{Mode: mode, Until: time.Now().Add(d)}
+	p.partition = partition
+	p.mu.Unlock()
+	log.Infof("action: partition | result: in_progress | mode: %v | duration: %v", mode, d)
+
+	if mode == partitionReset {
+		p.resetAll("partition")
+	}
+	time.AfterFunc(d, func() {
+		p.mu.Lock()
+		healed := p.partition == partition
+		if healed {
+			p.partition = nil
+		}
+		p.mu.Unlock()
+		if healed {
+			log.Infof("action: partition | result: success | mode: %v | duration: %v", mode, d)
+		}
+	})
+}
+
+// heal Ends the partition in course, if any
+func (p *proxy) heal() {
+	p.mu.Lock()
+	partition := p.partition
+	p.partition = nil
+	p.mu.Unlock()
+	if partition != nil {
+		log.Infof("action: partition | result: success | mode: %v | healed: true", partition.Mode)
+	}
+}
+
+// resetAll Resets every connection open. Returns how many were
+func (p *proxy) resetAll(reason string) int {
+	p.mu.Lock()
+	conns := make([]*connection, 0, len(p.conns))
+	for c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		p.reset(c, reason)
+	}
+	return len(conns)
+}
+
+// reset Resets c, logging why
+func (p *proxy) reset(c *connection, reason string) {
+	atomic.AddInt64(&p.stats.Resets, 1)
+	log.Infof("action: reset_connection | result: success | connection: %v | client: %v | reason: %v", c.id, c.client.RemoteAddr(), reason)
+	c.reset()
+}
+
+// handleConnection Connects to the upstream server and forwards the
+// traffic of conn in both directions until both of them end
+func (p *proxy) handleConnection(conn net.Conn) {
+	if p.partitioned() == partitionReset {
+		log.Infof("action: accept_connections | result: fail | client: %v | error: partitioned", conn.RemoteAddr())
+		atomic.AddInt64(&p.stats.Resets, 1)
+		(&connection{client: conn, server: conn}).reset()
+		return
+	}
+
+	server, err := net.Dial(p.network, p.address)
+	if err != nil {
+		log.Errorf("action: connect_upstream | result: fail | client: %v | upstream: %v | error: %v", conn.RemoteAddr(), p.address, err)
+		conn.Close()
+		return
+	}
+
+	p.mu.Lock()
+	p.lastID++
+	c := &connection{id: p.lastID, client: conn, server: server}
+	p.conns[c] = true
+	p.mu.Unlock()
+	atomic.AddInt64(&p.stats.Open, 1)
+	atomic.AddInt64(&p.stats.Total, 1)
+	log.Infof("action: accept_connections | result: success | connection: %v | client: %v | upstream: %v", c.id, conn.RemoteAddr(), server.RemoteAddr())
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.pipe(c, clientToServer, c.client, c.server, &p.stats.ClientToServer)
+	}()
+	go func() {
+		defer wg.Done()
+		p.pipe(c, serverToClient, c.server, c.client, &p.stats.ServerToClient)
+	}()
+	wg.Wait()
+	c.close()
+
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+	atomic.AddInt64(&p.stats.Open, -1)
+	log.Infof("action: connection_closed | result: success | connection: %v | client: %v", c.id, conn.RemoteAddr())
+}
+
+// chunk Bytes read from one side, to be forwarded to the other one once
+// due
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+// pipe Reads from src and forwards to dst in the direction dir. Reading
+// and writing happen in different goroutines, so delayed chunks do not
+// stop the reads until pendingChunks are waiting
+func (p *proxy) pipe(c *connection, dir string, src net.Conn, dst net.Conn, stats *directionStats) {
+	chunks := make(chan chunk, pendingChunks)
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		p.deliver(c, dir, dst, chunks, stats)
+	}()
+
+	buf := make([]byte, readBufferSize)
+	var last time.Time
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			atomic.AddInt64(&stats.Read, int64(n))
+			f := p.currentFaults(dir)
+			delay := time.Duration(f.Latency)
+			if f.Jitter > 0 {
+				delay += time.Duration(rand.Int63n(int64(f.Jitter)))
+			}
+			// Jitter must not reorder the chunks
+			due := time.Now().Add(delay)
+			if due.Before(last) {
+				due = last
+			}
+			last = due
+			chunks <- chunk{data: append([]byte(nil), buf[:n]...), due: due}
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(chunks)
+	<-delivered
+}
+
+// deliver Writes the chunks to dst once due, applying the faults of the
+// direction dir at the time of writing each of them. Once every chunk is
+// written the write side of dst is closed
+func (p *proxy) deliver(c *connection, dir string, dst net.Conn, chunks <-chan chunk, stats *directionStats) {
+	// Chunks left once delivering stops are dropped so the reader never
+	// blocks
+	defer func() {
+		for range chunks {
+		}
+	}()
+
+	var forwarded int64
+	var next time.Time
+	for ch := range chunks {
+		time.Sleep(time.Until(ch.due))
+		f := p.currentFaults(dir)
+		if f.Blackhole || p.partitioned() == partitionDrop {
+			atomic.AddInt64(&stats.Dropped, int64(len(ch.data)))
+			continue
+		}
+
+		data := ch.data
+		reset := false
+		if f.ResetAfter > 0 && forwarded+int64(len(data)) >= f.ResetAfter {
+			limit := f.ResetAfter - forwarded
+			if limit < 0 {
+				limit = 0
+			}
+			data = data[:limit]
+			reset = true
+		}
+
+		// A piece takes at most 10ms of bandwidth so the rate is smooth
+		piece := len(data)
+		if f.Bandwidth > 0 && piece > f.Bandwidth/100 {
+			piece = f.Bandwidth/100 + 1
+		}
+		if f.Fragment > 0 && rand.Float64() < f.Fragment {
+			piece = 1
+		}
+		for len(data) > 0 {
+			n := piece
+			if n > len(data) {
+				n = len(data)
+			}
+			if f.Bandwidth > 0 {
+				if now := time.Now(); next.Before(now) {
+					next = now
+				}
+				next = next.Add(time.Duration(n) * time.Second / time.Duration(f.Bandwidth))
+				time.Sleep(time.Until(next))
+			}
+			if _, err := dst.Write(data[:n]); err != nil {
+				c.close()
+				return
+			}
+			data = data[n:]
+			forwarded += int64(n)
+			atomic.AddInt64(&stats.Forwarded, int64(n))
+		}
+
+		if reset {
+			p.reset(c, "reset_after "+dir)
+			return
+		}
+	}
+	closeWrite(dst)
+}
+
+// closeWrite Tells the other side no more bytes will be written, keeping
+// the connection open for the other direction if possible
+func closeWrite(conn net.Conn) {
+	type writeCloser interface {
+		CloseWrite() error
+	}
+	if wc, ok := conn.(writeCloser); ok {
+		wc.CloseWrite()
+		return
+	}
+	conn.Close()
+}
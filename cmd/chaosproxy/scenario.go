@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Directions of the traffic of a connection
+const (
+	clientToServer = "client_to_server"
+	serverToClient = "server_to_client"
+)
+
+// Modes of a partition
+const (
+	// partitionDrop Bytes are dropped in both directions while the
+	// connections stay open
+	partitionDrop = "drop"
+	// partitionReset Open connections are reset and new ones are reset as
+	// soon as they are accepted
+	partitionReset = "reset"
+)
+
+// duration Duration read and written as text, such as 150ms
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// faults Faults injected in one direction of every connection. They are
+// read for every chunk forwarded, so changing them affects the
+// connections already open
+type faults struct {
+	// Latency Delay added to every chunk
+	Latency duration `yaml:"latency" json:"latency"`
+	// Jitter Maximum random delay added on top of Latency. Chunks are
+	// never reordered
+	Jitter duration `yaml:"jitter" json:"jitter"`
+	// Bandwidth Bytes per second forwarded, unlimited if zero
+	Bandwidth int `yaml:"bandwidth" json:"bandwidth"`
+	// Fragment Probability of writing a chunk one byte at a time, to
+	// provoke short reads on the receiving side
+	Fragment float64 `yaml:"fragment" json:"fragment"`
+	// ResetAfter Bytes forwarded before the connection is reset, never if
+	// zero
+	ResetAfter int64 `yaml:"reset_after" json:"reset_after"`
+	// Blackhole Every byte is dropped while the connection stays open
+	Blackhole bool `yaml:"blackhole" json:"blackhole"`
+}
+
+// validate Returns an error if the faults cannot be applied
+func (f faults) validate() error {
+	if f.Latency < 0 || f.Jitter < 0 {
+		return errors.New("negative latency or jitter")
+	}
+	if f.Bandwidth < 0 {
+		return errors.Errorf("invalid bandwidth %v", f.Bandwidth)
+	}
+	if f.Fragment < 0 || f.Fragment > 1 {
+		return errors.Errorf("invalid fragment %v, must be between 0 and 1", f.Fragment)
+	}
+	if f.ResetAfter < 0 {
+		return errors.Errorf("invalid reset after %v", f.ResetAfter)
+	}
+	return nil
+}
+
+// partition Period in which the client and the server cannot reach each
+// other
+type partition struct {
+	// Start Time until the partition begins, since the proxy started for
+	// the partitions of the scenario and since the request for the ones
+	// posted to the control API
+	Start    duration `yaml:"start" json:"start"`
+	Duration duration `yaml:"duration" json:"duration"`
+	// Mode How the link is cut, see partitionDrop
+	Mode string `yaml:"mode" json:"mode"`
+}
+
+// validate Returns an error if the partition cannot be applied
+func (p partition) validate() error {
+	switch p.Mode {
+	case partitionDrop, partitionReset:
+	default:
+		return errors.Errorf("unknown mode %q, expected %v or %v", p.Mode, partitionDrop, partitionReset)
+	}
+	if p.Start < 0 || p.Duration <= 0 {
+		return errors.Errorf("invalid start %v or duration %v", time.Duration(p.Start), time.Duration(p.Duration))
+	}
+	return nil
+}
+
+// scenario Faults injected from the start and partitions scheduled, as
+// read from the scenario file
+type scenario struct {
+	ClientToServer faults      `yaml:"client_to_server" json:"client_to_server"`
+	ServerToClient faults      `yaml:"server_to_client" json:"server_to_client"`
+	Partitions     []partition `yaml:"partitions" json:"partitions"`
+}
+
+// loadScenario Reads the scenario of a YAML file, checking that every
+// fault of it can be applied
+func loadScenario(path string) (scenario, error) {
+	var s scenario
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return s, errors.Wrapf(err, "invalid scenario file %v", path)
+	}
+	if err := s.ClientToServer.validate(); err != nil {
+		return s, errors.Wrapf(err, "%v", clientToServer)
+	}
+	if err := s.ServerToClient.validate(); err != nil {
+		return s, errors.Wrapf(err, "%v", serverToClient)
+	}
+	for i, p := range s.Partitions {
+		if err := p.validate(); err != nil {
+			return s, errors.Wrapf(err, "partition %v", i+1)
+		}
+	}
+	return s, nil
+}
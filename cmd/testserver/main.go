@@ -0,0 +1,107 @@
+// Command testserver is a stand-in for the lottery server that speaks the
+// framed protocol of the client. It acknowledges every batch it receives
+// and can simulate a high latency link to exercise the pipelined sender.
+// Once the configured amount of agencies finished, the draw takes place
+// and the winners are pushed to the subscribed clients. It can also
+// store corrupted copies of some bets to exercise the reconciliation the
+// client makes when it finishes. Errors echo the session and request
+// IDs of the frame that caused them, and the span of every request can be
+// written to a trace file to line it up with the ones of the client.
+// The server itself lives in internal/testserver so the tests of the
+// client can run it in-process.
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testserver"
+)
+
+var log = logging.MustGetLogger("log")
+
+func main() {
+	addr := flag.String("addr", ":12345", "address to listen on, host:port or unix:///path/to.sock")
+	latency := flag.Duration("latency", 0, "delay added to every response")
+	jitter := flag.Duration("jitter", 0, "maximum random delay added on top of the latency to every ack, which reorders them")
+	agencies := flag.Int("agencies", 1, "agencies that must finish before the draw")
+	winningNumber := flag.String("winning-number", "7574", "number of the winning bets")
+	subscribe := flag.Bool("subscribe", true, "support subscriptions to the results, clients must poll otherwise")
+	maxBetsPerSecond := flag.Float64("max-bets-per-second", 0, "bets per second stored before answering BUSY, unlimited if zero")
+	protocols := flag.String("protocols", "1", "comma separated protocol versions supported")
+	pipelining := flag.Bool("pipelining", true, "let clients keep several batches in flight")
+	maxFrameSize := flag.Int("max-frame-size", common.MaxFrameSize, "biggest frame accepted")
+	compression := flag.Bool("compression", true, "accept compressed payloads and compress big responses")
+	maxDecompressedSize := flag.Int("max-decompressed-size", 64*1024, "biggest payload accepted after decompression")
+	checksum := flag.Bool("checksum", true, "let clients add a CRC32C trailer to every frame")
+	corruptEvery := flag.Int("corrupt-every", 0, "store a corrupted bet in every nth batch, never if zero")
+	trace := flag.Bool("trace", true, "let clients send their session and request IDs in every frame")
+	traceFile := flag.String("trace-file", "", "file the span of every request is appended to as a JSON line")
+	flag.Parse()
+
+	backend := logging.NewLogBackend(os.Stdout, "", 0)
+	logging.SetBackend(logging.NewBackendFormatter(backend, logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)))
+
+	network, address := common.ParseServerAddress(*addr)
+	if network == "unix" {
+		// A socket file left by a previous run would make Listen fail
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		log.Criticalf("action: listen | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("action: listen | result: success | addr: %v | latency: %v | jitter: %v | agencies: %v", listener.Addr(), *latency, *jitter, *agencies)
+
+	traceWriter, err := common.NewTraceWriter(*traceFile, common.TraceServer)
+	if err != nil {
+		log.Criticalf("action: open_trace | result: fail | file: %v | error: %v", *traceFile, err)
+		os.Exit(1)
+	}
+
+	config := testserver.Config{
+		Latency:             *latency,
+		Jitter:              *jitter,
+		Agencies:            *agencies,
+		WinningNumber:       *winningNumber,
+		MaxBetsPerSecond:    *maxBetsPerSecond,
+		MaxFrameSize:        *maxFrameSize,
+		MaxDecompressedSize: *maxDecompressedSize,
+		CorruptEvery:        *corruptEvery,
+		Trace:               traceWriter,
+	}
+	for _, p := range strings.Split(*protocols, ",") {
+		version, err := strconv.Atoi(p)
+		if err != nil {
+			log.Criticalf("action: parse_protocols | result: fail | error: %v", err)
+			os.Exit(1)
+		}
+		config.Protocols = append(config.Protocols, version)
+	}
+	if *pipelining {
+		config.Features = append(config.Features, common.FeaturePipelining)
+	}
+	if *subscribe {
+		config.Features = append(config.Features, common.FeaturePushResults)
+	}
+	if *compression {
+		config.Features = append(config.Features, common.FeatureCompression)
+	}
+	if *checksum {
+		config.Features = append(config.Features, common.FeatureChecksum)
+	}
+	if *trace {
+		config.Features = append(config.Features, common.FeatureTrace)
+	}
+
+	testserver.New(config).Serve(listener)
+}
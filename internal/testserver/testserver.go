@@ -0,0 +1,619 @@
+// Package testserver is a stand-in for the lottery server that speaks the
+// framed protocol of the client. It acknowledges every batch it receives
+// and can simulate a high latency link to exercise the pipelined sender.
+// Once the configured amount of agencies finished, the draw takes place
+// and the winners are pushed to the subscribed clients. It can also
+// store corrupted copies of some bets to exercise the reconciliation the
+// client makes when it finishes. Errors echo the session and request
+// IDs of the frame that caused them, and the span of every request can be
+// written to a trace file to line it up with the ones of the client.
+// It is served by cmd/testserver and run in-process by the tests of the
+// client.
+package testserver
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+var log = logging.MustGetLogger("log")
+
+// responseCompressionThreshold Smallest response payload compressed
+const responseCompressionThreshold = 256
+
+// delayedFrame Response that must not be written before due
+type delayedFrame struct {
+	frame common.Frame
+	due   time.Time
+}
+
+// lottery Bets stored by the server and state of the draw, shared by
+// every connection
+type lottery struct {
+	mu            sync.Mutex
+	agencies      int
+	winningNumber string
+	bets          map[string][]common.Bet
+	finished      map[string]bool
+	// drawn Closed once the draw took place
+	drawn chan struct{}
+}
+
+func newLottery(agencies int, winningNumber string) *lottery {
+	return &lottery{
+		agencies:      agencies,
+		winningNumber: winningNumber,
+		bets:          make(map[string][]common.Bet),
+		finished:      make(map[string]bool),
+		drawn:         make(chan struct{}),
+	}
+}
+
+func (l *lottery) store(bets []common.Bet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range bets {
+		l.bets[b.Agency] = append(l.bets[b.Agency], b)
+	}
+}
+
+// keys Keys of the distinct bets stored for agency, in storing order
+func (l *lottery) keys(agency string) []common.BetKey {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[common.BetKey]bool)
+	var keys []common.BetKey
+	for _, b := range l.bets[agency] {
+		key := common.BetKey{Document: b.Document, Number: b.Number}
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// submission Summary of the bets stored for agency
+func (l *lottery) submission(agency string) common.Submission {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return common.NewSubmission(agency, l.bets[agency])
+}
+
+// finish Records that the agency sent all its bets, making the draw once
+// every agency did
+func (l *lottery) finish(agency string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.finished[agency] {
+		return
+	}
+	l.finished[agency] = true
+	log.Infof("action: agency_finished | result: success | agency: %v | finished: %v/%v", agency, len(l.finished), l.agencies)
+	if len(l.finished) == l.agencies {
+		log.Infof("action: sorteo | result: success | winning_number: %v", l.winningNumber)
+		close(l.drawn)
+	}
+}
+
+func (l *lottery) isDrawn() bool {
+	select {
+	case <-l.drawn:
+		return true
+	default:
+		return false
+	}
+}
+
+// results Frames carrying the result of the draw for agency. Each winner
+// is listed once even if its bet was received more than once
+func (l *lottery) results(agency string) []common.Frame {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]bool)
+	var winners []string
+	for _, b := range l.bets[agency] {
+		if b.Number == l.winningNumber && !seen[b.Document] {
+			seen[b.Document] = true
+			winners = append(winners, b.Document)
+		}
+	}
+	return []common.Frame{
+		{Type: common.MsgDrawComplete, Payload: []byte(l.winningNumber)},
+		{Type: common.MsgWinners, Payload: []byte(strings.Join(winners, ";"))},
+	}
+}
+
+// capacity Bets per second the server can store, shared by every
+// connection. Batches beyond it are answered with BUSY
+type capacity struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newCapacity(rate float64) *capacity {
+	return &capacity{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take Takes room for bets, or returns how long to wait until there is
+// room for them
+func (c *capacity) take(bets int) (bool, time.Duration) {
+	if c.rate <= 0 {
+		return true, 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.tokens += now.Sub(c.last).Seconds() * c.rate
+	if c.tokens > c.rate {
+		c.tokens = c.rate
+	}
+	c.last = now
+
+	if c.tokens >= float64(bets) {
+		c.tokens -= float64(bets)
+		return true, 0
+	}
+	missing := float64(bets) - c.tokens
+	return false, time.Duration(missing / c.rate * float64(time.Second))
+}
+
+// corrupter Spoils one bet of every nth batch stored, as a faulty disk
+// would. It is shared by every connection
+type corrupter struct {
+	mu      sync.Mutex
+	every   int
+	batches int
+}
+
+// corrupt Returns bets with the number of the first one changed if the
+// batch is one of those spoiled
+func (c *corrupter) corrupt(bets []common.Bet) ([]common.Bet, bool) {
+	if c.every <= 0 || len(bets) == 0 {
+		return bets, false
+	}
+
+	c.mu.Lock()
+	c.batches++
+	spoil := c.batches%c.every == 0
+	c.mu.Unlock()
+	if !spoil {
+		return bets, false
+	}
+
+	corrupted := append([]common.Bet(nil), bets...)
+	corrupted[0].Number += "0"
+	return corrupted, true
+}
+
+// Config Behaviour of the server
+type Config struct {
+	// Latency Delay added to every response
+	Latency time.Duration
+	// Jitter Maximum random delay added on top of Latency to the response
+	// of every batch, so acks can arrive in a different order than the
+	// batches were sent
+	Jitter time.Duration
+	// Agencies Agencies that must finish before the draw
+	Agencies      int
+	WinningNumber string
+	// MaxBetsPerSecond Bets per second stored before answering BUSY,
+	// unlimited if zero
+	MaxBetsPerSecond float64
+	// Protocols Protocol versions supported
+	Protocols []int
+	// Features Features offered to the clients
+	Features            []string
+	MaxFrameSize        int
+	MaxDecompressedSize int
+	// CorruptEvery Stores a corrupted bet in every nth batch, never if zero
+	CorruptEvery int
+	// Trace Where the span of every request is written, nothing if nil
+	Trace *common.TraceWriter
+}
+
+// DefaultConfig Configuration of a server for a single agency that
+// supports every feature of the client and adds no faults
+func DefaultConfig() Config {
+	return Config{
+		Agencies:      1,
+		WinningNumber: "7574",
+		Protocols:     common.ProtocolVersions,
+		Features: []string{
+			common.FeaturePipelining,
+			common.FeaturePushResults,
+			common.FeatureCompression,
+			common.FeatureChecksum,
+			common.FeatureTrace,
+		},
+		MaxFrameSize:        common.MaxFrameSize,
+		MaxDecompressedSize: 64 * 1024,
+	}
+}
+
+// Server Behaviour of the server shared by every connection
+type Server struct {
+	lottery             *lottery
+	capacity            *capacity
+	corrupter           *corrupter
+	latency             time.Duration
+	jitter              time.Duration
+	protocols           []int
+	features            []string
+	maxFrameSize        int
+	maxDecompressedSize int
+	trace               *common.TraceWriter
+}
+
+// New Initializes a server with the given configuration
+func New(config Config) *Server {
+	return &Server{
+		lottery:             newLottery(config.Agencies, config.WinningNumber),
+		capacity:            newCapacity(config.MaxBetsPerSecond),
+		corrupter:           &corrupter{every: config.CorruptEvery},
+		latency:             config.Latency,
+		jitter:              config.Jitter,
+		protocols:           config.Protocols,
+		features:            config.Features,
+		maxFrameSize:        config.MaxFrameSize,
+		maxDecompressedSize: config.MaxDecompressedSize,
+		trace:               config.Trace,
+	}
+}
+
+// Serve Handles every connection accepted by listener in its own
+// goroutine. Returns once the listener is closed
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			log.Errorf("action: accept_connections | result: fail | error: %v", err)
+			continue
+		}
+		go s.HandleConnection(conn)
+	}
+}
+
+// Bets Bets stored for agency, in storing order
+func (s *Server) Bets(agency string) []common.Bet {
+	s.lottery.mu.Lock()
+	defer s.lottery.mu.Unlock()
+	return append([]common.Bet(nil), s.lottery.bets[agency]...)
+}
+
+// delay Time the responses to request are held before being written
+func (s *Server) delay(request common.Frame) time.Duration {
+	if request.Type != common.MsgBatch || s.jitter <= 0 {
+		return s.latency
+	}
+	return s.latency + time.Duration(rand.Int63n(int64(s.jitter)+1))
+}
+
+// writeResponses Writes the responses queued once each is due, the
+// earliest first. Responses due at the same time keep the order they were
+// queued in. The ones left when responses is closed are written too
+func writeResponses(conn net.Conn, responses <-chan delayedFrame) error {
+	var pending []delayedFrame
+	for {
+		var due <-chan time.Time
+		if len(pending) > 0 {
+			due = time.After(time.Until(pending[0].due))
+		}
+
+		select {
+		case r, ok := <-responses:
+			if !ok {
+				for _, r := range pending {
+					time.Sleep(time.Until(r.due))
+					if err := common.WriteFrame(conn, r.frame); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			i := sort.Search(len(pending), func(i int) bool { return pending[i].due.After(r.due) })
+			pending = append(pending, delayedFrame{})
+			copy(pending[i+1:], pending[i:])
+			pending[i] = r
+		case <-due:
+			if err := common.WriteFrame(conn, pending[0].frame); err != nil {
+				return err
+			}
+			pending = pending[1:]
+		}
+	}
+}
+
+// HandleConnection Reads frames until the client disconnects. Responses
+// are handed to a writer goroutine that holds each one until its due
+// time, so the delay applies per frame as on a slow link and does not
+// serialize the processing of the frames in flight. The first frame must
+// be the hello of the client
+func (s *Server) HandleConnection(conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr()
+	log.Infof("action: accept_connections | result: success | ip: %v", addr)
+
+	responses := make(chan delayedFrame, 64)
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		if err := writeResponses(conn, responses); err != nil {
+			log.Errorf("action: send_response | result: fail | ip: %v | error: %v", addr, err)
+			// The reads fail too so the connection is dropped
+			conn.Close()
+		}
+	}()
+	// Subscriptions push the results from their own goroutine, which must
+	// be done before responses is closed
+	closed := make(chan struct{})
+	var subscriptions sync.WaitGroup
+	defer func() {
+		close(closed)
+		subscriptions.Wait()
+		close(responses)
+		<-writerDone
+	}()
+	// flags Flags of every response, set once the session is agreed
+	var flags byte
+	// respond Queues frame as a response to request, echoing its IDs, and
+	// ends the span of request if it is the first response to it
+	respond := func(request common.Frame, span *common.Span, frame common.Frame) bool {
+		span.Finish(common.MessageName(frame.Type))
+		frame.Flags |= flags
+		frame.Session, frame.Request = request.Session, request.Request
+		select {
+		case responses <- delayedFrame{frame: frame, due: time.Now().Add(s.delay(request))}:
+			return true
+		case <-writerDone:
+			return false
+		case <-closed:
+			return false
+		}
+	}
+
+	// rejected Seq of the batch last answered with BUSY. Every other batch
+	// is rejected until it is received again
+	var rejected uint32
+	busy := func(seq uint32, retryAfter time.Duration) []common.Frame {
+		millis := strconv.FormatInt(int64(retryAfter/time.Millisecond)+1, 10)
+		return []common.Frame{{Type: common.MsgBusy, Seq: seq, Payload: []byte(millis)}}
+	}
+
+	var session *common.Session
+	// hello Hello of the client, whose session ID is used for the frames
+	// sent without FlagTrace
+	var hello common.Hello
+	for {
+		frame, err := common.ReadFrame(conn)
+		if err == common.ErrChecksumMismatch {
+			// The frame cannot be trusted, not even its seq, so the
+			// connection is dropped and the client sends it again
+			log.Warningf("action: receive_frame | result: fail | ip: %v | session_id: %v | error: %v", addr, hello.Session, err)
+			return
+		}
+		if err != nil {
+			log.Infof("action: connection_closed | result: success | ip: %v | session_id: %v | error: %v", addr, hello.Session, err)
+			return
+		}
+
+		if session == nil {
+			if frame.Type != common.MsgHello {
+				respond(frame, nil, errorFrame(frame, "expected a hello"))
+				return
+			}
+			hello, session, err = s.negotiate(addr, frame.Payload)
+			frame.Session, frame.Request = hello.Session, hello.Request
+			span := s.trace.StartSpan(frame, hello.Agency)
+			if err != nil {
+				log.Warningf("action: handshake | result: fail | ip: %v | session_id: %v | request_id: %v | error: %v", addr, frame.Session, frame.Request, err)
+				respond(frame, span, errorFrame(frame, err.Error()))
+				return
+			}
+			respond(frame, span, common.Frame{Type: common.MsgWelcome, Seq: frame.Seq, Payload: session.Encode()})
+			flags = session.Flags()
+			continue
+		}
+
+		if frame.Flags&common.FlagTrace == 0 {
+			frame.Session = hello.Session
+		}
+		span := s.trace.StartSpan(frame, hello.Agency)
+		if frame.Flags&common.FlagCompressed != 0 && !session.Has(common.FeatureCompression) {
+			respond(frame, span, errorFrame(frame, "compression was not agreed"))
+			return
+		}
+		frame, err = common.DecompressFrame(frame, s.maxDecompressedSize)
+		if err != nil {
+			log.Warningf("action: decompress | result: fail | ip: %v | session_id: %v | request_id: %v | seq: %v | error: %v", addr, frame.Session, frame.Request, frame.Seq, err)
+			respond(frame, span, errorFrame(frame, err.Error()))
+			return
+		}
+
+		var response []common.Frame
+		switch frame.Type {
+		case common.MsgBatch:
+			bets, err := common.DecodeBets(frame.Payload)
+			if err != nil {
+				response = []common.Frame{errorFrame(frame, err.Error())}
+				break
+			}
+			if rejected != 0 && frame.Seq != rejected {
+				response = busy(frame.Seq, 0)
+				break
+			}
+			if ok, retryAfter := s.capacity.take(len(bets)); !ok {
+				log.Debugf("action: receive_batch | result: busy | ip: %v | session_id: %v | request_id: %v | seq: %v | retry_after: %v", addr, frame.Session, frame.Request, frame.Seq, retryAfter)
+				rejected = frame.Seq
+				response = busy(frame.Seq, retryAfter)
+				break
+			}
+			rejected = 0
+			if corrupted, ok := s.corrupter.corrupt(bets); ok {
+				log.Warningf("action: receive_batch | result: corrupted | ip: %v | session_id: %v | request_id: %v | seq: %v | document: %v", addr, frame.Session, frame.Request, frame.Seq, bets[0].Document)
+				bets = corrupted
+			}
+			s.lottery.store(bets)
+			log.Debugf("action: receive_batch | result: success | ip: %v | session_id: %v | request_id: %v | seq: %v | bets: %v", addr, frame.Session, frame.Request, frame.Seq, len(bets))
+			response = []common.Frame{{Type: common.MsgAck, Seq: frame.Seq, Payload: []byte(strconv.Itoa(len(bets)))}}
+		case common.MsgPing:
+			response = []common.Frame{{Type: common.MsgPong, Seq: frame.Seq}}
+		case common.MsgFinished:
+			response = s.finish(addr, frame)
+		case common.MsgQueryBets:
+			response = s.storedBets(session, frame)
+		case common.MsgQueryWinners:
+			if !s.lottery.isDrawn() {
+				response = []common.Frame{{Type: common.MsgNotReady, Seq: frame.Seq}}
+				break
+			}
+			response = s.results(session, string(frame.Payload))
+		case common.MsgSubscribeResults:
+			if !session.Has(common.FeaturePushResults) {
+				response = []common.Frame{{Type: common.MsgUnsupported, Seq: frame.Seq}}
+				break
+			}
+			agency := string(frame.Payload)
+			log.Infof("action: subscribe_results | result: success | ip: %v | session_id: %v | request_id: %v | agency: %v", addr, frame.Session, frame.Request, agency)
+			// The ack must be queued before the results, which are sent
+			// right away if the draw already took place
+			respond(frame, span, common.Frame{Type: common.MsgAck, Seq: frame.Seq})
+			subscriptions.Add(1)
+			go func(request common.Frame) {
+				defer subscriptions.Done()
+				select {
+				case <-s.lottery.drawn:
+				case <-closed:
+					return
+				}
+				for _, f := range s.results(session, agency) {
+					if !respond(request, nil, f) {
+						return
+					}
+				}
+			}(frame)
+		default:
+			response = []common.Frame{{Type: common.MsgUnsupported, Seq: frame.Seq}}
+		}
+
+		for _, f := range response {
+			respond(frame, span, f)
+		}
+	}
+}
+
+// errorFrame Error response to request. The message echoes the session
+// and request IDs of request so the client logs can be matched with the
+// ones of the server
+func errorFrame(request common.Frame, msg string) common.Frame {
+	return common.Frame{
+		Type:    common.MsgError,
+		Seq:     request.Seq,
+		Payload: []byte(fmt.Sprintf("%v (session_id: %v, request_id: %v)", msg, request.Session, request.Request)),
+	}
+}
+
+// negotiate Agrees on a session with the client that sent hello
+func (s *Server) negotiate(addr net.Addr, payload []byte) (common.Hello, *common.Session, error) {
+	hello, err := common.DecodeHello(payload)
+	if err != nil {
+		return hello, nil, err
+	}
+	session, err := common.Negotiate(hello, s.protocols, s.features, s.maxFrameSize)
+	if err != nil {
+		return hello, nil, err
+	}
+	log.Infof("action: handshake | result: success | ip: %v | session_id: %v | request_id: %v | agency: %v | version: %v | protocol: %v | features: %v | max_frame_size: %v",
+		addr,
+		hello.Session,
+		hello.Request,
+		hello.Agency,
+		hello.Version,
+		session.Protocol,
+		strings.Join(session.Features, ","),
+		session.MaxFrameSize,
+	)
+	return hello, &session, nil
+}
+
+// finish Records that the agency of the client finished and answers with
+// the summary of the bets stored for it, logging whether it matches the
+// one sent by the client. Clients that predate the summary send just the
+// agency
+func (s *Server) finish(addr net.Addr, frame common.Frame) []common.Frame {
+	sent := common.Submission{Agency: string(frame.Payload)}
+	if strings.Contains(sent.Agency, "=") {
+		var err error
+		sent, err = common.DecodeSubmission(frame.Payload)
+		if err != nil {
+			return []common.Frame{errorFrame(frame, err.Error())}
+		}
+	}
+
+	stored := s.lottery.submission(sent.Agency)
+	if sent.Digest != "" && !sent.Matches(stored) {
+		log.Warningf("action: reconcile | result: fail | ip: %v | session_id: %v | request_id: %v | agency: %v | sent_bets: %v | stored_bets: %v | sent_digest: %v | stored_digest: %v",
+			addr,
+			frame.Session,
+			frame.Request,
+			sent.Agency,
+			sent.Bets,
+			stored.Bets,
+			sent.Digest,
+			stored.Digest,
+		)
+	}
+	s.lottery.finish(sent.Agency)
+	return []common.Frame{{Type: common.MsgAck, Seq: frame.Seq, Payload: stored.Encode()}}
+}
+
+// storedBets Frames carrying the keys of the bets stored for the agency in
+// the query, followed by the ack with their summary
+func (s *Server) storedBets(session *common.Session, query common.Frame) []common.Frame {
+	agency := string(query.Payload)
+	var frames []common.Frame
+	for _, payload := range common.EncodeBetKeys(s.lottery.keys(agency), session.MaxPayloadSize()) {
+		frame := common.Frame{Type: common.MsgStoredBets, Seq: query.Seq, Payload: payload}
+		if session.Has(common.FeatureCompression) {
+			if compressed, err := common.CompressFrame(frame, responseCompressionThreshold); err == nil {
+				frame = compressed
+			}
+		}
+		frames = append(frames, frame)
+	}
+	frames = append(frames, common.Frame{Type: common.MsgAck, Seq: query.Seq, Payload: s.lottery.submission(agency).Encode()})
+	log.Infof("action: query_bets | result: success | session_id: %v | request_id: %v | agency: %v | frames: %v", query.Session, query.Request, agency, len(frames))
+	return frames
+}
+
+// results Frames carrying the result of the draw for agency, compressed
+// if the session allows it and they are big enough
+func (s *Server) results(session *common.Session, agency string) []common.Frame {
+	frames := s.lottery.results(agency)
+	if !session.Has(common.FeatureCompression) {
+		return frames
+	}
+	for i, f := range frames {
+		if compressed, err := common.CompressFrame(f, responseCompressionThreshold); err == nil {
+			frames[i] = compressed
+		}
+	}
+	return frames
+}